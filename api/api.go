@@ -10,10 +10,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"time"
 
 	"github.com/spf13/afero"
 
+	"github.com/aukletio/Auklet-Client-C/errorlog"
 	"github.com/aukletio/Auklet-Client-C/fsutil"
 )
 
@@ -31,6 +34,7 @@ const (
 type Fs interface {
 	Open(string) (afero.File, error)
 	OpenFile(string, int, os.FileMode) (afero.File, error)
+	Rename(string, string) error
 }
 
 // API provides an interface to the backend.
@@ -42,10 +46,18 @@ type API struct {
 	AppID   string
 	MacHash string
 
+	// Client performs requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+
 	// for credentials
 	CredsPath string // where to save/load credentials
 	Fs        Fs     // filesystem for saving/loading
 
+	// Rotate, if not nil, gives the device a new identity under which it
+	// can register again. It returns the new MacHash, and a function that
+	// restores the previous one.
+	Rotate func() (macHash string, restore func() error, err error)
+
 	ReleasesEP     string
 	CertificatesEP string
 	DevicesEP      string
@@ -53,13 +65,27 @@ type API struct {
 	DataLimitEP    string
 }
 
+// do sends req with a.Client.
+func (a API) do(req *http.Request) (*http.Response, error) {
+	if a.Client == nil {
+		return http.DefaultClient.Do(req)
+	}
+	return a.Client.Do(req)
+}
+
+// ProxyClient returns a client that sends requests through the proxy at u.
+// HTTP and SOCKS5 proxies are supported, with credentials given in u.
+func ProxyClient(u *url.URL) *http.Client {
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+}
+
 // Release is an API call that checks whether
 // the given checksum has been released.
 func (a API) Release(checksum string) error {
 	url := a.BaseURL + a.ReleasesEP + "?checksum=" + checksum
 	req, _ := http.NewRequest("GET", url, nil)
 	req.Header.Add("Authorization", "JWT "+a.Key)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := a.do(req)
 	if err != nil {
 		return fmt.Errorf("checking release %v: %v", checksum, err)
 	}
@@ -82,7 +108,7 @@ func (a API) Certificates() (*tls.Config, error) {
 	url := a.BaseURL + a.CertificatesEP
 	req, _ := http.NewRequest("GET", url, nil)
 	req.Header.Add("Authorization", "JWT "+a.Key)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := a.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("getting certificates: %v", err)
 	}
@@ -132,7 +158,7 @@ func (a API) credentials() (*Credentials, error) {
 	req, _ := http.NewRequest("POST", url, bytes.NewReader(b))
 	req.Header.Add("content-type", "application/json")
 	req.Header.Add("Authorization", "JWT "+a.Key)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := a.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("getting broker credentials: %v", err)
 	}
@@ -155,12 +181,18 @@ func decodeCredentials(data []byte) (*Credentials, error) {
 	}
 
 	if c.Password == "" {
-		return nil, errors.New("empty password")
+		return nil, errIssued
 	}
 
 	return c, nil
 }
 
+// errIssued means that the device cannot register again, because the backend
+// issues a device's credentials only once.
+var errIssued = errors.New("empty password: credentials for this device " +
+	"have already been issued; delete the device in the backend so that it " +
+	"can register again")
+
 // Credentialer provides a way to get Credentials.
 type Credentialer interface {
 	Credentials() (*Credentials, error)
@@ -168,14 +200,91 @@ type Credentialer interface {
 
 // Credentials retrieves credentials from the filesystem,
 // with a fallback to the API. If credentials are retrieved
-// from the API, they are saved to the filesystem.
-func (a API) Credentials() (*Credentials, error) {
-	// Not covered in tests, as its callees are covered.
-
+// from the API, they are saved to the filesystem. If the backend has
+// already issued them, the device registers under a new identity.
+func (a *API) Credentials() (*Credentials, error) {
 	c, err := credsFromFile(a.CredsPath, a.Fs.Open)
+	if err == nil && c.Password != "" {
+		return c, nil
+	}
+	if _, corrupt := err.(errEncoding); corrupt || err == nil {
+		// The file exists, but is unusable. Keep it for diagnosis.
+		errorlog.Printf("API.Credentials: unusable credentials file %v: %v", a.CredsPath, err)
+		if _, err := a.backupCredentials(); err != nil {
+			errorlog.Printf("API.Credentials: %v", err)
+		}
+	}
+	// ask the API for credentials
+	c, err = a.getAndSaveCredentials()
+	if err != errIssued {
+		return c, err
+	}
+	// The credentials issued to this device are lost.
+	errorlog.Printf("API.Credentials: device %v: %v; registering under a new identity", a.MacHash, err)
+	if c, err = a.register(); err != nil {
+		errorlog.Printf("API.Credentials: %v", err)
+		return nil, err
+	}
+	errorlog.Printf("API.Credentials: registered as device %v", a.MacHash)
+	return c, nil
+}
+
+// backupCredentials renames the credentials file, so that the next call to
+// Credentials registers the device again, and returns its new path.
+func (a API) backupCredentials() (string, error) {
+	backup := fmt.Sprintf("%v.%v.bak", a.CredsPath, time.Now().Unix())
+	if err := a.Fs.Rename(a.CredsPath, backup); err != nil {
+		return "", fmt.Errorf("could not back up credentials: %v", err)
+	}
+	errorlog.Printf("API.backupCredentials: moved %v to %v", a.CredsPath, backup)
+	return backup, nil
+}
+
+// Reregister replaces credentials that the broker rejected. Since the
+// backend issues a device's credentials only once, the device registers
+// under a new identity, from a.Rotate. If it cannot, the credentials and
+// the identity are restored.
+func (a *API) Reregister() error {
+	if a.Rotate == nil {
+		return errNoRotate
+	}
+	backup, err := a.backupCredentials()
 	if err != nil {
-		// file doesn't exist; ask the API for credentials
-		return a.getAndSaveCredentials()
+		return err
+	}
+	if _, err = a.register(); err == nil {
+		return nil
+	}
+	if rerr := a.Fs.Rename(backup, a.CredsPath); rerr != nil {
+		errorlog.Printf("API.Reregister: could not restore credentials: %v", rerr)
+	}
+	return fmt.Errorf("registering again: %v", err)
+}
+
+// errNoRotate means that the device cannot register again, since it has no
+// way to change its identity.
+var errNoRotate = errors.New("the device cannot register under a new identity")
+
+// register registers the device under a new identity, from a.Rotate, and
+// saves the credentials issued to it. If it cannot, the identity is
+// restored.
+func (a *API) register() (*Credentials, error) {
+	if a.Rotate == nil {
+		return nil, errNoRotate
+	}
+	macHash, restoreID, err := a.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	prev := a.MacHash
+	a.MacHash = macHash
+	c, err := a.getAndSaveCredentials()
+	if err != nil {
+		a.MacHash = prev
+		if rerr := restoreID(); rerr != nil {
+			errorlog.Printf("API.register: could not restore identity: %v", rerr)
+		}
+		return nil, err
 	}
 	return c, nil
 }
@@ -224,7 +333,7 @@ func (a API) BrokerAddress() (string, error) {
 	req, _ := http.NewRequest("GET", a.BaseURL+a.ConfigEP, nil)
 	req.Header.Add("content-type", "application/json")
 	req.Header.Add("Authorization", "JWT "+a.Key)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := a.do(req)
 	if err != nil {
 		return "", fmt.Errorf("getting broker address: %v", err)
 	}
@@ -234,19 +343,31 @@ func (a API) BrokerAddress() (string, error) {
 	var k struct {
 		Broker string `json:"brokers"`
 		Port   string `json:"port"`
+
+		// If Transport is "wss", the broker is to be reached over
+		// WebSockets on WSPort.
+		Transport string `json:"transport"`
+		WSPort    string `json:"ws_port"`
 	}
 	body, _ := ioutil.ReadAll(resp.Body)
 	if err := json.Unmarshal(body, &k); err != nil {
 		return "", errEncoding{err, string(body), "BrokerAddress"}
 	}
+	if k.Transport == "wss" {
+		if k.WSPort == "" {
+			k.WSPort = "443"
+		}
+		return fmt.Sprintf("wss://%s:%s/mqtt", k.Broker, k.WSPort), nil
+	}
 	return fmt.Sprintf("ssl://%s:%s", k.Broker, k.Port), nil
 }
 
 // DataLimit holds parameters controlling Auklet's data usage.
 type DataLimit struct {
-	Storage        *int64
-	EmissionPeriod int
-	Cellular       CellularConfig
+	Storage         *int64
+	EmissionPeriod  int
+	Cellular        CellularConfig
+	HeartbeatPeriod int // seconds; zero selects the client's default
 }
 
 // CellularConfig holds parameters for a cellular plan.
@@ -266,7 +387,7 @@ func (a API) DataLimit() (*DataLimit, error) {
 	}
 	req.Header.Add("content-type", "application/json")
 	req.Header.Add("Authorization", "JWT "+a.Key)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := a.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("getting data limit configuration: %v", err)
 	}
@@ -281,9 +402,10 @@ func (a API) DataLimit() (*DataLimit, error) {
 		Date  int  `json:"normalized_cell_plan_date"`
 	}
 	type config struct {
-		EmissionPeriod int     `json:"emission_period"`
-		Storage        storage `json:"storage"`
-		Data           data    `json:"data"`
+		EmissionPeriod  int     `json:"emission_period"`
+		Storage         storage `json:"storage"`
+		Data            data    `json:"data"`
+		HeartbeatPeriod int     `json:"heartbeat_period"`
 	}
 	var l struct {
 		Config config `json:"config"`
@@ -294,8 +416,9 @@ func (a API) DataLimit() (*DataLimit, error) {
 	}
 	c := l.Config
 	return &DataLimit{
-		Storage:        c.Storage.Limit,
-		EmissionPeriod: c.EmissionPeriod,
+		Storage:         c.Storage.Limit,
+		EmissionPeriod:  c.EmissionPeriod,
+		HeartbeatPeriod: c.HeartbeatPeriod,
 		Cellular: CellularConfig{
 			Date:    c.Data.Date,
 			Defined: c.Data.Limit != nil,
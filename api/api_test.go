@@ -1,6 +1,8 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -181,3 +183,214 @@ func TestDataLimit(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestCredentials(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(201)
+		w.Write([]byte(`{"client_password":"new"}`))
+	}))
+	defer s.Close()
+
+	cases := []struct {
+		file     string // contents of the credentials file; empty if absent
+		password string
+		backup   bool
+	}{
+		{file: "", password: "new", backup: false},
+		{file: `{"client_password":"old"}`, password: "old", backup: false},
+		{file: `{"client_password":""}`, password: "new", backup: true},
+		{file: `{`, password: "new", backup: true},
+	}
+
+	for i, c := range cases {
+		fs := afero.NewMemMapFs()
+		if c.file != "" {
+			if err := fsutil.WriteFile(fs.OpenFile, "creds", []byte(c.file)); err != nil {
+				panic(err)
+			}
+		}
+		api := API{
+			BaseURL:   s.URL,
+			DevicesEP: DevicesEP,
+			CredsPath: "creds",
+			Fs:        fs,
+		}
+		creds, err := api.Credentials()
+		if err != nil {
+			t.Errorf("case %v: %v", i, err)
+			continue
+		}
+		if creds.Password != c.password {
+			t.Errorf("case %v: expected %v, got %v", i, c.password, creds.Password)
+		}
+		backups, _ := afero.Glob(fs, "creds.*.bak")
+		if backup := len(backups) > 0; backup != c.backup {
+			t.Errorf("case %v: expected backup %v, got %v", i, c.backup, backup)
+		}
+	}
+}
+
+// onceBackend is a backend that, like the real one, issues each device's
+// credentials only once, recording them in issued.
+func onceBackend(issued map[string]bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var dev struct {
+			Mac string `json:"mac_address_hash"`
+		}
+		json.NewDecoder(r.Body).Decode(&dev)
+		w.WriteHeader(201)
+		if issued[dev.Mac] {
+			w.Write([]byte(`{"client_password":""}`))
+			return
+		}
+		issued[dev.Mac] = true
+		fmt.Fprintf(w, `{"client_password":"for %v"}`, dev.Mac)
+	}))
+}
+
+// rotate returns a Rotate function that yields macHash and err.
+func rotate(macHash string, err error) func() (string, func() error, error) {
+	return func() (string, func() error, error) {
+		return macHash, func() error { return nil }, err
+	}
+}
+
+func TestCredentialsIssued(t *testing.T) {
+	issued := make(map[string]bool)
+	s := onceBackend(issued)
+	defer s.Close()
+
+	cases := []struct {
+		file     string // contents of the credentials file; empty if absent
+		rotate   func() (string, func() error, error)
+		macHash  string
+		password string
+		ok       bool
+	}{
+		{rotate: rotate("new", nil), macHash: "new", password: "for new", ok: true},
+		{file: `{"client_password":""}`, rotate: rotate("new", nil), macHash: "new", password: "for new", ok: true},
+		{rotate: rotate("", errors.New("read-only")), macHash: "old", ok: false},
+		{rotate: nil, macHash: "old", ok: false},
+	}
+
+	for i, c := range cases {
+		fs := afero.NewMemMapFs()
+		if c.file != "" {
+			if err := fsutil.WriteFile(fs.OpenFile, "creds", []byte(c.file)); err != nil {
+				panic(err)
+			}
+		}
+		api := API{
+			BaseURL:   s.URL,
+			MacHash:   "old",
+			DevicesEP: DevicesEP,
+			CredsPath: "creds",
+			Fs:        fs,
+			Rotate:    c.rotate,
+		}
+		// The credentials of the device were issued, and lost.
+		issued["old"], issued["new"] = true, false
+		creds, err := api.Credentials()
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("case %v: expected %v, got %v", i, c.ok, err)
+		}
+		if api.MacHash != c.macHash {
+			t.Errorf("case %v: expected %v, got %v", i, c.macHash, api.MacHash)
+		}
+		if !c.ok {
+			continue
+		}
+		saved, err := credsFromFile("creds", fs.Open)
+		if err != nil || creds.Password != c.password || saved.Password != c.password {
+			t.Errorf("case %v: expected %v, got %v and saved %v %v", i, c.password, creds, saved, err)
+		}
+	}
+}
+
+func TestReregister(t *testing.T) {
+	issued := make(map[string]bool)
+	s := onceBackend(issued)
+	defer s.Close()
+
+	cases := []struct {
+		rotate   func() (string, func() error, error)
+		macHash  string
+		password string
+		ok       bool
+	}{
+		{rotate: rotate("new", nil), macHash: "new", password: "for new", ok: true},
+		{rotate: rotate("old", nil), macHash: "old", password: "for old", ok: false}, // already issued
+		{rotate: rotate("", errors.New("read-only")), macHash: "old", password: "for old", ok: false},
+		{rotate: nil, macHash: "old", password: "for old", ok: false},
+	}
+
+	for i, c := range cases {
+		fs := afero.NewMemMapFs()
+		api := API{
+			BaseURL:   s.URL,
+			MacHash:   "old",
+			DevicesEP: DevicesEP,
+			CredsPath: "creds",
+			Fs:        fs,
+			Rotate:    c.rotate,
+		}
+		issued["old"] = false
+		if _, err := api.Credentials(); err != nil {
+			t.Fatal(err)
+		}
+		err := api.Reregister()
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("case %v: expected %v, got %v", i, c.ok, err)
+		}
+		if api.MacHash != c.macHash {
+			t.Errorf("case %v: expected %v, got %v", i, c.macHash, api.MacHash)
+		}
+		// Failures restore the previous credentials.
+		creds, err := credsFromFile("creds", fs.Open)
+		if err != nil || creds.Password != c.password {
+			t.Errorf("case %v: expected %v, got %v %v", i, c.password, creds, err)
+		}
+	}
+}
+
+func TestDecodeCredentials(t *testing.T) {
+	if _, err := decodeCredentials([]byte(`{"client_password":""}`)); err != errIssued {
+		t.Errorf("expected %v, got %v", errIssued, err)
+	}
+}
+
+func TestBrokerAddressTransport(t *testing.T) {
+	cases := []struct {
+		body   string
+		expect string
+	}{
+		{
+			body:   `{"brokers":"broker","port":"8883"}`,
+			expect: "ssl://broker:8883",
+		}, {
+			body:   `{"brokers":"broker","port":"8883","transport":"wss"}`,
+			expect: "wss://broker:443/mqtt",
+		}, {
+			body:   `{"brokers":"broker","port":"8883","transport":"wss","ws_port":"8443"}`,
+			expect: "wss://broker:8443/mqtt",
+		},
+	}
+
+	for i, c := range cases {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(c.body))
+		}))
+		api := API{
+			BaseURL:  s.URL,
+			ConfigEP: ConfigEP,
+		}
+		got, err := api.BrokerAddress()
+		s.Close()
+		if err != nil {
+			t.Errorf("case %v: %v", i, err)
+		}
+		if got != c.expect {
+			t.Errorf("case %v: expected %v, got %v", i, c.expect, got)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/aukletio/Auklet-Client-C/fsutil"
+)
+
+// Bundle holds everything a device needs to send broker messages without
+// registering itself with the backend. Bundles are generated ahead of time,
+// so that devices need not hold an API key.
+type Bundle struct {
+	AppID       string      `json:"application"`
+	Credentials Credentials `json:"credentials"`
+	Broker      string      `json:"broker"` // e.g. ssl://host:port
+	CA          string      `json:"ca"`     // PEM-encoded certificates
+}
+
+// signedBundle is the file format of a Bundle. Signature, if present, is the
+// base64-encoded ASN.1 ECDSA signature of the SHA-256 hash of the exact bytes
+// of the bundle field, as they appear in the file.
+type signedBundle struct {
+	Bundle    json.RawMessage `json:"bundle"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+var (
+	errUnsigned     = errors.New("not signed")
+	errBadSignature = errors.New("signature verification failed")
+	errNotECDSA     = errors.New("verification key is not an ECDSA public key")
+)
+
+// ParseBundle decodes and validates a bundle file. If key is not nil, it must
+// hold a PEM-encoded ECDSA public key, and the bundle must carry a valid
+// signature made with the corresponding private key.
+func ParseBundle(data, key []byte) (*Bundle, error) {
+	var s signedBundle
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errEncoding{err, string(data), "ParseBundle"}
+	}
+
+	if key != nil {
+		if err := Verify(s.Bundle, s.Signature, key); err != nil {
+			return nil, fmt.Errorf("bundle: %v", err)
+		}
+	} else if s.Signature != "" {
+		log.Print("provision: bundle is signed, but no key was given to verify it")
+	}
+
+	b := new(Bundle)
+	if err := json.Unmarshal(s.Bundle, b); err != nil {
+		return nil, errEncoding{err, string(s.Bundle), "ParseBundle"}
+	}
+	return b, b.validate()
+}
+
+// Verify reports whether signature is the base64-encoded ASN.1 ECDSA signature
+// of the SHA-256 hash of data, made with the private key corresponding to the
+// PEM-encoded public key.
+func Verify(data []byte, signature string, key []byte) error {
+	if signature == "" {
+		return errUnsigned
+	}
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return errors.New("verification key is not PEM-encoded")
+	}
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("parsing verification key: %v", err)
+	}
+	pub, ok := k.(*ecdsa.PublicKey)
+	if !ok {
+		return errNotECDSA
+	}
+	der, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errBadSignature
+	}
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return errBadSignature
+	}
+	hash := sha256.Sum256(data)
+	if !ecdsa.Verify(pub, hash[:], sig.R, sig.S) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// validate reports whether b is complete.
+func (b Bundle) validate() error {
+	switch {
+	case b.Credentials.Username == "" || b.Credentials.Password == "":
+		return errors.New("bundle lacks credentials")
+	case b.Broker == "":
+		return errors.New("bundle lacks broker address")
+	}
+	_, err := tlsConfig([]byte(b.CA))
+	return err
+}
+
+// LoadBundle reads a previously imported Bundle from path.
+func LoadBundle(path string, open openFunc) (*Bundle, error) {
+	data, err := readFile(path, open)
+	if err != nil {
+		return nil, err
+	}
+	b := new(Bundle)
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, errEncoding{err, string(data), "LoadBundle"}
+	}
+	return b, nil
+}
+
+// Save writes b to path, from where it can be loaded with LoadBundle. Since
+// b holds broker credentials, only the owner can read a new file.
+func (b Bundle) Save(path string, openFile fsutil.OpenFileFunc) error {
+	data, _ := json.Marshal(b)
+	if err := fsutil.WriteFileMode(openFile, path, data, 0600); err != nil {
+		return fmt.Errorf("could not write bundle: %v", err)
+	}
+	return nil
+}
+
+// Provisioned is an API whose broker parameters come from a Bundle, rather
+// than from the device endpoints of the backend.
+type Provisioned struct {
+	API
+	Bundle *Bundle
+}
+
+// Credentials returns the bundle's credentials.
+func (p Provisioned) Credentials() (*Credentials, error) {
+	c := p.Bundle.Credentials
+	return &c, nil
+}
+
+// BrokerAddress returns the bundle's broker address.
+func (p Provisioned) BrokerAddress() (string, error) {
+	return p.Bundle.Broker, nil
+}
+
+// Certificates returns the bundle's CA certificates.
+func (p Provisioned) Certificates() (*tls.Config, error) {
+	return tlsConfig([]byte(p.Bundle.CA))
+}
+
+// Reregister fails, because the bundle's credentials cannot be replaced
+// without importing a new bundle.
+func (p Provisioned) Reregister() error {
+	return errors.New("provisioned credentials were rejected; import a new bundle")
+}
+
+// Release checks whether checksum has been released. Without an API key, the
+// check cannot be performed, and the executable is assumed to be released.
+func (p Provisioned) Release(checksum string) error {
+	if p.Key == "" {
+		log.Printf("provision: no API key; skipping release check of %v", checksum)
+		return nil
+	}
+	return p.API.Release(checksum)
+}
+
+// DataLimit retrieves DataLimit parameters from the backend. Without an API
+// key, there are none, and no limit applies.
+func (p Provisioned) DataLimit() (*DataLimit, error) {
+	if p.Key == "" {
+		return nil, nil
+	}
+	return p.API.DataLimit()
+}
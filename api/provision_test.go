@@ -0,0 +1,152 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// testKey returns a new ECDSA key and its PEM-encoded public key.
+func testKey() (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// testCA returns a PEM-encoded self-signed certificate.
+func testCA(key *ecdsa.PrivateKey) string {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// sign returns a bundle file holding payload, signed with key if not nil.
+func sign(payload []byte, key *ecdsa.PrivateKey) []byte {
+	s := signedBundle{Bundle: payload}
+	if key != nil {
+		hash := sha256.Sum256(payload)
+		r, ss, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		if err != nil {
+			panic(err)
+		}
+		der, _ := asn1.Marshal(struct{ R, S *big.Int }{r, ss})
+		s.Signature = base64.StdEncoding.EncodeToString(der)
+	}
+	b, _ := json.Marshal(s)
+	return b
+}
+
+func TestParseBundle(t *testing.T) {
+	key, pub := testKey()
+	_, otherPub := testKey()
+	valid, _ := json.Marshal(Bundle{
+		AppID:       "app",
+		Credentials: Credentials{Username: "user", Password: "pass"},
+		Broker:      "ssl://broker:8883",
+		CA:          testCA(key),
+	})
+	incomplete, _ := json.Marshal(Bundle{Broker: "ssl://broker:8883"})
+	badCA, _ := json.Marshal(Bundle{
+		Credentials: Credentials{Username: "user", Password: "pass"},
+		Broker:      "ssl://broker:8883",
+		CA:          "garbage",
+	})
+	tampered := sign(valid, key)
+	tampered[len(tampered)-10] ^= 1 // corrupt the signature
+
+	cases := []struct {
+		data []byte
+		key  []byte
+		ok   bool
+	}{
+		{data: []byte("{"), ok: false},
+		{data: sign(valid, nil), ok: true},
+		{data: sign(valid, key), ok: true},
+		{data: sign(valid, key), key: pub, ok: true},
+		{data: sign(valid, nil), key: pub, ok: false},
+		{data: sign(valid, key), key: otherPub, ok: false},
+		{data: tampered, key: pub, ok: false},
+		{data: sign(valid, key), key: []byte("not pem"), ok: false},
+		{data: sign(incomplete, nil), ok: false},
+		{data: sign(badCA, nil), ok: false},
+	}
+
+	for i, c := range cases {
+		_, err := ParseBundle(c.data, c.key)
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("case %v: expected %v, got %v: %v", i, c.ok, ok, err)
+		}
+	}
+}
+
+func TestBundleSave(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	b := Bundle{
+		AppID:       "app",
+		Credentials: Credentials{Username: "user", Password: "pass"},
+		Broker:      "ssl://broker:8883",
+	}
+	if err := b.Save("bundle.json", fs.OpenFile); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fs.Stat("bundle.json"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info)
+	}
+	got, err := LoadBundle("bundle.json", fs.Open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != b {
+		t.Errorf("expected %v, got %v", b, *got)
+	}
+}
+
+func TestProvisioned(t *testing.T) {
+	p := Provisioned{
+		API: API{BaseURL: "http://invalid.invalid"},
+		Bundle: &Bundle{
+			Credentials: Credentials{Username: "user", Password: "pass"},
+			Broker:      "ssl://broker:8883",
+		},
+	}
+	if addr, _ := p.BrokerAddress(); addr != p.Bundle.Broker {
+		t.Errorf("expected %v, got %v", p.Bundle.Broker, addr)
+	}
+	if c, _ := p.Credentials(); *c != p.Bundle.Credentials {
+		t.Errorf("expected %v, got %v", p.Bundle.Credentials, *c)
+	}
+	// Without a key, the backend must not be contacted.
+	if err := p.Release("checksum"); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if dl, err := p.DataLimit(); dl != nil || err != nil {
+		t.Errorf("expected no limit, got %v %v", dl, err)
+	}
+}
@@ -12,6 +12,9 @@ import (
 	"os"
 	"os/exec"
 	"syscall"
+	"time"
+
+	"github.com/aukletio/Auklet-Client-C/device"
 )
 
 // Exec represents an executable.
@@ -26,6 +29,11 @@ type Exec struct {
 	// state initialized after the process starts
 	agentVersion string
 	decoder      *json.Decoder // reading from agentData
+	start        time.Time
+	exited       chan struct{} // closed when the process exits
+
+	// state initialized after the process exits
+	stop time.Time
 }
 
 // NewExec creates a new executable from one or more arguments.
@@ -80,7 +88,19 @@ func (exec *Exec) Start() error {
 	for _, file := range exec.cmd.ExtraFiles {
 		defer file.Close()
 	}
-	return exec.cmd.Start()
+	exec.start = time.Now()
+	if err := exec.cmd.Start(); err != nil {
+		return err
+	}
+	// The process is reaped as soon as it exits, so that its runtime does
+	// not depend on when Wait is first called.
+	exec.exited = make(chan struct{})
+	go func() {
+		exec.cmd.Wait()
+		exec.stop = time.Now()
+		close(exec.exited)
+	}()
+	return nil
 }
 
 var (
@@ -119,8 +139,13 @@ func (exec *Exec) getAgentVersion() error {
 	return nil
 }
 
-// Wait waits for the process to exit.
-func (exec *Exec) Wait() { exec.cmd.Wait() }
+// Wait waits for the process to exit. It returns at once if the process was
+// never started.
+func (exec *Exec) Wait() {
+	if exec.exited != nil {
+		<-exec.exited
+	}
+}
 
 // CheckSum returns the executable file's SHA512/224 sum.
 func (exec *Exec) CheckSum() string {
@@ -153,6 +178,36 @@ func (exec *Exec) Signal() string {
 	return sig
 }
 
+// Usage returns the resources consumed by the process over its lifetime.
+func (exec *Exec) Usage() device.Usage {
+	exec.Wait()
+	if exec.cmd.ProcessState == nil {
+		// The process never started.
+		return device.Usage{}
+	}
+	u := device.Usage{
+		Runtime: milliseconds(exec.stop.Sub(exec.start)),
+	}
+	ru, ok := exec.cmd.ProcessState.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return u
+	}
+	u.MaxRSS = int64(ru.Maxrss) // kilobytes on Linux
+	u.UserTime = milliseconds(time.Duration(ru.Utime.Nano()))
+	u.SystemTime = milliseconds(time.Duration(ru.Stime.Nano()))
+	u.MinorFaults = int64(ru.Minflt)
+	u.MajorFaults = int64(ru.Majflt)
+	u.VoluntarySwitches = int64(ru.Nvcsw)
+	u.InvoluntarySwitches = int64(ru.Nivcsw)
+	u.BlockIn = int64(ru.Inblock)
+	u.BlockOut = int64(ru.Oublock)
+	return u
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
 // String returns the exectuable path and agent version as a formatted string.
 func (exec *Exec) String() string {
 	return fmt.Sprintf("%s %s", exec.cmd.Path, exec.agentVersion)
@@ -187,6 +242,15 @@ func (exec *Exec) Connect() error {
 	return nil
 }
 
+// Pid returns the process ID of the running process, or zero if it has not
+// been started.
+func (exec *Exec) Pid() int {
+	if exec.cmd.Process == nil {
+		return 0
+	}
+	return exec.cmd.Process.Pid
+}
+
 // AgentData returns a raw data stream from the agent.
 func (exec *Exec) AgentData() io.ReadWriter { return exec.agentData }
 
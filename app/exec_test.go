@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"testing"
+	"time"
+
+	"github.com/aukletio/Auklet-Client-C/device"
 )
 
 func TestMethods(t *testing.T) {
@@ -41,6 +44,7 @@ func TestMethods(t *testing.T) {
 	// see if it crashed
 	exec.ExitStatus()
 	exec.Signal()
+	exec.Usage()
 }
 
 func TestExec(t *testing.T) {
@@ -157,6 +161,40 @@ func TestConnect(t *testing.T) {
 	}
 }
 
+func TestUsage(t *testing.T) {
+	e := must(NewExec("testdata/noexec"))
+	e.Run()
+	if u := e.Usage(); u != (device.Usage{}) {
+		t.Errorf("expected zero usage for unstarted process, got %+v", u)
+	}
+
+	e = must(NewExec("testdata/ls"))
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if u := e.Usage(); u.MaxRSS == 0 {
+		t.Errorf("expected nonzero max RSS, got %+v", u)
+	}
+}
+
+func TestUsageRuntime(t *testing.T) {
+	e := must(NewExec("testdata/ls"))
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// The process exits long before we ask for its usage.
+	const delay = 500 * time.Millisecond
+	time.Sleep(delay)
+	u := e.Usage()
+	if u.Runtime >= milliseconds(delay) {
+		t.Errorf("expected runtime under %v ms, got %v", milliseconds(delay), u.Runtime)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if again := e.Usage(); again.Runtime != u.Runtime {
+		t.Errorf("expected runtime %v to stay put, got %v", u.Runtime, again.Runtime)
+	}
+}
+
 func TestRun(t *testing.T) {
 	e := must(NewExec("testdata/noexec"))
 	if err := e.Run(); err == nil {
@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	backend "github.com/aukletio/Auklet-Client-C/api"
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+)
+
+// These parameters control how an HTTPProducer batches and retries uploads.
+const (
+	batchSize  = 256 << 10        // bytes of message payload per batch
+	batchWait  = 5 * time.Second  // how long to wait for a batch to fill
+	retries    = 5                // attempts per batch
+	minBackoff = time.Second      // delay before the first retry
+	maxBackoff = 30 * time.Second // longest delay between retries
+)
+
+// HTTPProducer uploads messages in batches over HTTPS, for networks that
+// block MQTT. Each batch is a gzipped JSON POST. Messages are removed from
+// the persistence layer only after the backend accepts their batch.
+type HTTPProducer struct {
+	url     string
+	client  *http.Client
+	creds   *backend.Credentials
+	size    int           // maximum payload bytes per batch
+	wait    time.Duration // maximum time to wait for a batch to fill
+	backoff time.Duration // delay before the first retry
+}
+
+// NewHTTPProducer returns a producer that uploads to url using client,
+// authenticating with creds.
+func NewHTTPProducer(url string, client *http.Client, creds *backend.Credentials) *HTTPProducer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPProducer{
+		url:     url,
+		client:  client,
+		creds:   creds,
+		size:    batchSize,
+		wait:    batchWait,
+		backoff: minBackoff,
+	}
+}
+
+// batch is the request body of an upload.
+type batch struct {
+	Org      string      `json:"organization"`
+	Device   string      `json:"device"`
+	Messages []batchItem `json:"messages"`
+}
+
+type batchItem struct {
+	Topic    Topic  `json:"topic"`
+	Encoding string `json:"encoding"`
+	Payload  []byte `json:"payload"` // base64-encoded by encoding/json
+}
+
+// Serve uploads messages from in until in is closed.
+func (p *HTTPProducer) Serve(in MessageSource) {
+	var (
+		msgs  []Message
+		size  int
+		timer = time.NewTimer(p.wait)
+	)
+	defer timer.Stop()
+	flush := func() {
+		if len(msgs) > 0 {
+			p.upload(msgs)
+		}
+		msgs, size = nil, 0
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(p.wait)
+	}
+
+	src := in.Output()
+	for {
+		select {
+		case msg, ok := <-src:
+			if !ok {
+				flush()
+				log.Print("producer: done")
+				return
+			}
+			if len(msgs) > 0 && size+len(msg.Bytes) > p.size {
+				flush()
+			}
+			// A message larger than the cap is sent in a batch of
+			// its own.
+			msgs = append(msgs, msg)
+			size += len(msg.Bytes)
+			if size >= p.size {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// upload sends msgs, retrying with exponential backoff. If every attempt
+// fails, msgs remain persisted, to be loaded on the next run, or returned by
+// Persistor.Unsent.
+func (p *HTTPProducer) upload(msgs []Message) {
+	body, err := p.encode(msgs)
+	if err != nil {
+		errorlog.Printf("HTTPProducer.upload: %v", err)
+		for _, msg := range msgs {
+			msg.Release()
+		}
+		return
+	}
+	delay := p.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := p.post(body)
+		if err == nil {
+			log.Printf("producer: sent batch of %v messages", len(msgs))
+			for _, msg := range msgs {
+				msg.Remove()
+			}
+			return
+		}
+		errorlog.Printf("HTTPProducer.upload: attempt %v: %v", attempt, err)
+		if !retry || attempt == retries {
+			for _, msg := range msgs {
+				msg.Release()
+			}
+			return
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+}
+
+// encode returns the gzipped batch of msgs.
+func (p *HTTPProducer) encode(msgs []Message) ([]byte, error) {
+	b := batch{
+		Org:      p.creds.Org,
+		Device:   p.creds.Username,
+		Messages: make([]batchItem, len(msgs)),
+	}
+	for i, msg := range msgs {
+		b.Messages[i] = batchItem{Topic: msg.Topic, Encoding: msg.encoding(), Payload: msg.Bytes}
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(w).Encode(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// post sends body, and reports whether a failure is worth retrying.
+func (p *HTTPProducer) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("content-encoding", "gzip")
+	req.SetBasicAuth(p.creds.Username, p.creds.Password)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("upload: %v", resp.Status)
+	}
+	return false, fmt.Errorf("upload: %v", resp.Status)
+}
@@ -0,0 +1,153 @@
+package broker
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/aukletio/Auklet-Client-C/api"
+	"github.com/aukletio/Auklet-Client-C/fsutil"
+)
+
+// uploadServer responds to successive uploads with the given status codes,
+// and records the number of messages in each batch it accepts. Messages must
+// name their encoding.
+type uploadServer struct {
+	mu      sync.Mutex
+	codes   []int
+	batches []int
+}
+
+func (u *uploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	code := u.codes[0]
+	u.codes = u.codes[1:]
+	user, pass, _ := r.BasicAuth()
+	if user != "id" || pass != "password" {
+		code = http.StatusUnauthorized
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		code = http.StatusBadRequest
+	} else {
+		var b batch
+		if err := json.NewDecoder(zr).Decode(&b); err != nil {
+			code = http.StatusBadRequest
+		}
+		for _, m := range b.Messages {
+			if m.Encoding == "" {
+				code = http.StatusBadRequest
+			}
+		}
+		if code < 300 {
+			u.batches = append(u.batches, len(b.Messages))
+		}
+	}
+	w.WriteHeader(code)
+}
+
+// persisted returns n messages of the given size, each stored in fs.
+func persisted(fs afero.Fs, n, size int) []Message {
+	msgs := make([]Message, n)
+	for i := range msgs {
+		msgs[i] = Message{
+			Topic: Event,
+			Bytes: make([]byte, size),
+			path:  string(rune('a' + i)),
+			fs:    fs,
+		}
+		if err := fsutil.WriteFile(fs.OpenFile, msgs[i].path, msgs[i].Bytes); err != nil {
+			panic(err)
+		}
+	}
+	return msgs
+}
+
+func TestHTTPProducer(t *testing.T) {
+	cases := []struct {
+		codes   []int
+		msgs    int
+		size    int // of each message
+		batches []int
+		removed bool
+	}{
+		// two messages fit a batch
+		{codes: []int{200, 200}, msgs: 4, size: 40, batches: []int{2, 2}, removed: true},
+		// oversized messages are sent alone
+		{codes: []int{200, 200}, msgs: 2, size: 200, batches: []int{1, 1}, removed: true},
+		// retried after server errors
+		{codes: []int{503, 500, 204}, msgs: 1, size: 1, batches: []int{1}, removed: true},
+		// client errors are not retried
+		{codes: []int{400}, msgs: 1, size: 1, batches: nil, removed: false},
+		// gives up after too many attempts
+		{codes: []int{500, 500, 500, 500, 500}, msgs: 1, size: 1, batches: nil, removed: false},
+	}
+
+	for i, c := range cases {
+		u := &uploadServer{codes: c.codes}
+		s := httptest.NewServer(u)
+		p := NewHTTPProducer(s.URL, nil, &api.Credentials{Username: "id", Password: "password"})
+		p.size = 100
+		p.backoff = time.Millisecond
+
+		fs := afero.NewMemMapFs()
+		source := make(channel)
+		go func() {
+			defer close(source)
+			for _, m := range persisted(fs, c.msgs, c.size) {
+				source <- m
+			}
+		}()
+		p.Serve(source)
+		s.Close()
+
+		if len(u.batches) != len(c.batches) {
+			t.Errorf("case %v: expected batches %v, got %v", i, c.batches, u.batches)
+		} else {
+			for j := range c.batches {
+				if u.batches[j] != c.batches[j] {
+					t.Errorf("case %v: expected batches %v, got %v", i, c.batches, u.batches)
+					break
+				}
+			}
+		}
+		_, err := fs.Stat("a")
+		if removed := err != nil; removed != c.removed {
+			t.Errorf("case %v: expected removed %v, got %v", i, c.removed, removed)
+		}
+		if len(u.codes) != 0 {
+			t.Errorf("case %v: %v responses unused", i, len(u.codes))
+		}
+	}
+}
+
+func TestHTTPProducerTimer(t *testing.T) {
+	u := &uploadServer{codes: []int{200}}
+	s := httptest.NewServer(u)
+	defer s.Close()
+	p := NewHTTPProducer(s.URL, nil, &api.Credentials{Username: "id", Password: "password"})
+	p.wait = 10 * time.Millisecond
+
+	source := make(channel)
+	done := make(chan struct{})
+	go func() {
+		p.Serve(source)
+		close(done)
+	}()
+	source <- Message{}
+	time.Sleep(100 * time.Millisecond)
+	u.mu.Lock()
+	if len(u.batches) != 1 {
+		t.Errorf("expected a batch before the source closed, got %v", len(u.batches))
+	}
+	u.mu.Unlock()
+	close(source)
+	<-done
+}
@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"crypto/tls"
+	"errors"
+
+	backend "github.com/aukletio/Auklet-Client-C/api"
+)
+
+// LocalBroker is an API for a broker that is configured locally, such as a
+// site's own Mosquitto, rather than provided by the backend. Its certificates
+// are verified against the system's roots, which LocalTLS can supplement or
+// replace.
+type LocalBroker struct {
+	URL   string // e.g. ssl://host:8883 or tcp://host:1883
+	Creds backend.Credentials
+}
+
+// Credentials returns the locally configured credentials.
+func (l LocalBroker) Credentials() (*backend.Credentials, error) {
+	c := l.Creds
+	return &c, nil
+}
+
+// BrokerAddress returns the locally configured broker URL.
+func (l LocalBroker) BrokerAddress() (string, error) {
+	return l.URL, nil
+}
+
+// Certificates returns a TLS configuration that uses the system's roots.
+func (l LocalBroker) Certificates() (*tls.Config, error) {
+	return new(tls.Config), nil
+}
+
+// Reregister fails, because locally configured credentials cannot be
+// replaced.
+func (l LocalBroker) Reregister() error {
+	return errors.New("the broker rejected the configured credentials")
+}
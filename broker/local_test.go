@@ -0,0 +1,37 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aukletio/Auklet-Client-C/api"
+)
+
+func TestLocalBroker(t *testing.T) {
+	l := LocalBroker{
+		URL:   "ssl://mosquitto:8883",
+		Creds: api.Credentials{Username: "user", Password: "pass"},
+	}
+	if addr, _ := l.BrokerAddress(); addr != l.URL {
+		t.Errorf("expected %v, got %v", l.URL, addr)
+	}
+	if c, _ := l.Credentials(); *c != l.Creds {
+		t.Errorf("expected %v, got %v", l.Creds, *c)
+	}
+	if l.Reregister() == nil {
+		t.Error("expected an error replacing local credentials")
+	}
+
+	// A local CA bundle supplements the system's roots.
+	local, err := LoadTLS(TLSFiles{CA: "cert.pem"}, certFs(time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := local.Wrap(l).Certificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RootCAs == nil {
+		t.Error("expected root CAs")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/spf13/afero"
 
@@ -19,12 +20,18 @@ import (
 // Topic encodes a Message topic.
 type Topic string
 
-// Profile, Event, Log, and DataPoint are Message topics.
+// Profile, Event, Log, DataPoint, Presence, Command, Response, Batch, and
+// Session are Message topics. Command messages are received rather than sent.
 const (
 	Profile   Topic = "profiler"
 	Event           = "events"
 	Log             = "logs"
 	DataPoint       = "datapoints"
+	Presence        = "presence"
+	Command         = "commands"
+	Response        = "responses"
+	Batch           = "batches"
+	Session         = "sessions"
 )
 
 // Message represents a broker message.
@@ -32,9 +39,77 @@ type Message struct {
 	Error string `json:"error"`
 	Topic Topic  `json:"topic"`
 	Bytes []byte `json:"bytes"`
-	path  string
 
-	fs Fs
+	// Sequence numbers the message among those on its topic; zero if the
+	// message is not numbered.
+	Sequence uint64 `json:"sequence,omitempty"`
+
+	// Encoding names the encoding of Bytes, such as msgpack; if empty,
+	// it is JSON.
+	Encoding string `json:"encoding,omitempty"`
+
+	path string
+
+	fs      Fs
+	sending *inflight // of the Persistor that stored m
+	parts   []Message // that m stands for; see Join
+}
+
+// inflight is the set of paths of stored messages on their way to the
+// broker.
+type inflight struct {
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+// add records that the message at path is being sent. It reports whether it
+// was not already.
+func (f *inflight) add(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.paths[path] {
+		return false
+	}
+	f.paths[path] = true
+	return true
+}
+
+func (f *inflight) remove(path string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	delete(f.paths, path)
+	f.mu.Unlock()
+}
+
+// Join returns a message on topic holding b, which stands for parts, such as
+// a batch of them. Removing it removes each of parts from the persistence
+// layer.
+func Join(topic Topic, b []byte, parts []Message) Message {
+	return Message{Topic: topic, Bytes: b, parts: parts}
+}
+
+// encoding returns the name of the encoding of m's payload.
+func (m Message) encoding() string {
+	if m.Encoding == "" {
+		return "json"
+	}
+	return m.Encoding
+}
+
+// Parts returns the messages that m stands for, or m itself if it does not
+// stand for others.
+func (m Message) Parts() []Message {
+	if len(m.parts) == 0 {
+		return []Message{m}
+	}
+	return m.parts
+}
+
+// DropRecorder records messages that were discarded before being sent.
+type DropRecorder interface {
+	Drop(reason string, m Message)
 }
 
 // ErrStorageFull indicates that the corresponding Persistor is full.
@@ -66,7 +141,12 @@ type Persistor struct {
 	count        int // counter to give Messages unique names
 	done         chan struct{}
 
-	fs Fs
+	fs      Fs
+	sending *inflight
+
+	// Drops, if not nil, records messages rejected because storage is
+	// full. It must be set before the first call to CreateMessage.
+	Drops DropRecorder
 }
 
 // NewPersistor creates a new Persistor in dir.
@@ -77,6 +157,7 @@ func NewPersistor(dir string, fs Fs, conf <-chan *int64) *Persistor {
 		currentLimit: make(chan *int64),
 		done:         make(chan struct{}),
 		fs:           fs,
+		sending:      &inflight{paths: make(map[string]bool)},
 	}
 	go p.serve()
 	return p
@@ -126,6 +207,47 @@ func load(dir string, fs Fs) <-chan Message {
 	return out
 }
 
+// Load returns a stream of the messages stored under p, which are then
+// being sent.
+func (p *Persistor) Load() MessageSource {
+	out := make(chan Message)
+	go func() {
+		defer close(out)
+		for m := range load(p.dir, p.fs) {
+			if m.path != "" {
+				p.sending.add(m.path)
+				m.sending = p.sending
+			}
+			out <- m
+		}
+	}()
+	return MessageLoader{out}
+}
+
+// Unsent returns the messages stored under p that are not being sent, such
+// as those that failed to reach the broker, which are then being sent.
+func (p *Persistor) Unsent() []Message {
+	var msgs []Message
+	paths, err := filepaths(p.dir, p.fs)
+	if err != nil {
+		errorlog.Printf("Persistor.Unsent: %v", err)
+	}
+	for _, path := range paths {
+		if !p.sending.add(path) {
+			continue
+		}
+		m := loadMessage(path, p.fs)
+		if m.Error != "" {
+			errorlog.Printf("Persistor.Unsent: %v", m.Error)
+			p.sending.remove(path)
+			continue
+		}
+		m.sending = p.sending
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
 // loadMessage decodes the file at path into a Message.
 func loadMessage(path string, fs Fs) (m Message) {
 	m.path = path
@@ -161,6 +283,9 @@ func (p *Persistor) CreateMessage(m *Message) (err error) {
 		return err
 	}
 	if lim != nil && int64(len(m.Bytes))+totalSize > 9**lim/10 {
+		if p.Drops != nil {
+			p.Drops.Drop("storage", *m)
+		}
 		return ErrStorageFull{
 			limit: *lim,
 			used:  totalSize,
@@ -169,7 +294,48 @@ func (p *Persistor) CreateMessage(m *Message) (err error) {
 	m.path = fmt.Sprintf("%v/%v-%v", p.dir, os.Getpid(), p.count)
 	m.fs = p.fs
 	p.count++
-	return m.save()
+	if err := m.save(); err != nil {
+		return err
+	}
+	p.sending.add(m.path)
+	m.sending = p.sending
+	return nil
+}
+
+// Rewrite calls f on each message stored under p, and saves those that f
+// reports it changed. Messages removed in the meantime are not saved again.
+func (p *Persistor) Rewrite(f func(*Message) bool) error {
+	paths, err := filepaths(p.dir, p.fs)
+	for _, path := range paths {
+		m := loadMessage(path, p.fs)
+		if m.Error != "" || !f(&m) {
+			continue
+		}
+		if err2 := m.update(); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// Len returns the number of messages stored under p.
+func (p *Persistor) Len() int {
+	paths, _ := filepaths(p.dir, p.fs)
+	return len(paths)
+}
+
+// Purge deletes all messages stored under p, and returns the number deleted.
+func (p *Persistor) Purge() (int, error) {
+	paths, err := filepaths(p.dir, p.fs)
+	n := 0
+	for _, path := range paths {
+		if err2 := p.fs.Remove(path); err2 != nil {
+			err = fmt.Errorf("purge: %v", err2)
+			continue
+		}
+		n++
+	}
+	return n, err
 }
 
 func size(dir string, fs Fs) (int64, error) {
@@ -225,14 +391,46 @@ func (m Message) save() error {
 	return fsutil.WriteFile(m.fs.OpenFile, m.path, b)
 }
 
+// update overwrites m in the persistence layer, if it is still there.
+func (m Message) update() error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("update: could not marshal JSON: %v", err)
+	}
+	f, err := m.fs.OpenFile(m.path, os.O_WRONLY|os.O_TRUNC, 0666)
+	if os.IsNotExist(err) {
+		return nil // sent in the meantime
+	}
+	if err != nil {
+		return fmt.Errorf("update: %v", err)
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	return err
+}
+
 // Remove deletes m from the persistence layer.
 func (m Message) Remove() {
+	for _, p := range m.parts {
+		p.Remove()
+	}
 	if m.fs == nil {
 		return
 	}
 	if err := m.fs.Remove(m.path); err != nil {
 		errorlog.Print(err)
 	}
+	m.sending.remove(m.path)
+}
+
+// Release records that m, which failed to reach the broker, is no longer
+// being sent. It stays in the persistence layer, from where Persistor.Unsent
+// returns it.
+func (m Message) Release() {
+	for _, p := range m.parts {
+		p.Release()
+	}
+	m.sending.remove(m.path)
 }
 
 // MessageSource is implemented by types that can generate a Message stream.
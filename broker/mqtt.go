@@ -4,6 +4,8 @@ import (
 	"crypto/tls"
 	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 
 	"github.com/eclipse/paho.mqtt.golang"
 
@@ -15,6 +17,27 @@ import (
 type MQTTProducer struct {
 	c       Client
 	org, id string
+	topic   string        // template
+	window  int           // maximum unacknowledged publishes
+	done    chan struct{} // closed when Serve returns
+}
+
+// DefaultTopic is the topic template of the Auklet broker. It does not name
+// the encoding, which the Auklet backend expects to be msgpack.
+const DefaultTopic = "c/{topic}/{org}/{device}"
+
+// ParseTopic validates a topic template, in which {topic} is replaced by a
+// Message's Topic, {org} by the organization, {device} by the username, or the
+// client ID if there is no username, and {encoding} by the name of the
+// Message's encoding. The empty string yields DefaultTopic.
+func ParseTopic(template string) (string, error) {
+	if template == "" {
+		return DefaultTopic, nil
+	}
+	if !strings.Contains(template, "{topic}") {
+		return "", fmt.Errorf("topic template %q lacks {topic}", template)
+	}
+	return template, nil
 }
 
 type token interface {
@@ -32,6 +55,7 @@ var wait = func(t token) error {
 type Client interface {
 	Connect() mqtt.Token
 	Publish(string, byte, bool, interface{}) mqtt.Token
+	Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token
 	Disconnect(uint)
 }
 
@@ -39,6 +63,8 @@ type Client interface {
 type Config struct {
 	Creds  *backend.Credentials
 	Client Client
+	Topic  string // template; if empty, DefaultTopic
+	Window int    // maximum unacknowledged publishes; if zero, DefaultWindow
 }
 
 // API consists of the backend interface needed to generate a Config.
@@ -48,8 +74,14 @@ type API interface {
 	Certificates() (*tls.Config, error)
 }
 
-// NewConfig returns a Config from the given API.
-func NewConfig(api API) (Config, error) {
+// NewConfig returns a Config from the given API, publishing to topics formed
+// from the given template. The broker is asked to publish a Last Will on the
+// Presence topic if the connection is lost, which the client replaces when it
+// reconnects.
+func NewConfig(api API, topic string) (Config, error) {
+	if topic == "" {
+		topic = DefaultTopic
+	}
 	creds, err := api.Credentials()
 	if err != nil {
 		return Config{}, err
@@ -73,42 +105,172 @@ func NewConfig(api API) (Config, error) {
 	opt.SetCredentialsProvider(func() (string, string) {
 		return creds.Username, creds.Password
 	})
+	will := topicName(topic, Presence, creds.Org, deviceName(creds), "json")
+	opt.SetBinaryWill(will, presencePayload(lost), 1, true)
+	onConnect := reconnected(will)
+	opt.SetOnConnectHandler(func(c mqtt.Client) { onConnect(c) })
 
 	return Config{
 		Creds:  creds,
 		Client: mqtt.NewClient(opt),
+		Topic:  topic,
 	}, nil
 }
 
+// reconnected returns a handler of connections that, from the second on,
+// publishes the retained online presence on topic, in place of the Last Will
+// the broker published when the connection was lost. The first connection is
+// announced by NewMQTTProducer.
+func reconnected(topic string) func(Client) {
+	var connects int32
+	return func(c Client) {
+		if atomic.AddInt32(&connects, 1) == 1 {
+			return
+		}
+		log.Print("producer: reconnected")
+		if err := wait(c.Publish(topic, 1, true, presencePayload(online))); err != nil {
+			errorlog.Printf("reconnected: %v", err)
+		}
+	}
+}
+
 // NewMQTTProducer returns a new producer for the given input.
 func NewMQTTProducer(cfg Config) (*MQTTProducer, error) {
 	c := cfg.Client
 	if err := wait(c.Connect()); err != nil {
+		if isAuthError(err) {
+			return nil, errRejected{err}
+		}
 		return nil, fmt.Errorf("connecting to broker: %v", err)
 	}
 	log.Print("producer: connected")
-	return &MQTTProducer{
-		c:   c,
-		org: cfg.Creds.Org,
-		id:  cfg.Creds.Username,
-	}, nil
+	p := &MQTTProducer{
+		c:      c,
+		org:    cfg.Creds.Org,
+		id:     deviceName(cfg.Creds),
+		topic:  cfg.Topic,
+		window: cfg.Window,
+		done:   make(chan struct{}),
+	}
+	if p.topic == "" {
+		p.topic = DefaultTopic
+	}
+	if p.window == 0 {
+		p.window = DefaultWindow
+	}
+	p.presence(online)
+	return p, nil
+}
+
+// deviceName returns the name of the device in topics.
+func deviceName(creds *backend.Credentials) string {
+	if creds.Username == "" {
+		return creds.ClientID
+	}
+	return creds.Username
 }
 
-// Serve launches p, enabling it to send and receive messages.
+// topicName forms the name of a topic for payloads in the given encoding from
+// a template.
+func topicName(template string, topic Topic, org, device, encoding string) string {
+	return strings.NewReplacer(
+		"{topic}", string(topic),
+		"{org}", org,
+		"{device}", device,
+		"{encoding}", encoding,
+	).Replace(template)
+}
+
+// presence publishes a retained message with the given status on the
+// Presence topic.
+func (p MQTTProducer) presence(status string) {
+	topic := topicName(p.topic, Presence, p.org, p.id, "json")
+	if err := wait(p.c.Publish(topic, 1, true, presencePayload(status))); err != nil {
+		errorlog.Printf("MQTTProducer.presence: %v", err)
+	}
+}
+
+// Subscribe returns a stream of the messages received on the given topic.
+// Messages received after Serve returns are dropped.
+func (p MQTTProducer) Subscribe(topic Topic) (<-chan Message, error) {
+	out := make(chan Message)
+	name := topicName(p.topic, topic, p.org, p.id, "json")
+	handle := func(_ mqtt.Client, m mqtt.Message) {
+		select {
+		case out <- Message{Topic: topic, Bytes: m.Payload()}:
+		case <-p.done:
+		}
+	}
+	if err := wait(p.c.Subscribe(name, 1, handle)); err != nil {
+		return nil, fmt.Errorf("subscribing to %v: %v", name, err)
+	}
+	log.Printf("producer: subscribed to %v", name)
+	return out, nil
+}
+
+// DefaultWindow is the default number of publishes that may await
+// acknowledgement from the broker at once.
+const DefaultWindow = 32
+
+// ordered reports whether messages on topic must reach the broker in the
+// order in which they were sent. Such a message is not published until the
+// previous message on its topic is acknowledged.
+func ordered(topic Topic) bool {
+	return topic == Presence
+}
+
+// publish is a message awaiting acknowledgement.
+type publish struct {
+	msg Message
+	tok token
+}
+
+// Serve launches p, enabling it to send and receive messages. Up to p's
+// window of messages are published before the first is acknowledged; each
+// message is removed from the persistence layer when its own acknowledgement
+// arrives.
 func (p MQTTProducer) Serve(in MessageSource) {
+	window := p.window
+	if window < 1 {
+		window = 1
+	}
+	slots := make(chan struct{}, window) // one entry per unacknowledged publish
+	inflight := make(chan publish, window)
+	acked := make(chan struct{})
+	go func() {
+		defer close(acked)
+		for pub := range inflight {
+			err := wait(pub.tok)
+			<-slots
+			if err != nil {
+				errorlog.Print("publishing to broker:", err)
+				pub.msg.Release()
+				continue
+			}
+			log.Printf("producer: sent %+q", pub.msg.Bytes)
+			pub.msg.Remove()
+		}
+	}()
 	defer func() {
-		p.c.Disconnect(0)
+		close(inflight)
+		<-acked
+		close(p.done)
+		p.presence(offline)
+		p.c.Disconnect(250)
 		log.Print("producer: disconnected")
 	}()
 
+	last := make(map[Topic]token) // of ordered topics
 	for msg := range in.Output() {
-		topic := fmt.Sprintf("c/%v/%v/%v", msg.Topic, p.org, p.id)
-		err := wait(p.c.Publish(topic, 1, false, msg.Bytes))
-		if err != nil {
-			errorlog.Print("publishing to broker:", err)
-			continue
+		if prev, ok := last[msg.Topic]; ok {
+			wait(prev) // errors are reported with the previous message
+		}
+		topic := topicName(p.topic, msg.Topic, p.org, p.id, msg.encoding())
+		slots <- struct{}{}
+		tok := p.c.Publish(topic, 1, msg.Topic == Presence, msg.Bytes)
+		if ordered(msg.Topic) {
+			last[msg.Topic] = tok
 		}
-		log.Printf("producer: sent %+q", msg.Bytes)
-		msg.Remove()
+		inflight <- publish{msg, tok}
 	}
 }
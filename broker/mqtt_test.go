@@ -2,7 +2,9 @@ package broker
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/eclipse/paho.mqtt.golang"
@@ -34,6 +36,10 @@ func (k klient) Publish(string, byte, bool, interface{}) mqtt.Token {
 	return &mqtt.PublishToken{}
 }
 
+func (k klient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	return &mqtt.SubscribeToken{}
+}
+
 func (k klient) Disconnect(uint) {}
 
 func TestConnect(t *testing.T) {
@@ -91,7 +97,7 @@ func TestPublish(t *testing.T) {
 			defer close(source)
 			source <- Message{}
 		}()
-		MQTTProducer{c: klient{}}.Serve(source)
+		MQTTProducer{c: klient{}, done: make(chan struct{})}.Serve(source)
 	}
 }
 
@@ -123,13 +129,182 @@ func (a mockAPI) Certificates() (*tls.Config, error) {
 }
 
 func TestNewConfig(t *testing.T) {
-	_, err := NewConfig(mockAPI{errors.New("error")})
+	_, err := NewConfig(mockAPI{errors.New("error")}, "")
 	if err == nil {
 		t.Error(err)
 	}
 
-	_, err = NewConfig(mockAPI{nil})
+	_, err = NewConfig(mockAPI{nil}, "")
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+// topicKlient records the topics to which it publishes.
+type topicKlient struct {
+	klient
+	topics *[]string
+}
+
+func (k topicKlient) Publish(topic string, _ byte, _ bool, _ interface{}) mqtt.Token {
+	*k.topics = append(*k.topics, topic)
+	return &mqtt.PublishToken{}
+}
+
+func TestTopic(t *testing.T) {
+	orig := wait
+	defer func() { wait = orig }()
+	wait = func(token) error { return nil }
+
+	cases := []struct {
+		template string
+		creds    api.Credentials
+		encoding string
+		expect   string
+		presence string
+		ok       bool
+	}{
+		{
+			template: "",
+			creds:    api.Credentials{Org: "org", Username: "user"},
+			encoding: "cbor",
+			expect:   "c/events/org/user",
+			presence: "c/presence/org/user",
+			ok:       true,
+		}, {
+			template: "site/{device}/{topic}",
+			creds:    api.Credentials{ClientID: "client"},
+			expect:   "site/client/events",
+			presence: "site/client/presence",
+			ok:       true,
+		}, {
+			template: "c/{topic}/{encoding}",
+			encoding: "cbor",
+			expect:   "c/events/cbor",
+			presence: "c/presence/json",
+			ok:       true,
+		}, {
+			template: "c/{topic}/{encoding}",
+			expect:   "c/events/json",
+			presence: "c/presence/json",
+			ok:       true,
+		}, {
+			template: "site/{device}",
+			ok:       false,
+		},
+	}
+
+	for i, c := range cases {
+		template, err := ParseTopic(c.template)
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("case %v: expected %v, got %v: %v", i, c.ok, ok, err)
+		}
+		if err != nil {
+			continue
+		}
+		var topics []string
+		p, err := NewMQTTProducer(Config{
+			Creds:  &c.creds,
+			Client: topicKlient{topics: &topics},
+			Topic:  template,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := make(channel)
+		go func() {
+			defer close(source)
+			source <- Message{Topic: Event, Encoding: c.encoding}
+		}()
+		p.Serve(source)
+		// online, the message, offline
+		expect := []string{c.presence, c.expect, c.presence}
+		if fmt.Sprint(topics) != fmt.Sprint(expect) {
+			t.Errorf("case %v: expected %v, got %v", i, expect, topics)
+		}
+	}
+}
+
+// subKlient delivers payload to the first subscription made on it.
+type subKlient struct {
+	klient
+	topic   *string
+	payload []byte
+}
+
+func (k subKlient) Subscribe(topic string, _ byte, h mqtt.MessageHandler) mqtt.Token {
+	*k.topic = topic
+	go h(nil, payload(k.payload))
+	return &mqtt.SubscribeToken{}
+}
+
+// payload is an mqtt.Message.
+type payload []byte
+
+func (payload) Duplicate() bool   { return false }
+func (payload) Qos() byte         { return 1 }
+func (payload) Retained() bool    { return false }
+func (payload) Topic() string     { return "" }
+func (payload) MessageID() uint16 { return 0 }
+func (p payload) Payload() []byte { return p }
+func (payload) Ack()              {}
+
+func TestSubscribe(t *testing.T) {
+	orig := wait
+	defer func() { wait = orig }()
+	wait = func(token) error { return nil }
+
+	var topic string
+	p, err := NewMQTTProducer(Config{
+		Creds:  &api.Credentials{Org: "org", Username: "user"},
+		Client: subKlient{topic: &topic, payload: []byte("cmd")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := p.Subscribe(Command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "c/commands/org/user"; topic != expect {
+		t.Errorf("expected %v, got %v", expect, topic)
+	}
+	m := <-in
+	if m.Topic != Command || string(m.Bytes) != "cmd" {
+		t.Errorf("expected cmd on %v, got %+v", Command, m)
+	}
+}
+
+// presenceKlient records the retained payloads it publishes, by topic.
+type presenceKlient struct {
+	klient
+	retained map[string]string
+}
+
+func (k presenceKlient) Publish(topic string, _ byte, retained bool, payload interface{}) mqtt.Token {
+	if retained {
+		k.retained[topic] = string(payload.([]byte))
+	}
+	return &mqtt.PublishToken{}
+}
+
+func TestReconnected(t *testing.T) {
+	orig := wait
+	defer func() { wait = orig }()
+	wait = func(token) error { return nil }
+
+	c := presenceKlient{retained: make(map[string]string)}
+	onConnect := reconnected("presence")
+	onConnect(c)
+	if len(c.retained) != 0 {
+		t.Errorf("expected first connection left to NewMQTTProducer, got %v", c.retained)
+	}
+
+	// The connection was lost, and the broker published the Last Will.
+	c.retained["presence"] = string(presencePayload(lost))
+	onConnect(c)
+	var got struct{ Status string }
+	if err := json.Unmarshal([]byte(c.retained["presence"]), &got); err != nil || got.Status != online {
+		t.Errorf("expected %v, got %v %v", online, got.Status, err)
+	}
+}
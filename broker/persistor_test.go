@@ -3,6 +3,8 @@ package broker
 import (
 	"errors"
 	"os"
+	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/spf13/afero"
@@ -225,3 +227,133 @@ func TestCreateMessage(t *testing.T) {
 		close(p.done)
 	}
 }
+
+func TestPurge(t *testing.T) {
+	p := NewPersistor("dir", afero.NewMemMapFs(), nil)
+	defer close(p.done)
+	for i := 0; i < 2; i++ {
+		if err := p.CreateMessage(&Message{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := p.Purge()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 2 || p.Len() != 0 {
+		t.Errorf("expected 2 purged and none left, got %v purged and %v left", n, p.Len())
+	}
+}
+
+func TestJoin(t *testing.T) {
+	p := NewPersistor("dir", afero.NewMemMapFs(), nil)
+	defer close(p.done)
+	parts := make([]Message, 2)
+	for i := range parts {
+		if err := p.CreateMessage(&parts[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Join(Batch, nil, parts).Remove()
+	if n := p.Len(); n != 0 {
+		t.Errorf("expected parts removed, %v left", n)
+	}
+}
+
+// dropList is a DropRecorder that lists the dropped messages.
+type dropList []Message
+
+func (d *dropList) Drop(reason string, m Message) { *d = append(*d, m) }
+
+func TestStorageFullDrop(t *testing.T) {
+	cfg := make(chan *int64)
+	p := NewPersistor("dir", afero.NewMemMapFs(), cfg)
+	defer close(p.done)
+	drops := new(dropList)
+	p.Drops = drops
+	var limit int64
+	cfg <- &limit
+
+	m := Message{Topic: DataPoint, Bytes: []byte("x"), Sequence: 7}
+	if _, ok := p.CreateMessage(&m).(ErrStorageFull); !ok {
+		t.Fatal("expected ErrStorageFull")
+	}
+	if len(*drops) != 1 || (*drops)[0].Sequence != 7 {
+		t.Errorf("expected message 7 recorded as dropped, got %+v", *drops)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	p := NewPersistor("dir", afero.NewMemMapFs(), nil)
+	defer close(p.done)
+	msgs := []Message{{Bytes: []byte("a")}, {Bytes: []byte("b")}, {Bytes: []byte("c")}}
+	for i := range msgs {
+		if err := p.CreateMessage(&msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := p.Rewrite(func(m *Message) bool {
+		switch string(m.Bytes) {
+		case "a":
+			m.Bytes = []byte("A")
+			return true
+		case "b":
+			// sent while being rewritten
+			msgs[1].Remove()
+			m.Bytes = []byte("B")
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var got []string
+	for m := range NewMessageLoader("dir", p.fs).Output() {
+		got = append(got, string(m.Bytes))
+	}
+	sort.Strings(got)
+	if expect := []string{"A", "c"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestUnsent(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	p := NewPersistor("dir", fs, nil)
+	defer close(p.done)
+	// stored by an earlier run
+	if err := fsutil.WriteFile(fs.OpenFile, "dir/old", []byte(`{"bytes":"b2xk"}`)); err != nil {
+		t.Fatal(err)
+	}
+	var loaded []Message
+	for m := range p.Load().Output() {
+		loaded = append(loaded, m)
+	}
+	msgs := []Message{{Bytes: []byte("sent")}, {Bytes: []byte("failed")}, {Bytes: []byte("sending")}}
+	for i := range msgs {
+		if err := p.CreateMessage(&msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(p.Unsent()); n != 0 {
+		t.Errorf("expected no unsent messages while all are being sent, got %v", n)
+	}
+
+	msgs[0].Remove()
+	msgs[1].Release()
+	loaded[0].Release()
+	var got []string
+	for _, m := range p.Unsent() {
+		got = append(got, string(m.Bytes))
+	}
+	sort.Strings(got)
+	if expect := []string{"failed", "old"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+	// Unsent messages are then being sent.
+	if n := len(p.Unsent()); n != 0 {
+		t.Errorf("expected no unsent messages, got %v", n)
+	}
+}
@@ -0,0 +1,32 @@
+package broker
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Statuses reported on the Presence topic. The broker publishes lost as our
+// Last Will when the connection drops without a clean disconnect.
+const (
+	online  = "online"
+	offline = "offline"
+	lost    = "lost"
+)
+
+// presencePayload returns a message reporting status on the Presence topic.
+func presencePayload(status string) []byte {
+	b, _ := json.Marshal(struct {
+		Status    string `json:"status"`
+		Timestamp int64  `json:"timestamp,omitempty"` // ms since epoch
+	}{
+		Status: status,
+		Timestamp: func() int64 {
+			if status == lost {
+				// The will is published long after it is set.
+				return 0
+			}
+			return time.Now().UnixNano() / 1e6
+		}(),
+	})
+	return b
+}
@@ -0,0 +1,225 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+)
+
+// ParseProxy parses a proxy URL of the form scheme://[user:password@]host:port,
+// where scheme is http or socks5.
+func ParseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy %v lacks a port", u.Host)
+	}
+	return u, nil
+}
+
+// ProxyDialer returns a Dialer that connects through the proxy at u.
+func ProxyDialer(u *url.URL) (proxy.Dialer, error) {
+	if u.Scheme == "http" {
+		return httpConnect{u}, nil
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+	return proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
+}
+
+// httpConnect is a Dialer that tunnels connections through an HTTP proxy
+// using the CONNECT method.
+type httpConnect struct {
+	proxy *url.URL
+}
+
+func (h httpConnect) Dial(network, addr string) (net.Conn, error) {
+	conn, err := net.Dial(network, h.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := h.proxy.User; u != nil {
+		password, _ := u.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The proxy sends nothing after its response until we do, so the
+	// reader cannot buffer any tunneled bytes.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %v: %v", addr, resp.Status)
+	}
+	return conn, nil
+}
+
+// ProxyAPI is an API whose broker connections pass through a proxy.
+//
+// The MQTT client cannot be given a dialer, so ProxyAPI listens on a loopback
+// address, which it gives as the broker address, and relays connections to
+// the broker through the proxy. Certificates are verified against the
+// broker's real host name. For a WebSocket broker, the relay makes the TLS
+// connection itself, so that the handshake names the broker rather than the
+// relay.
+type ProxyAPI struct {
+	Recoverer
+	dial proxy.Dialer
+
+	mu     sync.Mutex
+	target string // broker host:port
+	wss    bool   // whether the broker is reached over WebSockets
+	relay  net.Listener
+}
+
+// WrapProxy returns an API whose broker connections are made with d.
+func WrapProxy(api Recoverer, d proxy.Dialer) *ProxyAPI {
+	return &ProxyAPI{Recoverer: api, dial: d}
+}
+
+// BrokerAddress returns the address of a relay to the broker.
+func (p *ProxyAPI) BrokerAddress() (string, error) {
+	addr, err := p.Recoverer.BrokerAddress()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+
+	wss := u.Scheme == "wss"
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.relay == nil || p.target != u.Host || p.wss != wss {
+		if p.relay != nil {
+			p.relay.Close()
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+		p.relay, p.target, p.wss = l, u.Host, wss
+		go p.serve(l, u.Host, wss)
+		log.Printf("proxy: relaying %v to %v", l.Addr(), u.Host)
+	}
+	u.Host = p.relay.Addr().String()
+	if wss {
+		u.Scheme = "ws"
+	}
+	return u.String(), nil
+}
+
+// Certificates returns the API's TLS configuration, set to verify the
+// broker's real host name rather than that of the relay.
+func (p *ProxyAPI) Certificates() (*tls.Config, error) {
+	cfg, err := p.Recoverer.Certificates()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if host, _, err := net.SplitHostPort(p.target); err == nil {
+		cfg.ServerName = host
+	}
+	return cfg, nil
+}
+
+// serve relays connections accepted by l to target until l is closed. If
+// wss, the connections to target are made over TLS, and begin with a
+// WebSocket handshake.
+func (p *ProxyAPI) serve(l net.Listener, target string, wss bool) {
+	for {
+		local, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			remote, err := p.dial.Dial("tcp", target)
+			if err == nil && wss {
+				remote, err = p.handshake(local, remote, target)
+			}
+			if err != nil {
+				errorlog.Printf("ProxyAPI.serve: %v", err)
+				local.Close()
+				return
+			}
+			pipe(local, remote)
+		}()
+	}
+}
+
+// handshake secures remote, and forwards to it the WebSocket handshake
+// read from local, with the Host and Origin headers naming target rather
+// than the relay.
+func (p *ProxyAPI) handshake(local, remote net.Conn, target string) (net.Conn, error) {
+	cfg, err := p.Certificates()
+	if err != nil {
+		remote.Close()
+		return nil, err
+	}
+	conn := tls.Client(remote, cfg)
+	// The client sends nothing after its handshake until it gets a
+	// response, so the reader cannot buffer any relayed bytes.
+	req, err := http.ReadRequest(bufio.NewReader(local))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Host = target
+	req.Header.Set("Origin", "https://"+target)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// pipe copies data between a and b until either side is closed.
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	a.Close()
+	b.Close()
+}
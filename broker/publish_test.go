@@ -0,0 +1,221 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/spf13/afero"
+
+	"github.com/aukletio/Auklet-Client-C/api"
+	"github.com/aukletio/Auklet-Client-C/fsutil"
+)
+
+// testBroker is a minimal MQTT broker that acknowledges each publish after a
+// delay, as if over a high-latency network, and records the payloads it
+// receives.
+type testBroker struct {
+	l       net.Listener
+	latency time.Duration
+
+	mu       sync.Mutex
+	received []string
+}
+
+func newTestBroker(latency time.Duration) *testBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	b := &testBroker{l: l, latency: latency}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) Close() { b.l.Close() }
+
+// client returns a client connected to b.
+func (b *testBroker) client() Client {
+	opt := mqtt.NewClientOptions()
+	opt.AddBroker("tcp://" + b.l.Addr().String())
+	opt.SetClientID("test")
+	return mqtt.NewClient(opt)
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	var wmu sync.Mutex
+	write := func(p packets.ControlPacket) {
+		wmu.Lock()
+		defer wmu.Unlock()
+		p.Write(conn)
+	}
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := p.(type) {
+		case *packets.ConnectPacket:
+			write(packets.NewControlPacket(packets.Connack))
+		case *packets.PingreqPacket:
+			write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		case *packets.PublishPacket:
+			b.mu.Lock()
+			b.received = append(b.received, string(p.Payload))
+			b.mu.Unlock()
+			if p.Qos == 0 {
+				continue
+			}
+			ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			ack.MessageID = p.MessageID
+			time.AfterFunc(b.latency, func() { write(ack) })
+		}
+	}
+}
+
+// stored returns n messages on topic, each stored in fs.
+func stored(fs afero.Fs, topic Topic, n int) []Message {
+	msgs := make([]Message, n)
+	for i := range msgs {
+		msgs[i] = Message{
+			Topic: topic,
+			Bytes: []byte(fmt.Sprint(i)),
+			path:  fmt.Sprintf("m%v", i),
+			fs:    fs,
+		}
+		if err := fsutil.WriteFile(fs.OpenFile, msgs[i].path, msgs[i].Bytes); err != nil {
+			panic(err)
+		}
+	}
+	return msgs
+}
+
+func serve(p *MQTTProducer, msgs []Message) {
+	source := make(channel)
+	go func() {
+		defer close(source)
+		for _, m := range msgs {
+			source <- m
+		}
+	}()
+	p.Serve(source)
+}
+
+func TestServeWindow(t *testing.T) {
+	cases := []struct {
+		topic Topic
+		n     int
+	}{
+		{topic: Event, n: 100},
+		{topic: Presence, n: 10},
+	}
+
+	for i, c := range cases {
+		b := newTestBroker(time.Millisecond)
+		p, err := NewMQTTProducer(Config{
+			Creds:  &api.Credentials{Org: "org", Username: "user"},
+			Client: b.client(),
+			Window: 8,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := afero.NewMemMapFs()
+		serve(p, stored(fs, c.topic, c.n))
+		b.Close()
+
+		// online presence, the messages, offline presence
+		b.mu.Lock()
+		got := b.received[1 : len(b.received)-1]
+		b.mu.Unlock()
+		if len(got) != c.n {
+			t.Errorf("case %v: expected %v messages, got %v", i, c.n, len(got))
+			continue
+		}
+		for j := range got {
+			if got[j] != fmt.Sprint(j) {
+				t.Errorf("case %v: expected messages in order, got %v", i, got)
+				break
+			}
+		}
+		if names, _ := afero.ReadDir(fs, "."); len(names) != 0 {
+			t.Errorf("case %v: expected all messages removed, %v left", i, len(names))
+		}
+	}
+}
+
+// ackToken is a completed mqtt.Token.
+type ackToken struct{ err error }
+
+func (t ackToken) Wait() bool                     { return true }
+func (t ackToken) WaitTimeout(time.Duration) bool { return true }
+func (t ackToken) Error() error                   { return t.err }
+
+// ackKlient fails the publishes of the payloads in fail.
+type ackKlient struct {
+	klient
+	fail map[string]bool
+}
+
+func (k ackKlient) Connect() mqtt.Token { return ackToken{} }
+
+func (k ackKlient) Publish(_ string, _ byte, _ bool, payload interface{}) mqtt.Token {
+	if b, ok := payload.([]byte); ok && k.fail[string(b)] {
+		return ackToken{errors.New("no acknowledgement")}
+	}
+	return ackToken{}
+}
+
+func TestServeAcks(t *testing.T) {
+	k := ackKlient{fail: map[string]bool{"1": true, "3": true}}
+	p, err := NewMQTTProducer(Config{Creds: new(api.Credentials), Client: k, Window: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := afero.NewMemMapFs()
+	serve(p, stored(fs, Event, 5))
+	for i := 0; i < 5; i++ {
+		_, err := fs.Stat(fmt.Sprintf("m%v", i))
+		if kept, expect := err == nil, k.fail[fmt.Sprint(i)]; kept != expect {
+			t.Errorf("message %v: expected kept %v, got %v", i, expect, kept)
+		}
+	}
+}
+
+// BenchmarkServe measures throughput over a link with a 2ms round trip, with
+// one publish in flight at a time and with DefaultWindow.
+func BenchmarkServe(b *testing.B) {
+	for _, window := range []int{1, DefaultWindow} {
+		b.Run(fmt.Sprintf("window=%v", window), func(b *testing.B) {
+			tb := newTestBroker(2 * time.Millisecond)
+			defer tb.Close()
+			p, err := NewMQTTProducer(Config{
+				Creds:  new(api.Credentials),
+				Client: tb.client(),
+				Window: window,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			msgs := stored(afero.NewMemMapFs(), Event, b.N)
+			b.ResetTimer()
+			serve(p, msgs)
+		})
+	}
+}
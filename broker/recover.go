@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"fmt"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+
+	backend "github.com/aukletio/Auklet-Client-C/api"
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+)
+
+// Recoverer is an API that can replace credentials rejected by the broker.
+type Recoverer interface {
+	API
+	// Reregister registers the device again, so that the next call to
+	// Credentials returns new credentials. If it fails, the previous
+	// credentials are kept.
+	Reregister() error
+}
+
+// errRejected means that the broker rejected our credentials.
+type errRejected struct {
+	err error
+}
+
+func (e errRejected) Error() string {
+	return fmt.Sprintf("connecting to broker: credentials rejected: %v", e.err)
+}
+
+// isAuthError reports whether err is a CONNACK refusal caused by bad
+// credentials. A refusal as not authorised is not: it comes from the
+// broker's access control, which new credentials would not change.
+func isAuthError(err error) bool {
+	return err == packets.ConnErrors[packets.ErrRefusedBadUsernameOrPassword]
+}
+
+// newConfig is declared as a variable so that tests need not create real
+// MQTT clients.
+var newConfig = NewConfig
+
+// Connect returns a producer connected to the broker described by api, along
+// with the credentials it used. Messages are published to topics formed from
+// the given template. If the broker rejects the stored credentials, Connect
+// registers the device again, and retries once.
+func Connect(api Recoverer, topic string) (*MQTTProducer, *backend.Credentials, error) {
+	cfg, err := newConfig(api, topic)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := NewMQTTProducer(cfg)
+	if _, rejected := err.(errRejected); !rejected {
+		return p, cfg.Creds, err
+	}
+
+	errorlog.Printf("Connect: broker rejected credentials of device %v: %v; registering again",
+		cfg.Creds.Username, err)
+	if err := api.Reregister(); err != nil {
+		return nil, nil, fmt.Errorf("recovering credentials: %v", err)
+	}
+	if cfg, err = newConfig(api, topic); err != nil {
+		return nil, nil, err
+	}
+	if p, err = NewMQTTProducer(cfg); err != nil {
+		errorlog.Printf("Connect: new credentials of device %v were rejected: %v",
+			cfg.Creds.Username, err)
+		return nil, nil, err
+	}
+	return p, cfg.Creds, nil
+}
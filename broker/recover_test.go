@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+
+	"github.com/aukletio/Auklet-Client-C/api"
+)
+
+// fakeRecoverer hands out a new password each time the device registers
+// again.
+type fakeRecoverer struct {
+	mockAPI
+	discardErr error
+	discards   int
+}
+
+func (r *fakeRecoverer) Credentials() (*api.Credentials, error) {
+	return &api.Credentials{Password: string(rune('a' + r.discards))}, r.err
+}
+
+func (r *fakeRecoverer) Reregister() error {
+	r.discards++
+	return r.discardErr
+}
+
+func TestRecover(t *testing.T) {
+	origWait, origConfig := wait, newConfig
+	defer func() { wait, newConfig = origWait, origConfig }()
+	newConfig = func(a API, topic string) (Config, error) {
+		creds, err := a.Credentials()
+		return Config{Creds: creds, Client: klient{}, Topic: topic}, err
+	}
+
+	rejected := packets.ConnErrors[packets.ErrRefusedBadUsernameOrPassword]
+	denied := packets.ConnErrors[packets.ErrRefusedNotAuthorised]
+	errConn := errors.New("connect error")
+	cases := []struct {
+		errs       []error // returned by successive connection attempts
+		discardErr error
+		discards   int
+		password   string
+		ok         bool
+	}{
+		{errs: []error{nil}, discards: 0, password: "a", ok: true},
+		{errs: []error{errConn}, discards: 0, ok: false},
+		{errs: []error{rejected, nil}, discards: 1, password: "b", ok: true},
+		{errs: []error{rejected, rejected}, discards: 1, ok: false},
+		{errs: []error{rejected}, discardErr: errors.New("read-only"), discards: 1, ok: false},
+		{errs: []error{denied}, discards: 0, ok: false},
+	}
+
+	for i, c := range cases {
+		errs := c.errs
+		wait = func(tok token) error {
+			if _, publish := tok.(*mqtt.PublishToken); publish {
+				return nil
+			}
+			err := errs[0]
+			errs = errs[1:]
+			return err
+		}
+		r := &fakeRecoverer{discardErr: c.discardErr}
+		_, creds, err := Connect(r, "")
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("case %v: expected %v, got %v: %v", i, c.ok, ok, err)
+		}
+		if r.discards != c.discards {
+			t.Errorf("case %v: expected %v discards, got %v", i, c.discards, r.discards)
+		}
+		if c.ok && creds.Password != c.password {
+			t.Errorf("case %v: expected password %v, got %v", i, c.password, creds.Password)
+		}
+	}
+}
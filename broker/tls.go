@@ -0,0 +1,165 @@
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// ExpiryWarning is how long before a certificate expires that a warning is
+// sent.
+const ExpiryWarning = 30 * 24 * time.Hour
+
+// TLSFiles names PEM-encoded files from which TLS parameters for the broker
+// are loaded. Empty names are ignored.
+type TLSFiles struct {
+	Cert string // client certificate
+	Key  string // private key of the client certificate
+	CA   string // CA bundle
+
+	// OverrideCA indicates that CA replaces the bundle provided by the
+	// API, rather than supplementing it.
+	OverrideCA bool
+}
+
+// LocalTLS holds TLS parameters loaded from local files.
+type LocalTLS struct {
+	client     []tls.Certificate
+	ca         []byte // PEM-encoded; nil if there is no local bundle
+	overrideCA bool
+
+	// certs holds every loaded certificate, for expiry checks.
+	certs []*x509.Certificate
+}
+
+// LoadTLS loads the given files.
+func LoadTLS(files TLSFiles, fs afero.Fs) (*LocalTLS, error) {
+	l := &LocalTLS{overrideCA: files.OverrideCA}
+	if (files.Cert == "") != (files.Key == "") {
+		return nil, errors.New("client certificate and key must be given together")
+	}
+	if files.Cert != "" {
+		cert, err := afero.ReadFile(fs, files.Cert)
+		if err != nil {
+			return nil, err
+		}
+		key, err := afero.ReadFile(fs, files.Key)
+		if err != nil {
+			return nil, err
+		}
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		l.client = []tls.Certificate{pair}
+		l.certs = append(l.certs, parseCerts(cert)...)
+	}
+	if files.CA != "" {
+		ca, err := afero.ReadFile(fs, files.CA)
+		if err != nil {
+			return nil, err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in CA bundle %v", files.CA)
+		}
+		l.ca = ca
+		l.certs = append(l.certs, parseCerts(ca)...)
+	} else if files.OverrideCA {
+		return nil, errors.New("CA override requires a CA bundle")
+	}
+	return l, nil
+}
+
+// parseCerts returns the certificates in data that can be parsed.
+func parseCerts(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// Wrap returns an API whose certificates are those of api, extended with l.
+func (l *LocalTLS) Wrap(api Recoverer) Recoverer {
+	return tlsAPI{api, l}
+}
+
+type tlsAPI struct {
+	Recoverer
+	local *LocalTLS
+}
+
+// Certificates returns the API's TLS configuration, extended with local
+// files. If the local CA bundle overrides the API's, the API is not called.
+func (t tlsAPI) Certificates() (*tls.Config, error) {
+	cfg := &tls.Config{RootCAs: x509.NewCertPool()}
+	if !t.local.overrideCA {
+		var err error
+		if cfg, err = t.Recoverer.Certificates(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.RootCAs == nil && t.local.ca != nil {
+		// nil means the system's roots, which the bundle supplements.
+		if cfg.RootCAs, _ = x509.SystemCertPool(); cfg.RootCAs == nil {
+			cfg.RootCAs = x509.NewCertPool()
+		}
+	}
+	if cfg.RootCAs != nil {
+		cfg.RootCAs.AppendCertsFromPEM(t.local.ca)
+	}
+	cfg.Certificates = t.local.client
+	return cfg, nil
+}
+
+// Expiring returns a warning on the Log topic for each loaded certificate
+// that expires within ExpiryWarning of now.
+func (l *LocalTLS) Expiring(now time.Time) []Message {
+	var msgs []Message
+	for _, cert := range l.certs {
+		if now.Add(ExpiryWarning).Before(cert.NotAfter) {
+			continue
+		}
+		b, _ := json.Marshal(struct {
+			Type     string    `json:"type"`
+			Subject  string    `json:"subject"`
+			NotAfter time.Time `json:"notAfter"`
+			Expired  bool      `json:"expired"`
+		}{
+			Type:     "certificateExpiry",
+			Subject:  cert.Subject.String(),
+			NotAfter: cert.NotAfter,
+			Expired:  now.After(cert.NotAfter),
+		})
+		msgs = append(msgs, Message{Topic: Log, Bytes: b})
+	}
+	return msgs
+}
+
+// MessageList is a MessageSource that emits a fixed list of messages.
+type MessageList []Message
+
+// Output returns the messages of l in a closed channel.
+func (l MessageList) Output() <-chan Message {
+	out := make(chan Message, len(l))
+	for _, m := range l {
+		out <- m
+	}
+	close(out)
+	return out
+}
@@ -0,0 +1,136 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/aukletio/Auklet-Client-C/fsutil"
+)
+
+// certFs returns a filesystem holding a self-signed certificate that expires
+// at notAfter, its key, and a file without certificates.
+func certFs(notAfter time.Time) afero.Fs {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    notAfter.Add(-time.Hour),
+		NotAfter:     notAfter,
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	fs := afero.NewMemMapFs()
+	files := map[string][]byte{
+		"cert.pem":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"key.pem":   pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		"empty.pem": []byte("no certificates here"),
+	}
+	for path, b := range files {
+		if err := fsutil.WriteFile(fs.OpenFile, path, b); err != nil {
+			panic(err)
+		}
+	}
+	return fs
+}
+
+func TestLoadTLS(t *testing.T) {
+	fs := certFs(time.Now().Add(time.Hour))
+	cases := []struct {
+		files TLSFiles
+		ok    bool
+	}{
+		{files: TLSFiles{}, ok: true},
+		{files: TLSFiles{Cert: "cert.pem", Key: "key.pem"}, ok: true},
+		{files: TLSFiles{CA: "cert.pem"}, ok: true},
+		{files: TLSFiles{CA: "cert.pem", OverrideCA: true}, ok: true},
+		{files: TLSFiles{Cert: "cert.pem"}, ok: false},
+		{files: TLSFiles{Cert: "noexist", Key: "key.pem"}, ok: false},
+		{files: TLSFiles{Cert: "cert.pem", Key: "cert.pem"}, ok: false},
+		{files: TLSFiles{CA: "empty.pem"}, ok: false},
+		{files: TLSFiles{OverrideCA: true}, ok: false},
+	}
+
+	for i, c := range cases {
+		_, err := LoadTLS(c.files, fs)
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("case %v: expected %v, got %v: %v", i, c.ok, ok, err)
+		}
+	}
+}
+
+func TestTLSCertificates(t *testing.T) {
+	fs := certFs(time.Now().Add(time.Hour))
+	errAPI := errors.New("API called")
+	cases := []struct {
+		files TLSFiles
+		err   error
+	}{
+		// supplement the API's bundle
+		{files: TLSFiles{Cert: "cert.pem", Key: "key.pem", CA: "cert.pem"}, err: errAPI},
+		// override the API's bundle
+		{files: TLSFiles{Cert: "cert.pem", Key: "key.pem", CA: "cert.pem", OverrideCA: true}, err: nil},
+	}
+
+	for i, c := range cases {
+		l, err := LoadTLS(c.files, fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := l.Wrap(&fakeRecoverer{mockAPI: mockAPI{errAPI}}).Certificates()
+		if err != c.err {
+			t.Errorf("case %v: expected %v, got %v", i, c.err, err)
+		}
+		if err == nil && len(cfg.Certificates) != 1 {
+			t.Errorf("case %v: expected a client certificate, got %v", i, len(cfg.Certificates))
+		}
+	}
+}
+
+func TestExpiring(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		notAfter time.Time
+		expect   int
+	}{
+		{notAfter: now.Add(2 * ExpiryWarning), expect: 0},
+		{notAfter: now.Add(ExpiryWarning / 2), expect: 2},
+		{notAfter: now.Add(-time.Hour), expect: 2},
+	}
+
+	for i, c := range cases {
+		fs := certFs(c.notAfter)
+		l, err := LoadTLS(TLSFiles{Cert: "cert.pem", Key: "key.pem", CA: "cert.pem"}, fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs := l.Expiring(now)
+		if len(msgs) != c.expect {
+			t.Errorf("case %v: expected %v, got %v", i, c.expect, len(msgs))
+		}
+		for m := range MessageList(msgs).Output() {
+			if m.Topic != Log {
+				t.Errorf("case %v: expected topic %v, got %v", i, Log, m.Topic)
+			}
+		}
+	}
+}
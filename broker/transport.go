@@ -0,0 +1,138 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+)
+
+// Transport selects how broker connections are made.
+type Transport string
+
+// Auto, TLS, and WebSocket are Transports. Auto uses TLS, falling back to
+// WebSockets if the TLS port is unreachable.
+const (
+	Auto      Transport = "auto"
+	TLS                 = "tls"
+	WebSocket           = "wss"
+)
+
+// ParseTransport returns the Transport named s. The empty string names Auto.
+func ParseTransport(s string) (Transport, error) {
+	switch t := Transport(s); t {
+	case "":
+		return Auto, nil
+	case Auto, TLS, WebSocket:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown broker transport %q", s)
+}
+
+// webSocketPort and webSocketPath locate the broker's WebSocket endpoint when
+// the backend does not provide one.
+const (
+	webSocketPort = "443"
+	webSocketPath = "/mqtt"
+)
+
+// probeTimeout is how long the TLS port is given to accept a connection.
+const probeTimeout = 10 * time.Second
+
+// TransportAPI is an API whose broker address uses the chosen Transport.
+// A WebSocket address provided by the backend is always used as-is.
+type TransportAPI struct {
+	Recoverer
+	Transport Transport
+
+	// Dialer is used to probe the TLS port. If nil, connections are
+	// direct.
+	Dialer proxy.Dialer
+}
+
+// BrokerAddress returns the broker address for the chosen transport.
+func (t TransportAPI) BrokerAddress() (string, error) {
+	addr, err := t.Recoverer.BrokerAddress()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+
+	chosen, reason := t.choose(u)
+	log.Printf("broker transport: %v (%v)", chosen, reason)
+	if chosen == WebSocket && u.Scheme != "wss" {
+		u = &url.URL{
+			Scheme: "wss",
+			Host:   net.JoinHostPort(u.Hostname(), webSocketPort),
+			Path:   webSocketPath,
+		}
+	}
+	return u.String(), nil
+}
+
+// choose returns the transport with which to reach u, and the reason for
+// choosing it.
+func (t TransportAPI) choose(u *url.URL) (Transport, string) {
+	if u.Scheme == "wss" {
+		return WebSocket, "chosen by backend"
+	}
+	if t.Transport == TLS || t.Transport == WebSocket {
+		return t.Transport, "configured"
+	}
+	if err := t.probe(u.Host); err != nil {
+		errorlog.Printf("TransportAPI.choose: TLS port unreachable: %v", err)
+		return WebSocket, "fallback"
+	}
+	return TLS, "TLS port reachable"
+}
+
+// probe reports whether a connection to addr can be established.
+func (t TransportAPI) probe(addr string) error {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if t.Dialer == nil {
+		conn, err = net.DialTimeout("tcp", addr, probeTimeout)
+	} else {
+		conn, err = dialTimeout(t.Dialer, addr, probeTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// dialTimeout connects to addr with d, giving up after timeout. Dialers
+// of proxies have no timeout of their own.
+func dialTimeout(d proxy.Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := d.Dial("tcp", addr)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		// Close the connection if it is made after all.
+		go func() {
+			if r := <-done; r.err == nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("dial %v: timed out after %v", addr, timeout)
+	}
+}
@@ -0,0 +1,100 @@
+package broker
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseTransport(t *testing.T) {
+	cases := []struct {
+		name   string
+		expect Transport
+		ok     bool
+	}{
+		{name: "", expect: Auto, ok: true},
+		{name: "tls", expect: TLS, ok: true},
+		{name: "wss", expect: WebSocket, ok: true},
+		{name: "ws", ok: false},
+	}
+
+	for i, c := range cases {
+		got, err := ParseTransport(c.name)
+		if ok := err == nil; ok != c.ok || got != c.expect {
+			t.Errorf("case %v: expected %v %v, got %v %v", i, c.expect, c.ok, got, ok)
+		}
+	}
+}
+
+func TestTransportAddress(t *testing.T) {
+	open, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	cases := []struct {
+		addr      string
+		transport Transport
+		expect    string
+	}{
+		{
+			addr:      "wss://broker:8443/mqtt",
+			transport: TLS,
+			expect:    "wss://broker:8443/mqtt",
+		}, {
+			addr:      "ssl://broker:8883",
+			transport: TLS,
+			expect:    "ssl://broker:8883",
+		}, {
+			addr:      "ssl://broker:8883",
+			transport: WebSocket,
+			expect:    "wss://broker:443/mqtt",
+		}, {
+			addr:      "ssl://" + open.Addr().String(),
+			transport: Auto,
+			expect:    "ssl://" + open.Addr().String(),
+		}, {
+			addr:      "ssl://" + closed.Addr().String(),
+			transport: Auto,
+			expect:    "wss://127.0.0.1:443/mqtt",
+		},
+	}
+
+	for i, c := range cases {
+		api := TransportAPI{
+			Recoverer: &brokerAPI{addr: c.addr},
+			Transport: c.transport,
+		}
+		got, err := api.BrokerAddress()
+		if err != nil {
+			t.Errorf("case %v: %v", i, err)
+		}
+		if got != c.expect {
+			t.Errorf("case %v: expected %v, got %v", i, c.expect, got)
+		}
+	}
+}
+
+// hangingDialer does not connect until released, like a proxy that does
+// not respond.
+type hangingDialer chan struct{}
+
+func (d hangingDialer) Dial(network, addr string) (net.Conn, error) {
+	<-d
+	return nil, errors.New("released")
+}
+
+func TestDialTimeout(t *testing.T) {
+	d := make(hangingDialer)
+	defer close(d)
+	if _, err := dialTimeout(d, "broker:8883", 10*time.Millisecond); err == nil {
+		t.Error("expected timeout")
+	}
+}
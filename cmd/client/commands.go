@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+	"github.com/aukletio/Auklet-Client-C/command"
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+	"github.com/aukletio/Auklet-Client-C/message"
+	"github.com/aukletio/Auklet-Client-C/schema"
+	"github.com/aukletio/Auklet-Client-C/version"
+)
+
+// subscriber is a producer that can receive messages.
+type subscriber interface {
+	Subscribe(broker.Topic) (<-chan broker.Message, error)
+}
+
+// commands returns a source of responses to remote commands, or nil if remote
+// commands are disabled.
+func (c *client) commands(registry command.Registry, done <-chan struct{}) broker.MessageSource {
+	if c.commandKey == nil {
+		log.Print("remote commands disabled")
+		return nil
+	}
+	sub, ok := c.producer.(subscriber)
+	if !ok {
+		errorlog.Print("remote commands require a broker connection")
+		return nil
+	}
+	in, err := sub.Subscribe(broker.Command)
+	if err != nil {
+		errorlog.Print(err)
+		return nil
+	}
+	history := &command.History{Path: c.historyPath, Fs: c.fs}
+	return command.NewDispatcher(registry, c.commandKey, c.macHash, history, in, done)
+}
+
+// registry returns the remote commands that act on the given app, message
+// store, flusher of stored messages, data limiter, and compressor, which may
+// be nil.
+func (c *client) registry(exec exec, persistor *broker.Persistor, flushed flusher, limiter *message.DataLimiter, compressor *schema.Compressor) command.Registry {
+	start := time.Now()
+	return command.Registry{
+		// flush sends again the stored messages that failed to reach the
+		// broker. They pass through the data limiter.
+		"flush": func(json.RawMessage, func(broker.Message)) (interface{}, error) {
+			msgs := persistor.Unsent()
+			if !flushed.flush(msgs) {
+				return nil, errStopped
+			}
+			return map[string]int{"messages": len(msgs)}, nil
+		},
+
+		// profile requests an immediate profile emission from the agent.
+		"profile": func(json.RawMessage, func(broker.Message)) (interface{}, error) {
+			_, err := exec.AgentData().Write([]byte{0})
+			return nil, err
+		},
+
+		// purge deletes all unsent messages.
+		"purge": func(json.RawMessage, func(broker.Message)) (interface{}, error) {
+			n, err := persistor.Purge()
+			return map[string]int{"messages": n}, err
+		},
+
+		"log-level": func(args json.RawMessage, _ func(broker.Message)) (interface{}, error) {
+			var a struct {
+				Level string `json:"level"`
+			}
+			if err := json.Unmarshal(args, &a); err != nil {
+				return nil, err
+			}
+			return nil, setLogLevel(a.Level, os.Stderr, os.Stdout)
+		},
+
+		"diagnostics": func(json.RawMessage, func(broker.Message)) (interface{}, error) {
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+			d := diagnostics{
+				ClientVersion: version.Version,
+				AppID:         c.appID,
+				Device:        c.macHash,
+				Pid:           exec.Pid(),
+				Uptime:        int64(time.Since(start) / time.Second),
+				QueueDepth:    persistor.Len(),
+				DataUsage:     limiter.Usage(),
+				Goroutines:    runtime.NumGoroutine(),
+				HeapBytes:     mem.HeapAlloc,
+				OS:            runtime.GOOS,
+				Arch:          runtime.GOARCH,
+			}
+			if compressor != nil {
+				s := compressor.Stats()
+				d.Compression = &compressionReport{s, s.Ratio()}
+			}
+			return d, nil
+		},
+	}
+}
+
+var errStopped = errors.New("the client is stopping")
+
+// flusher is a source of stored messages to be sent again.
+type flusher struct {
+	in   chan []broker.Message
+	out  chan broker.Message
+	done <-chan struct{}
+}
+
+// newFlusher returns a flusher whose output is closed when done is closed.
+func newFlusher(done <-chan struct{}) flusher {
+	f := flusher{
+		in:   make(chan []broker.Message),
+		out:  make(chan broker.Message),
+		done: done,
+	}
+	go func() {
+		defer close(f.out)
+		for {
+			select {
+			case msgs := <-f.in:
+				for _, m := range msgs {
+					select {
+					case f.out <- m:
+					case <-done:
+						return
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return f
+}
+
+// flush queues msgs to be sent. It reports whether they were queued before
+// the flusher stopped.
+func (f flusher) flush(msgs []broker.Message) bool {
+	select {
+	case f.in <- msgs:
+		return true
+	case <-f.done:
+		for _, m := range msgs {
+			m.Release()
+		}
+		return false
+	}
+}
+
+// Output returns f's output stream.
+func (f flusher) Output() <-chan broker.Message { return f.out }
+
+// diagnostics is the result of the diagnostics command.
+type diagnostics struct {
+	ClientVersion string        `json:"clientVersion"`
+	AppID         string        `json:"appId"`
+	Device        string        `json:"device"`
+	Pid           int           `json:"pid"`    // of the app
+	Uptime        int64         `json:"uptime"` // seconds
+	QueueDepth    int           `json:"queueDepth"`
+	DataUsage     message.Usage `json:"dataUsage"`
+	Goroutines    int           `json:"goroutines"`
+	HeapBytes     uint64        `json:"heapBytes"`
+	OS            string        `json:"os"`
+	Arch          string        `json:"arch"`
+
+	Compression *compressionReport `json:"compression,omitempty"`
+}
+
+// compressionReport reports the compression ratio achieved so far.
+type compressionReport struct {
+	schema.CompressionStats
+	Ratio float64 `json:"ratio"`
+}
+
+// setLogLevel directs logs according to level: info writes informational
+// logs to info and error logs to errs; errors writes only error logs; none
+// writes neither.
+func setLogLevel(level string, info, errs io.Writer) error {
+	switch level {
+	case "info":
+	case "errors":
+		info = ioutil.Discard
+	case "none":
+		info, errs = ioutil.Discard, ioutil.Discard
+	default:
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	log.SetOutput(info)
+	errorlog.SetOutput(errs)
+	return nil
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -21,7 +24,9 @@ import (
 	"github.com/aukletio/Auklet-Client-C/config"
 	"github.com/aukletio/Auklet-Client-C/device"
 	"github.com/aukletio/Auklet-Client-C/errorlog"
+	"github.com/aukletio/Auklet-Client-C/fsutil"
 	"github.com/aukletio/Auklet-Client-C/message"
+	"github.com/aukletio/Auklet-Client-C/profile"
 	"github.com/aukletio/Auklet-Client-C/schema"
 	"github.com/aukletio/Auklet-Client-C/version"
 )
@@ -35,19 +40,51 @@ func main() {
 		flags.PrintDefaults()
 	}
 	var (
-		baseURL            string
-		userVersion        string
+		opts               options
 		viewLicenses       bool
 		noNetwork          bool
 		serialOut          string
 		printClientVersion bool
+		bundlePath         string
+		bundleKey          string
+		schemaDir          string
+		profileDir         string
+		profileLimit       int
+		exportDir          string
+		symbolsPath        string
 	)
-	flags.StringVar(&baseURL, "base-url", "", "Auklet API URL; do not change unless instructed by support")
-	flags.StringVar(&userVersion, "appVersion", "", "version of your application")
+	flags.StringVar(&opts.baseURL, "base-url", "", "Auklet API URL; do not change unless instructed by support")
+	flags.StringVar(&opts.userVersion, "appVersion", "", "version of your application")
 	flags.StringVar(&serialOut, "serial-out", "", "address of serial device to write JSON")
 	flags.BoolVar(&printClientVersion, "version", false, "print Auklet Client version")
 	flags.BoolVar(&viewLicenses, "licenses", false, "view OSS licenses")
 	flags.BoolVar(&noNetwork, "no-network", false, "disable network communication")
+	flags.DurationVar(&opts.procInterval, "process-metrics", 0, "interval at which to sample metrics of the app's processes; 0 disables sampling")
+	flags.StringVar(&bundlePath, "provision", "", "import a provisioning bundle into the data directory and exit")
+	flags.StringVar(&schemaDir, "json-schema", "", "write the JSON Schemas of broker messages to this directory and exit")
+	flags.StringVar(&profileDir, "profile-dir", "", "with -no-network, archive profiles to this directory as JSON, pprof, and folded stacks")
+	flags.IntVar(&profileLimit, "profile-limit", 0, fmt.Sprintf("number of profiles kept in -profile-dir, removing the oldest (default %v)", profile.DefaultArchiveLimit))
+	flags.StringVar(&exportDir, "export-profiles", "", "convert the profiles archived in this directory to pprof and folded stacks, and exit")
+	flags.StringVar(&symbolsPath, "symbols", "", "executable from which -export-profiles names functions (default: the one recorded with each profile)")
+	flags.StringVar(&opts.tls.Cert, "client-cert", "", "PEM-encoded client certificate for the broker")
+	flags.StringVar(&opts.tls.Key, "client-key", "", "PEM-encoded private key of the client certificate")
+	flags.StringVar(&opts.tls.CA, "ca-bundle", "", "PEM-encoded CA bundle with which to verify the broker")
+	flags.BoolVar(&opts.tls.OverrideCA, "ca-override", false, "use only the CA bundle given by -ca-bundle, instead of adding it to the API's")
+	flags.StringVar(&opts.proxy, "proxy", "", "HTTP or SOCKS5 proxy for API and broker connections, as scheme://[user:password@]host:port")
+	flags.StringVar(&opts.uploadURL, "upload-url", "", "upload messages in batches to this HTTPS URL, instead of sending them to the broker")
+	flags.StringVar(&opts.brokerURL, "broker-url", "", "URL of your own MQTT broker, such as ssl://host:8883; the Auklet backend is not used")
+	flags.StringVar(&opts.topic, "topic-template", "", "template of broker topics, in which {topic}, {org}, {device} and {encoding} are replaced (default \""+broker.DefaultTopic+"\")")
+	flags.BoolVar(&opts.skipRelease, "skip-release-check", false, "serve the app without checking that it was released")
+	flags.StringVar(&opts.transport, "broker-transport", "", "broker transport: auto, tls, or wss (MQTT over WebSockets)")
+	flags.StringVar(&opts.commandKey, "command-key", "", "PEM-encoded ECDSA public key with which to verify remote commands; if not given, remote commands are disabled")
+	flags.DurationVar(&opts.batch.Window, "batch-window", 0, "how long datapoints and profiles may wait to be sent in a batch; 0 disables batching")
+	flags.IntVar(&opts.batch.Count, "batch-count", 0, fmt.Sprintf("maximum number of messages in a batch (default %v)", schema.DefaultBatchCount))
+	flags.IntVar(&opts.batch.Bytes, "batch-bytes", 0, fmt.Sprintf("maximum bytes of messages in a batch (default %v)", schema.DefaultBatchBytes))
+	flags.StringVar(&opts.encoding, "encoding", "", "encoding of messages: msgpack (the default), json, compact, protobuf, or cbor")
+	flags.StringVar(&opts.compression, "compression", "", "compression of message payloads: none, gzip, or zlib")
+	flags.DurationVar(&opts.clockJump, "clock-jump", 0, fmt.Sprintf("least jump of the wall clock taken to mean that it was set (default %v)", schema.DefaultClockJump))
+	flags.BoolVar(&opts.fullMetadata, "full-metadata", false, "send the full metadata in every message, instead of once per session")
+	flags.StringVar(&bundleKey, "provision-key", "", "PEM-encoded ECDSA public key with which to verify the provisioning bundle")
 
 	err := flags.Parse(os.Args[1:])
 	switch {
@@ -62,6 +99,24 @@ func main() {
 		licenses()
 		os.Exit(0)
 
+	case bundlePath != "":
+		if err := provision(afero.NewOsFs(), config.OS, bundlePath, bundleKey); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+
+	case schemaDir != "":
+		if err := writeSchemas(afero.NewOsFs(), schemaDir); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+
+	case exportDir != "":
+		if err := exportProfiles(afero.NewOsFs(), exportDir, symbolsPath); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+
 	case len(flags.Args()) == 0:
 		flags.Usage()
 		os.Exit(1)
@@ -69,12 +124,12 @@ func main() {
 
 	pipeline := func() interface{ run(exec) error } {
 		if serialOut != "" {
-			return newserial(serialOut, userVersion)
+			return newserial(serialOut, opts.userVersion, noNetwork)
 		}
 		if noNetwork {
-			return dumper{}
+			return newdumper(config.OS, profileDir, profileLimit)
 		}
-		p, err := newclient(userVersion, baseURL)
+		p, err := newclient(opts)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -120,15 +175,35 @@ type exec interface {
 	AgentData() io.ReadWriter
 	Decoder() *json.Decoder
 	DataPoints() io.Reader
+	Pid() int
 }
 
-type dumper struct{}
+type dumper struct {
+	// archive, if not nil, keeps the app's profiles.
+	archive *profile.Archive
+}
+
+func newdumper(env config.Getenv, profileDir string, profileLimit int) dumper {
+	var d dumper
+	if dir := env.ProfileDir(profileDir); dir != "" {
+		d.archive = &profile.Archive{
+			Dir:   dir,
+			Fs:    afero.NewOsFs(),
+			Limit: env.ProfileLimit(profileLimit),
+		}
+	}
+	return d
+}
 
-func (dumper) run(e exec) error {
+func (d dumper) run(e exec) error {
 	if err := e.Connect(); err != nil {
 		return err
 	}
 
+	var keep func(data []byte)
+	if d.archive != nil {
+		keep = d.keeper(e.Pid())
+	}
 	server := agent.NewServer(e.AgentData(), e.Decoder())
 	logger := agent.NewDataPointServer(e.DataPoints())
 	agent.NewPeriodicRequester(e.AgentData(), server.Done, nil)
@@ -138,26 +213,109 @@ func (dumper) run(e exec) error {
 data: %v
 
 `, m.Type, string(m.Data))
+		if m.Type == "profile" && keep != nil {
+			keep(m.Data)
+		}
 	}
 	return nil
 }
 
+// keeper returns a function that archives the profiles of the process pid,
+// naming functions from its executable, if it can be read.
+func (d dumper) keeper(pid int) func(data []byte) {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%v/exe", pid))
+	if err != nil {
+		errorlog.Printf("dumper.keeper: %v", err)
+	}
+	var mapping profile.Mapping
+	var sym *profile.Symbols
+	if exe != "" {
+		if mapping, err = profile.ReadMapping(afero.NewOsFs(), pid, exe); err != nil {
+			errorlog.Printf("dumper.keeper: %v", err)
+		}
+		if sym, err = profile.OpenSymbols(exe); err != nil {
+			log.Printf("archived profiles will not name functions: %v", err)
+		}
+	}
+	return func(data []byte) {
+		p, err := profile.Parse(data)
+		if err != nil {
+			errorlog.Printf("dumper.keeper: %v", err)
+			return
+		}
+		p.Time = time.Now().UnixNano() / int64(time.Millisecond)
+		p.Executable, p.Mapping = exe, mapping
+		if err := d.archive.Add(p, sym); err != nil {
+			errorlog.Printf("dumper.keeper: %v", err)
+		}
+	}
+}
+
 type serial struct {
 	userVersion string
 	appID       string
 	macHash     string
 	addr        string // address of serial device
 	fs          afero.Fs
+	metrics     device.Config
+	ip          schema.IPProvider
 }
 
-func newserial(addr, userVersion string) serial {
+func newserial(addr, userVersion string, noNetwork bool) serial {
+	fs := afero.NewOsFs()
+	prefix, err := selectPrefix(fs, config.OS)
+	if err != nil {
+		errorlog.Print(err)
+	}
 	return serial{
 		userVersion: userVersion,
 		appID:       config.OS.AppID(),
-		macHash:     device.IfaceHash(),
-		addr:        addr,
-		fs:          afero.NewOsFs(),
+		// Serial devices are not registered, so nothing marks those that
+		// reported IfaceHash before Identity existed: all of them did.
+		macHash: identity(fs, config.OS, prefix, true).ID(),
+		addr:    addr,
+		fs:      fs,
+		metrics: metricsConfig(config.OS, prefix+".auklet"),
+		ip:      ipProvider(config.OS, noNetwork),
+	}
+}
+
+// identity returns the identity of the device whose data directory is
+// under prefix. If legacy, a device without a persisted identifier keeps
+// the IfaceHash it reported before Identity existed.
+func identity(fs afero.Fs, env config.Getenv, prefix string, legacy bool) device.Identity {
+	return device.Identity{
+		Path:   prefix + ".auklet/device-id",
+		Seed:   env.DeviceIDSeed(),
+		Legacy: legacy,
+		Fs:     fs,
+	}
+}
+
+// ipProvider returns a source of the device's public IP address, or nil if
+// collecting it is disabled.
+func ipProvider(env config.Getenv, noNetwork bool) schema.IPProvider {
+	if noNetwork || !env.PublicIP() {
+		log.Print("public IP address collection disabled")
+		return nil
+	}
+	return device.NewIPCache(device.IPTTL)
+}
+
+// metricsConfig returns the system metrics configuration for the given data
+// directory.
+func metricsConfig(env config.Getenv, dataDir string) device.Config {
+	disabled := env.DisabledMetrics()
+	for name := range disabled {
+		known := false
+		for _, source := range device.Sources {
+			known = known || name == source
+		}
+		if !known {
+			errorlog.Printf("warning: unknown metric source %q", name)
+		}
 	}
+	return device.NewConfig(dataDir, disabled)
 }
 
 func (s serial) run(e exec) error {
@@ -167,8 +325,9 @@ func (s serial) run(e exec) error {
 	server := agent.NewServer(e.AgentData(), e.Decoder())
 	converter := schema.NewConverter(
 		schema.Config{
-			Monitor:     device.NewMonitor(),
+			Monitor:     device.NewMonitor(s.metrics),
 			Persistor:   nil,
+			IP:          s.ip,
 			App:         e, // schema.ExitSignalApp
 			Username:    "",
 			UserVersion: s.userVersion,
@@ -218,17 +377,113 @@ func (s serial) run(e exec) error {
 
 type client struct {
 	msgPath      string // directory for storing unsent messages
+	seqPath      string // of the last sequence number used on each topic
 	limPersistor message.Persistor
-	api          interface {
-		dataLimiter
-		Release(string) error
+	api          backendAPI
+	userVersion  string
+	username     string
+	appID        string
+	macHash      string
+	producer     interface{ Serve(broker.MessageSource) }
+	fs           afero.Fs
+	metrics      device.Config
+	ip           schema.IPProvider
+
+	// procInterval is the sampling period of process metrics. If zero,
+	// process metrics are not sampled.
+	procInterval time.Duration
+
+	// warnings are sent on the logs topic at startup.
+	warnings broker.MessageList
+
+	// commandKey verifies remote commands. If nil, remote commands are
+	// disabled.
+	commandKey  []byte
+	historyPath string // of executed commands
+
+	// batch bounds batches of messages. If its Window is zero, messages
+	// are not batched.
+	batch schema.BatchConfig
+
+	encoding    schema.Encoding
+	compression schema.Compression
+
+	// fullMetadata disables sessions.
+	fullMetadata bool
+
+	// clockJump is the least jump of the wall clock taken to mean that it
+	// was set.
+	clockJump time.Duration
+}
+
+// provision imports the bundle at path into the data directory. If keyPath is
+// not empty, the bundle's signature is verified with the key it names.
+func provision(fs afero.Fs, env config.Getenv, path, keyPath string) error {
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return err
 	}
-	userVersion string
-	username    string
-	appID       string
-	macHash     string
-	producer    interface{ Serve(broker.MessageSource) }
-	fs          broker.Fs
+	var key []byte
+	if keyPath != "" {
+		if key, err = afero.ReadFile(fs, keyPath); err != nil {
+			return err
+		}
+	}
+	bundle, err := backend.ParseBundle(data, key)
+	if err != nil {
+		return err
+	}
+	prefix, err := selectPrefix(fs, env)
+	if err != nil {
+		return err
+	}
+	saved := prefix + ".auklet/provision.json"
+	if err := bundle.Save(saved, fs.OpenFile); err != nil {
+		return err
+	}
+	// An earlier import may have left the file readable by others.
+	if err := fs.Chmod(saved, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("imported provisioning bundle for application %v into %v\n", bundle.AppID, prefix+".auklet")
+	return nil
+}
+
+// exportProfiles converts the profiles archived in dir to pprof and folded
+// stacks, naming functions from the executable at symbolsPath, if given.
+func exportProfiles(fs afero.Fs, dir, symbolsPath string) error {
+	var sym *profile.Symbols
+	if symbolsPath != "" {
+		var err error
+		if sym, err = profile.OpenSymbols(symbolsPath); err != nil {
+			return err
+		}
+	}
+	n, err := profile.Archive{Dir: dir, Fs: fs}.Convert(sym)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("converted %v profiles in %v\n", n, dir)
+	return nil
+}
+
+// writeSchemas writes the JSON Schema of each kind of broker message to dir.
+func writeSchemas(fs afero.Fs, dir string) error {
+	schemas, err := schema.JSONSchemas()
+	if err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for kind, s := range schemas {
+		path := filepath.Join(dir, kind+".json")
+		if err := fsutil.WriteFile(fs.OpenFile, path, s); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("wrote JSON Schemas of version %v to %v\n", schema.SchemaVersion, dir)
+	return nil
 }
 
 func selectPrefix(fs afero.Fs, env config.Getenv) (string, error) {
@@ -244,7 +499,28 @@ func selectPrefix(fs afero.Fs, env config.Getenv) (string, error) {
 	return afero.TempDir(fs, "", "auklet-")
 }
 
-func newclient(userVersion string, baseURL string) (*client, error) {
+// options holds command-line settings of a client. They take precedence over
+// the same settings given in the environment.
+type options struct {
+	userVersion  string
+	baseURL      string
+	procInterval time.Duration
+	tls          broker.TLSFiles
+	proxy        string
+	transport    string
+	uploadURL    string
+	brokerURL    string
+	topic        string // template
+	skipRelease  bool
+	commandKey   string // path
+	batch        schema.BatchConfig
+	encoding     string
+	compression  string
+	fullMetadata bool
+	clockJump    time.Duration
+}
+
+func newclient(opts options) (*client, error) {
 	env := config.OS
 	fs := afero.NewOsFs()
 
@@ -255,17 +531,38 @@ func newclient(userVersion string, baseURL string) (*client, error) {
 		log.Printf("selected prefix %q", prefix)
 	}
 
-	appID := env.AppID()
-	macHash := device.IfaceHash()
+	// A provisioning bundle, if present, replaces device registration.
+	bundle, bundleErr := backend.LoadBundle(prefix+".auklet/provision.json", fs.Open)
+	appID := ""
+	if bundleErr == nil {
+		log.Print("using provisioning bundle")
+		appID = bundle.AppID
+	}
+	if appID == "" {
+		appID = env.AppID()
+	}
+	credsPath := prefix + ".auklet/identification"
+	_, credsErr := fs.Stat(credsPath)
+	id := identity(fs, env, prefix, credsErr == nil) // registered before Identity existed
+	macHash := id.ID()
+
+	var proxy *url.URL
+	if p := env.Proxy(opts.proxy); p != "" {
+		if proxy, err = broker.ParseProxy(p); err != nil {
+			return nil, err
+		}
+		log.Printf("using proxy %v", proxy.Host)
+	}
 
+	brokerURL := env.BrokerURL(opts.brokerURL)
 	api := backend.API{
-		BaseURL: env.BaseURL(baseURL),
-		Key:     env.APIKey(),
+		BaseURL: env.BaseURL(opts.baseURL),
 		AppID:   appID,
 		MacHash: macHash,
 
-		CredsPath: prefix + ".auklet/identification",
+		CredsPath: credsPath,
 		Fs:        fs,
+		Rotate:    id.Rotate,
 
 		ReleasesEP:     backend.ReleasesEP,
 		CertificatesEP: backend.CertificatesEP,
@@ -273,31 +570,157 @@ func newclient(userVersion string, baseURL string) (*client, error) {
 		ConfigEP:       backend.ConfigEP,
 		DataLimitEP:    backend.DataLimitEP,
 	}
+	if brokerURL == "" {
+		api.Key = env.APIKey()
+	}
+	if proxy != nil {
+		api.Client = backend.ProxyClient(proxy)
+	}
+
+	// The device's identity changes if it registers again.
+	var (
+		brokerAPI  broker.Recoverer = &api
+		serviceAPI backendAPI       = &api
+	)
+	switch {
+	case brokerURL != "":
+		// Bring your own broker; the backend is not used at all.
+		log.Printf("using local broker %v", brokerURL)
+		clientID := env.BrokerClientID()
+		if clientID == "" {
+			clientID = macHash
+		}
+		brokerAPI = broker.LocalBroker{
+			URL: brokerURL,
+			Creds: backend.Credentials{
+				Username: env.BrokerUsername(),
+				Password: env.BrokerPassword(),
+				ClientID: clientID,
+			},
+		}
+		serviceAPI = skipRelease{noBackend{}}
+	case bundleErr == nil:
+		p := backend.Provisioned{API: api, Bundle: bundle}
+		brokerAPI, serviceAPI = p, p
+	}
+	if env.SkipReleaseCheck(opts.skipRelease) {
+		serviceAPI = skipRelease{serviceAPI}
+	}
+
+	var (
+		producer interface{ Serve(broker.MessageSource) }
+		creds    *backend.Credentials
+		warnings broker.MessageList
+	)
+	if uploadURL := env.UploadURL(opts.uploadURL); uploadURL != "" {
+		if creds, err = brokerAPI.Credentials(); err != nil {
+			return nil, err
+		}
+		log.Printf("uploading messages to %v", uploadURL)
+		producer = broker.NewHTTPProducer(uploadURL, api.Client, creds)
+	} else {
+		producer, creds, warnings, err = connectMQTT(env, opts, fs, brokerAPI, proxy)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	cfg, err := broker.NewConfig(api)
+	encoding, err := schema.ParseEncoding(env.Encoding(opts.encoding))
 	if err != nil {
 		return nil, err
 	}
-
-	producer, err := broker.NewMQTTProducer(cfg)
+	compression, err := schema.ParseCompression(env.Compression(opts.compression))
 	if err != nil {
 		return nil, err
 	}
 
+	var commandKey []byte
+	if path := env.CommandKey(opts.commandKey); path != "" {
+		if commandKey, err = afero.ReadFile(fs, path); err != nil {
+			return nil, err
+		}
+	}
+
 	configureLogs(env)
 	return &client{
 		msgPath:      prefix + ".auklet/message",
+		seqPath:      prefix + ".auklet/sequences.json",
 		limPersistor: message.FilePersistor{Path: prefix + ".auklet/datalimit.json"},
-		api:          api,
-		userVersion:  userVersion,
-		username:     cfg.Creds.Username,
+		api:          serviceAPI,
+		userVersion:  opts.userVersion,
+		username:     creds.Username,
 		appID:        appID,
-		macHash:      macHash,
+		macHash:      api.MacHash,
 		producer:     producer,
 		fs:           fs,
+		metrics:      metricsConfig(env, prefix+".auklet"),
+		ip:           ipProvider(env, false),
+		procInterval: opts.procInterval,
+		warnings:     warnings,
+		commandKey:   commandKey,
+		historyPath:  prefix + ".auklet/commands.json",
+		batch: schema.BatchConfig{
+			Count:  env.BatchCount(opts.batch.Count),
+			Bytes:  env.BatchBytes(opts.batch.Bytes),
+			Window: env.BatchWindow(opts.batch.Window),
+		},
+		encoding:     encoding,
+		compression:  compression,
+		fullMetadata: env.FullMetadata(opts.fullMetadata),
+		clockJump:    env.ClockJump(opts.clockJump),
 	}, nil
 }
 
+// connectMQTT connects to the broker described by api, applying local TLS
+// files, the chosen transport, and proxy, if not nil. It returns the
+// credentials it used, and warnings about expiring certificates.
+func connectMQTT(env config.Getenv, opts options, fs afero.Fs, api broker.Recoverer, proxy *url.URL) (*broker.MQTTProducer, *backend.Credentials, broker.MessageList, error) {
+	local, err := broker.LoadTLS(broker.TLSFiles{
+		Cert:       env.ClientCert(opts.tls.Cert),
+		Key:        env.ClientKey(opts.tls.Key),
+		CA:         env.CABundle(opts.tls.CA),
+		OverrideCA: env.CAOverride(opts.tls.OverrideCA),
+	}, fs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	warnings := local.Expiring(time.Now())
+	for _, w := range warnings {
+		errorlog.Printf("warning: certificate expires soon: %s", w.Bytes)
+	}
+
+	transport, err := broker.ParseTransport(env.BrokerTransport(opts.transport))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tapi := broker.TransportAPI{Recoverer: local.Wrap(api), Transport: transport}
+	if proxy != nil {
+		if tapi.Dialer, err = broker.ProxyDialer(proxy); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	connAPI := withTransport(api, tapi)
+	if proxy != nil {
+		connAPI = broker.WrapProxy(connAPI, tapi.Dialer)
+	}
+
+	topic, err := broker.ParseTopic(env.TopicTemplate(opts.topic))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	producer, creds, err := broker.Connect(connAPI, topic)
+	return producer, creds, warnings, err
+}
+
+// withTransport returns t, unless api is your own broker and no transport
+// was chosen: its address is then used as configured, rather than probed.
+func withTransport(api broker.Recoverer, t broker.TransportAPI) broker.Recoverer {
+	if _, own := api.(broker.LocalBroker); own && t.Transport == broker.Auto {
+		return t.Recoverer
+	}
+	return t
+}
+
 func (c *client) run(exec exec) error {
 	err := c.api.Release(exec.CheckSum())
 	if err != nil {
@@ -318,33 +741,83 @@ func (c *client) run(exec exec) error {
 
 	// main source of messages
 	server := agent.NewServer(exec.AgentData(), exec.Decoder())
+	sources := []agent.MessageSource{
+		server,
+		agent.NewDataPointServer(exec.DataPoints()),
+	}
+	if c.procInterval > 0 {
+		sources = append(sources, device.NewProcessSampler(exec.Pid(), c.procInterval, server.Done))
+	}
 
-	c.producer.Serve(
-		message.NewDataLimiter(
-			c.limPersistor,
-			cfg.limiter,
-			schema.NewConverter(
-				schema.Config{
-					Monitor:     device.NewMonitor(),
-					Persistor:   broker.NewPersistor(c.msgPath, c.fs, cfg.persistor),
-					App:         exec, // schema.ExitSignalApp
-					Username:    c.username,
-					UserVersion: c.userVersion,
-					AppID:       c.appID,
-					MacHash:     c.macHash,
-					Encoding:    schema.MsgPack,
-				},
-				server,
-				agent.NewDataPointServer(exec.DataPoints()),
-			),
-			broker.NewMessageLoader(c.msgPath, c.fs),
+	// Messages discarded by the persistor and the limiter are reported,
+	// so that the backend can tell them apart from those lost in transit.
+	gaps := message.NewGaps(message.DefaultGapPeriod, server.Done)
+	persistor := broker.NewPersistor(c.msgPath, c.fs, cfg.persistor)
+	persistor.Drops = gaps
+	var session *schema.Session
+	if !c.fullMetadata {
+		session = schema.NewSession()
+	}
+	flushed := newFlusher(server.Done)
+	data := []broker.MessageSource{
+		schema.NewConverter(
+			schema.Config{
+				Monitor:     device.NewMonitor(c.metrics),
+				Persistor:   persistor,
+				IP:          c.ip,
+				App:         exec, // schema.ExitSignalApp
+				Username:    c.username,
+				UserVersion: c.userVersion,
+				AppID:       c.appID,
+				MacHash:     c.macHash,
+				Encoding:    c.encoding,
+				Session:     session,
+				Sequences:   schema.NewSequences(c.seqPath, c.fs),
+				Clock:       schema.NewClock(device.ReadBoot(), c.clockJump),
+			},
+			sources...,
+		),
+		persistor.Load(),
+		flushed,
+	}
+	if c.batch.Window > 0 {
+		data = []broker.MessageSource{
+			schema.NewBatcher(c.batch, c.encoding, message.Merge(data...)),
+		}
+	}
+	// Compression precedes the limiter, so that compressed bytes are
+	// counted.
+	var compressor *schema.Compressor
+	if c.compression != schema.NoCompression {
+		compressor = schema.NewCompressor(c.compression, message.Merge(data...))
+		data = []broker.MessageSource{compressor}
+	}
+	limiter := message.NewDataLimiter(
+		c.limPersistor,
+		cfg.limiter,
+		gaps,
+		append(data,
+			c.warnings,
 			agent.NewPeriodicRequester(
 				exec.AgentData(),
 				server.Done,
 				cfg.requester,
 			),
-		),
+		)...,
 	)
+
+	// Heartbeats, gap reports, and command responses bypass the limiter,
+	// so that the device can be reached even when the data budget is
+	// spent.
+	out := []broker.MessageSource{
+		limiter,
+		message.NewHeartbeat(limiter, persistor.Len, cfg.heartbeat, server.Done),
+		gaps,
+	}
+	if cmds := c.commands(c.registry(exec, persistor, flushed, limiter, compressor), server.Done); cmds != nil {
+		out = append(out, cmds)
+	}
+	c.producer.Serve(message.Merge(out...))
 	return nil
 }
 
@@ -352,10 +825,37 @@ type dataLimiter interface {
 	DataLimit() (*backend.DataLimit, error)
 }
 
+// backendAPI consists of the backend services used while the app runs.
+type backendAPI interface {
+	dataLimiter
+	Release(string) error
+}
+
+// skipRelease is a backendAPI that considers every executable released.
+type skipRelease struct {
+	backendAPI
+}
+
+func (skipRelease) Release(checksum string) error {
+	log.Printf("skipping release check of %v", checksum)
+	return nil
+}
+
+// noBackend is a backendAPI for clients that do not use the backend.
+type noBackend struct{}
+
+func (noBackend) Release(string) error { return errNoBackend }
+
+// DataLimit returns no limit, since data limits come from the backend.
+func (noBackend) DataLimit() (*backend.DataLimit, error) { return nil, nil }
+
+var errNoBackend = errors.New("no backend")
+
 type configChans struct {
 	requester chan int
 	limiter   chan backend.CellularConfig
 	persistor chan *int64
+	heartbeat chan int
 }
 
 // pollConfig periodically polls the backend for data-limiting parameters and
@@ -365,6 +865,7 @@ func pollConfig(api dataLimiter) configChans {
 		requester: make(chan int, 1),
 		limiter:   make(chan backend.CellularConfig, 1),
 		persistor: make(chan *int64, 1),
+		heartbeat: make(chan int, 1),
 	}
 
 	go func() {
@@ -374,9 +875,13 @@ func pollConfig(api dataLimiter) configChans {
 				errorlog.Print(err)
 				return
 			}
+			if dl == nil {
+				return
+			}
 			c.persistor <- dl.Storage
 			c.requester <- dl.EmissionPeriod
 			c.limiter <- dl.Cellular
+			c.heartbeat <- dl.HeartbeatPeriod
 		}
 
 		poll()
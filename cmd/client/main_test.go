@@ -7,6 +7,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"os"
 	"strings"
 	"testing"
 
@@ -15,7 +17,11 @@ import (
 
 	backend "github.com/aukletio/Auklet-Client-C/api"
 	"github.com/aukletio/Auklet-Client-C/broker"
+	"github.com/aukletio/Auklet-Client-C/device"
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+	"github.com/aukletio/Auklet-Client-C/fsutil"
 	"github.com/aukletio/Auklet-Client-C/message"
+	"github.com/aukletio/Auklet-Client-C/profile"
 )
 
 type mockExec struct {
@@ -48,8 +54,10 @@ func (m *mockExec) Decoder() *json.Decoder {
 	}
 	return m.decoder
 }
-func (mockExec) ExitStatus() int { return 0 }
-func (mockExec) Signal() string  { return "signal" }
+func (mockExec) ExitStatus() int     { return 0 }
+func (mockExec) Signal() string      { return "signal" }
+func (mockExec) Usage() device.Usage { return device.Usage{} }
+func (mockExec) Pid() int            { return 0 }
 
 type mockAPI struct {
 	checksum  string
@@ -94,6 +102,7 @@ func TestClient(t *testing.T) {
 
 	c := client{
 		msgPath:      ".auklet/message",
+		seqPath:      ".auklet/sequences.json",
 		limPersistor: &message.MemPersistor{},
 		api: mockAPI{
 			checksum: "checksum",
@@ -128,6 +137,62 @@ func TestDumper(t *testing.T) {
 	}
 }
 
+func TestDumperArchive(t *testing.T) {
+	e := newMockExec()
+	fs := afero.NewMemMapFs()
+	d := dumper{archive: &profile.Archive{Dir: "profiles", Fs: fs}}
+	if err := d.run(e); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := afero.ReadDir(fs, "profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 {
+		t.Errorf("expected a profile in 3 forms, got %v files", len(infos))
+	}
+}
+
+func TestExportProfiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := exportProfiles(fs, "profiles", "noexist"); err == nil {
+		t.Error("expected error for missing executable")
+	}
+	if err := fsutil.WriteFile(fs.OpenFile, "profiles/1.json", []byte(`{"tree": {}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := exportProfiles(fs, "profiles", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("profiles/1.pb.gz"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	cases := []struct {
+		persisted string
+		legacy    bool
+		expect    string
+	}{
+		{persisted: "", legacy: true, expect: device.IfaceHash()},
+		{persisted: "kept\n", legacy: true, expect: "kept"},
+		{persisted: "kept\n", legacy: false, expect: "kept"},
+	}
+
+	for i, c := range cases {
+		fs := afero.NewMemMapFs()
+		if c.persisted != "" {
+			if err := fsutil.WriteFile(fs.OpenFile, "data/.auklet/device-id", []byte(c.persisted)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := identity(fs, func(string) string { return "" }, "data/", c.legacy).ID(); got != c.expect {
+			t.Errorf("case %v: expected %v, got %v", i, c.expect, got)
+		}
+	}
+}
+
 func TestSerial(t *testing.T) {
 	e := newMockExec()
 	addr := "serial-device"
@@ -161,3 +226,145 @@ func TestSerial(t *testing.T) {
 		}
 	}
 }
+
+func TestProvision(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	env := func(string) string { return "" }
+	if err := fsutil.WriteFile(fs.OpenFile, "bundle.json", []byte(`{"bundle":{}}`)); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path, key string
+	}{
+		{path: "noexist"},
+		{path: "bundle.json", key: "noexist"},
+		{path: "bundle.json"}, // incomplete bundle
+	}
+	for i, c := range cases {
+		if err := provision(fs, env, c.path, c.key); err == nil {
+			t.Errorf("case %v: expected error, got nil", i)
+		}
+	}
+	if _, err := fs.Stat(".auklet/provision.json"); err == nil {
+		t.Error("invalid bundle was imported")
+	}
+}
+
+func TestWriteSchemas(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := writeSchemas(fs, "schemas"); err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{"profile", "errorSig", "exit", "dataPoint", "session"} {
+		b, err := afero.ReadFile(fs, "schemas/"+kind+".json")
+		if err != nil {
+			t.Errorf("%v: %v", kind, err)
+			continue
+		}
+		var s map[string]interface{}
+		if err := json.Unmarshal(b, &s); err != nil || s["title"] != kind {
+			t.Errorf("%v: unexpected schema %s", kind, b)
+		}
+	}
+}
+
+func TestWithTransport(t *testing.T) {
+	own := broker.LocalBroker{URL: "tcp://mosquitto:1883"}
+	cases := []struct {
+		api       broker.Recoverer
+		transport broker.Transport
+		expect    string
+	}{
+		{api: own, transport: broker.Auto, expect: "tcp://mosquitto:1883"},
+		{api: own, transport: broker.TLS, expect: "tcp://mosquitto:1883"},
+		{api: own, transport: broker.WebSocket, expect: "wss://mosquitto:443/mqtt"},
+	}
+
+	for i, c := range cases {
+		api := withTransport(c.api, broker.TransportAPI{Recoverer: c.api, Transport: c.transport})
+		if got, err := api.BrokerAddress(); got != c.expect || err != nil {
+			t.Errorf("case %v: expected %v, got %v %v", i, c.expect, got, err)
+		}
+	}
+}
+
+func TestSkipRelease(t *testing.T) {
+	api := skipRelease{noBackend{}}
+	if err := api.Release("checksum"); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if dl, err := api.DataLimit(); dl != nil || err != nil {
+		t.Errorf("expected no limit, got %v %v", dl, err)
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	defer setLogLevel("info", os.Stderr, os.Stdout)
+	cases := []struct {
+		level      string
+		info, errs bool
+		ok         bool
+	}{
+		{level: "info", info: true, errs: true, ok: true},
+		{level: "errors", info: false, errs: true, ok: true},
+		{level: "none", info: false, errs: false, ok: true},
+		{level: "debug", ok: false},
+	}
+
+	for i, c := range cases {
+		var info, errs bytes.Buffer
+		err := setLogLevel(c.level, &info, &errs)
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("case %v: expected %v, got %v: %v", i, c.ok, ok, err)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		log.Print("info")
+		errorlog.Print("error")
+		if got := info.Len() > 0; got != c.info {
+			t.Errorf("case %v: expected info %v, got %v", i, c.info, got)
+		}
+		if got := errs.Len() > 0; got != c.errs {
+			t.Errorf("case %v: expected errors %v, got %v", i, c.errs, got)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	persistor := broker.NewPersistor("msgs", fs, nil)
+	for _, b := range []string{"sent", "failed"} {
+		m := broker.Message{Topic: broker.Log, Bytes: []byte(b)}
+		if err := persistor.CreateMessage(&m); err != nil {
+			t.Fatal(err)
+		}
+		if b == "failed" {
+			m.Release()
+		}
+	}
+	done := make(chan struct{})
+	flushed := newFlusher(done)
+	c := &client{fs: fs}
+	flush := c.registry(nil, persistor, flushed, nil, nil)["flush"]
+
+	result, err := flush(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := result.(map[string]int)["messages"]; n != 1 {
+		t.Errorf("expected 1 message flushed, got %v", n)
+	}
+	if m := <-flushed.Output(); string(m.Bytes) != "failed" {
+		t.Errorf("expected failed message, got %q", m.Bytes)
+	}
+
+	close(done)
+	if _, ok := <-flushed.Output(); ok {
+		t.Error("expected output closed")
+	}
+	if _, err := flush(nil, nil); err != errStopped {
+		t.Errorf("expected %v, got %v", errStopped, err)
+	}
+}
@@ -0,0 +1,247 @@
+// Package command executes commands sent to a device by the backend.
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/afero"
+
+	backend "github.com/aukletio/Auklet-Client-C/api"
+	"github.com/aukletio/Auklet-Client-C/broker"
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+	"github.com/aukletio/Auklet-Client-C/fsutil"
+)
+
+// Command is a request for the device to perform an action.
+type Command struct {
+	ID      string          `json:"id"`      // unique; a command is executed once
+	Name    string          `json:"name"`    // selects a Handler
+	Device  string          `json:"device"`  // identifier of the device to execute it
+	Expires int64           `json:"expires"` // ms since epoch, after which it is rejected
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// maxLifetime is how far in the future a command may expire. It bounds the
+// commands kept in a History.
+const maxLifetime = 24 * time.Hour
+
+// now is declared as a variable so that tests can set the time.
+var now = time.Now
+
+// nowMs returns the current time in ms since epoch.
+func nowMs() int64 { return now().UnixNano() / 1e6 }
+
+// signed is the wire format of a Command. Signature is the base64-encoded
+// ASN.1 ECDSA signature of the SHA-256 hash of the exact bytes of the command
+// field, as they appear in the message.
+type signed struct {
+	Command   json.RawMessage `json:"command"`
+	Signature string          `json:"signature"`
+}
+
+// Handler executes a command with the given arguments, and returns a result
+// to be included in the response. Messages passed to send are published
+// before the response.
+type Handler func(args json.RawMessage, send func(broker.Message)) (interface{}, error)
+
+// Registry maps command names to their handlers.
+type Registry map[string]Handler
+
+// Response reports the outcome of a Command.
+type Response struct {
+	ID        string      `json:"id,omitempty"`
+	Name      string      `json:"name,omitempty"`
+	Status    string      `json:"status"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Timestamp int64       `json:"timestamp"` // ms since epoch
+}
+
+// OK, Failed, Duplicate, Rejected, and Unknown are Response statuses.
+// Rejected commands are malformed or fail authentication. Duplicate commands
+// have already been executed.
+const (
+	OK        = "ok"
+	Failed    = "error"
+	Duplicate = "duplicate"
+	Rejected  = "rejected"
+	Unknown   = "unknown"
+)
+
+// History records the IDs of executed commands in a file, so that a command
+// redelivered by the broker, even after a restart, is not executed again.
+// An ID is kept until its command expires, after which the command is
+// rejected anyway.
+type History struct {
+	Path    string
+	Fs      afero.Fs
+	entries []entry
+}
+
+type entry struct {
+	ID      string `json:"id"`
+	Expires int64  `json:"expires"` // ms since epoch
+}
+
+func (h *History) load() {
+	b, err := afero.ReadFile(h.Fs, h.Path)
+	if err != nil {
+		return // no commands executed yet
+	}
+	if err := json.Unmarshal(b, &h.entries); err != nil {
+		errorlog.Printf("History.load: %v", err)
+	}
+}
+
+// seen reports whether id has been recorded.
+func (h *History) seen(id string) bool {
+	for _, e := range h.entries {
+		if e.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// add records the ID of c, forgetting those of expired commands.
+func (h *History) add(c Command) {
+	t := nowMs()
+	kept := h.entries[:0]
+	for _, e := range h.entries {
+		if e.Expires >= t {
+			kept = append(kept, e)
+		}
+	}
+	h.entries = append(kept, entry{ID: c.ID, Expires: c.Expires})
+	b, _ := json.Marshal(h.entries)
+	if err := fsutil.WriteFile(h.Fs.OpenFile, h.Path, b); err != nil {
+		errorlog.Printf("History.add: %v", err)
+	}
+}
+
+// Dispatcher executes commands received as messages, and outputs a response
+// to each on the Response topic.
+type Dispatcher struct {
+	registry Registry
+	key      []byte // PEM-encoded ECDSA public key
+	device   string
+	history  *History
+	in       <-chan broker.Message
+	out      chan broker.Message
+	done     <-chan struct{}
+}
+
+// NewDispatcher returns a Dispatcher that executes commands from in with the
+// handlers in registry. Only unexpired commands for device, signed with the
+// private key corresponding to the PEM-encoded public key, are executed. It
+// stops when done is closed.
+func NewDispatcher(registry Registry, key []byte, device string, history *History, in <-chan broker.Message, done <-chan struct{}) *Dispatcher {
+	d := &Dispatcher{
+		registry: registry,
+		key:      key,
+		device:   device,
+		history:  history,
+		in:       in,
+		out:      make(chan broker.Message),
+		done:     done,
+	}
+	go d.serve()
+	return d
+}
+
+// Output returns d's output stream.
+func (d *Dispatcher) Output() <-chan broker.Message { return d.out }
+
+func (d *Dispatcher) serve() {
+	defer close(d.out)
+	d.history.load()
+	for {
+		select {
+		case <-d.done:
+			return
+		case m := <-d.in:
+			d.send(d.handle(m.Bytes))
+		}
+	}
+}
+
+func (d *Dispatcher) send(m broker.Message) {
+	select {
+	case d.out <- m:
+	case <-d.done:
+	}
+}
+
+var (
+	errNoID    = errors.New("command lacks an id")
+	errDevice  = errors.New("command is for another device")
+	errExpired = errors.New("command has expired")
+	errLife    = fmt.Errorf("command expires more than %v ahead", maxLifetime)
+)
+
+// handle executes the command in data, and returns its response.
+func (d *Dispatcher) handle(data []byte) broker.Message {
+	c, err := d.parse(data)
+	if err != nil {
+		errorlog.Printf("Dispatcher.handle: %v", err)
+		return respond(Response{ID: c.ID, Name: c.Name, Status: Rejected, Error: err.Error()})
+	}
+	if d.history.seen(c.ID) {
+		log.Printf("command %v: already executed", c.ID)
+		return respond(Response{ID: c.ID, Name: c.Name, Status: Duplicate})
+	}
+	// The command is recorded before it is executed, so that a command
+	// that interrupts the client is not repeated.
+	d.history.add(c)
+
+	h, ok := d.registry[c.Name]
+	if !ok {
+		return respond(Response{ID: c.ID, Name: c.Name, Status: Unknown, Error: fmt.Sprintf("unknown command %q", c.Name)})
+	}
+	log.Printf("command %v: executing %v", c.ID, c.Name)
+	result, err := h(c.Args, d.send)
+	if err != nil {
+		errorlog.Printf("Dispatcher.handle: %v: %v", c.Name, err)
+		return respond(Response{ID: c.ID, Name: c.Name, Status: Failed, Error: err.Error()})
+	}
+	return respond(Response{ID: c.ID, Name: c.Name, Status: OK, Result: result})
+}
+
+// parse authenticates and decodes the command in data.
+func (d *Dispatcher) parse(data []byte) (Command, error) {
+	var (
+		s signed
+		c Command
+	)
+	if err := json.Unmarshal(data, &s); err != nil {
+		return c, fmt.Errorf("malformed command: %v", err)
+	}
+	if err := backend.Verify(s.Command, s.Signature, d.key); err != nil {
+		return c, fmt.Errorf("command: %v", err)
+	}
+	if err := json.Unmarshal(s.Command, &c); err != nil {
+		return c, fmt.Errorf("malformed command: %v", err)
+	}
+	t := nowMs()
+	switch {
+	case c.ID == "":
+		return c, errNoID
+	case c.Device != d.device:
+		return c, errDevice
+	case c.Expires < t:
+		return c, errExpired
+	case c.Expires > t+int64(maxLifetime/time.Millisecond):
+		return c, errLife
+	}
+	return c, nil
+}
+
+func respond(r Response) broker.Message {
+	r.Timestamp = time.Now().UnixNano() / 1e6
+	b, _ := json.Marshal(r)
+	return broker.Message{Topic: broker.Response, Bytes: b}
+}
@@ -0,0 +1,136 @@
+package command
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+)
+
+// testKey returns a new ECDSA key and its PEM-encoded public key.
+func testKey() (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// sign returns a command message holding c, signed with key.
+func sign(c Command, key *ecdsa.PrivateKey) broker.Message {
+	payload, _ := json.Marshal(c)
+	hash := sha256.Sum256(payload)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		panic(err)
+	}
+	der, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	b, _ := json.Marshal(signed{
+		Command:   payload,
+		Signature: base64.StdEncoding.EncodeToString(der),
+	})
+	return broker.Message{Topic: broker.Command, Bytes: b}
+}
+
+func TestDispatcher(t *testing.T) {
+	key, pub := testKey()
+	other, _ := testKey()
+	registry := Registry{
+		"echo": func(args json.RawMessage, send func(broker.Message)) (interface{}, error) {
+			send(broker.Message{Topic: broker.Log, Bytes: args})
+			return "done", nil
+		},
+		"fail": func(json.RawMessage, func(broker.Message)) (interface{}, error) {
+			return nil, errors.New("failed")
+		},
+	}
+
+	expires := nowMs() + 60000
+	cmd := func(id, name string) Command {
+		return Command{ID: id, Name: name, Device: "device", Expires: expires}
+	}
+	echo := cmd("1", "echo")
+	echo.Args = json.RawMessage(`"hi"`)
+	elsewhere, expired, distant := cmd("5", "echo"), cmd("6", "echo"), cmd("7", "echo")
+	elsewhere.Device = "other"
+	expired.Expires = nowMs() - 1
+	distant.Expires = nowMs() + 2*int64(maxLifetime/time.Millisecond)
+	cases := []struct {
+		msg    broker.Message
+		status string
+		sent   int // messages sent by the handler
+	}{
+		{msg: sign(echo, key), status: OK, sent: 1},
+		{msg: sign(cmd("1", "echo"), key), status: Duplicate},
+		{msg: sign(cmd("2", "echo"), other), status: Rejected},
+		{msg: sign(cmd("", "echo"), key), status: Rejected},
+		{msg: broker.Message{Bytes: []byte(`{"command":{}}`)}, status: Rejected},
+		{msg: sign(cmd("3", "fail"), key), status: Failed},
+		{msg: sign(cmd("4", "reboot"), key), status: Unknown},
+		{msg: sign(elsewhere, key), status: Rejected},
+		{msg: sign(expired, key), status: Rejected},
+		{msg: sign(distant, key), status: Rejected},
+	}
+
+	fs := afero.NewMemMapFs()
+	in := make(chan broker.Message)
+	done := make(chan struct{})
+	d := NewDispatcher(registry, pub, "device", &History{Path: "history", Fs: fs}, in, done)
+	for i, c := range cases {
+		in <- c.msg
+		for j := 0; j < c.sent; j++ {
+			if m := <-d.Output(); m.Topic != broker.Log {
+				t.Errorf("case %v: expected %v, got %v", i, broker.Log, m.Topic)
+			}
+		}
+		m := <-d.Output()
+		var r Response
+		if err := json.Unmarshal(m.Bytes, &r); err != nil {
+			t.Fatal(err)
+		}
+		if m.Topic != broker.Response || r.Status != c.status {
+			t.Errorf("case %v: expected %v, got %v %v: %v", i, c.status, m.Topic, r.Status, r.Error)
+		}
+	}
+	close(done)
+	for range d.Output() {
+	}
+
+	// A new Dispatcher remembers the commands executed by the last.
+	h := &History{Path: "history", Fs: fs}
+	h.load()
+	if !h.seen("1") || h.seen("2") {
+		t.Errorf("expected history of executed commands, got %v", h.entries)
+	}
+}
+
+func TestHistoryExpiry(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Unix(1000, 0) }
+
+	h := &History{Path: "history", Fs: afero.NewMemMapFs()}
+	h.add(Command{ID: "a", Expires: 1000000})
+	h.add(Command{ID: "b", Expires: 2000000})
+	now = func() time.Time { return time.Unix(1500, 0) }
+	h.add(Command{ID: "c", Expires: 2000000})
+	if h.seen("a") || !h.seen("b") || !h.seen("c") {
+		t.Errorf("expected only expired commands forgotten, got %v", h.entries)
+	}
+}
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestBaseURL(t *testing.T) {
@@ -39,3 +41,74 @@ func TestBaseURL(t *testing.T) {
 		}
 	}
 }
+
+func TestDisabledMetrics(t *testing.T) {
+	cases := []struct {
+		value  string
+		expect map[string]bool
+	}{
+		{value: "", expect: map[string]bool{}},
+		{value: "disk", expect: map[string]bool{"disk": true}},
+		{value: "thermal, power,", expect: map[string]bool{"thermal": true, "power": true}},
+	}
+
+	for i, c := range cases {
+		getenv := Getenv(func(string) string { return c.value })
+		if got := getenv.DisabledMetrics(); !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("case %v: expected %v, got %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestOption(t *testing.T) {
+	env := Getenv(func(string) string { return "env" })
+	cases := []struct {
+		getenv  Getenv
+		fromcli string
+		expect  string
+	}{
+		{getenv: env, fromcli: "cli", expect: "cli"},
+		{getenv: env, fromcli: "", expect: "env"},
+		{getenv: Getenv(func(string) string { return "" }), fromcli: "", expect: ""},
+	}
+
+	for i, c := range cases {
+		if got := c.getenv.ClientCert(c.fromcli); got != c.expect {
+			t.Errorf("case %v: expected %v, got %v", i, c.expect, got)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	env := func(v string) Getenv {
+		return func(string) string { return v }
+	}
+	cases := []struct {
+		getenv  Getenv
+		fromcli int
+		expect  int
+	}{
+		{getenv: env("7"), fromcli: 3, expect: 3},
+		{getenv: env("7"), fromcli: 0, expect: 7},
+		{getenv: env("seven"), fromcli: 0, expect: 0},
+		{getenv: env(""), fromcli: 0, expect: 0},
+	}
+
+	for i, c := range cases {
+		if got := c.getenv.BatchCount(c.fromcli); got != c.expect {
+			t.Errorf("case %v: expected %v, got %v", i, c.expect, got)
+		}
+	}
+	if got := env("5").ProfileLimit(0); got != 5 {
+		t.Errorf("expected 5, got %v", got)
+	}
+	if got := env("2s").BatchWindow(0); got != 2*time.Second {
+		t.Errorf("expected %v, got %v", 2*time.Second, got)
+	}
+	if got := env("48h").ClockJump(0); got != 48*time.Hour {
+		t.Errorf("expected %v, got %v", 48*time.Hour, got)
+	}
+	if got := env("two days").ClockJump(time.Hour); got != time.Hour {
+		t.Errorf("expected %v, got %v", time.Hour, got)
+	}
+}
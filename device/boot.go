@@ -0,0 +1,50 @@
+package device
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Boot identifies the device's current boot, and measures time since it
+// with the monotonic clock, which is unaffected when the wall clock is set.
+type Boot struct {
+	ID string // empty if unknown
+
+	up time.Duration // time since boot at at
+	at time.Time
+}
+
+// ReadBoot reads the boot ID and uptime from /proc. If they are unavailable,
+// the ID is empty, and time is measured from the call to ReadBoot.
+func ReadBoot() Boot {
+	return readBoot(pseudofs{fs: afero.NewOsFs(), root: "/proc"})
+}
+
+func readBoot(proc pseudofs) Boot {
+	b := Boot{at: time.Now()}
+	id, err := proc.read("sys", "kernel", "random", "boot_id")
+	if err != nil {
+		return b
+	}
+	// The first field of /proc/uptime is the uptime in seconds.
+	uptime, err := proc.read("uptime")
+	if err != nil {
+		return b
+	}
+	secs, err := strconv.ParseFloat(strings.Fields(uptime + " 0")[0], 64)
+	if err != nil {
+		return b
+	}
+	b.ID = id
+	b.up = time.Duration(secs * float64(time.Second))
+	return b
+}
+
+// Since returns the time since boot at t, which must carry a monotonic clock
+// reading, as returned by time.Now.
+func (b Boot) Since(t time.Time) time.Duration {
+	return b.up + t.Sub(b.at)
+}
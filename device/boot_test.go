@@ -0,0 +1,37 @@
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadBoot(t *testing.T) {
+	cases := []struct {
+		files  map[string]string
+		id     string
+		uptime time.Duration
+	}{
+		{
+			files: map[string]string{
+				"/proc/sys/kernel/random/boot_id": "4a7c3c8e-0b52-4bd6-a3a4-0c3e2ab7d0c1\n",
+				"/proc/uptime":                    "12.50 40.00\n",
+			},
+			id:     "4a7c3c8e-0b52-4bd6-a3a4-0c3e2ab7d0c1",
+			uptime: 12500 * time.Millisecond,
+		},
+		{
+			files: map[string]string{
+				"/proc/sys/kernel/random/boot_id": "4a7c3c8e-0b52-4bd6-a3a4-0c3e2ab7d0c1\n",
+				"/proc/uptime":                    "garbage\n",
+			},
+		},
+		{files: nil},
+	}
+
+	for i, c := range cases {
+		b := readBoot(fakeFs("/proc", c.files))
+		if b.ID != c.id || b.Since(b.at) != c.uptime {
+			t.Errorf("case %v: expected %q %v, got %q %v", i, c.id, c.uptime, b.ID, b.Since(b.at))
+		}
+	}
+}
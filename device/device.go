@@ -1,37 +1,23 @@
 // Package device provides access to hardware and system information.
 package device
 
-// TODO: Provide access to processor architecture.
-
 import (
 	"bytes"
 	"fmt"
 	snet "net"
 	"time"
 
-	"github.com/rdegges/go-ipify"
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/mem"
-	"github.com/shirou/gopsutil/net"
-
-	"github.com/aukletio/Auklet-Client-C/errorlog"
+	"github.com/spf13/afero"
 )
 
-// CurrentIP returns the device's current public IP address.
-func CurrentIP() (ip string) {
-	// Not covered in tests, because it depends on an external service.
-	ip, err := ipify.GetIp()
-	if err != nil {
-		errorlog.Print(err)
-	}
-	return
-}
-
-// IfaceHash generates a unique device identifier based on the MAC addresses of
+// IfaceHash generates a device identifier based on the MAC addresses of
 // hardware interfaces.
 //
-// I'm concerned that this isn't a good way to generate device identifiers.
-// Alternatives: use a file to store a generated UUID.
+// It is not a good identifier: collisions are easy, and it changes when an
+// interface is added or its address is randomized. It is used only to keep
+// the identifiers of devices registered before Identity existed.
 func IfaceHash() string {
 	// Not covered in tests, because it's unclear how to test for correctness.
 
@@ -49,39 +35,41 @@ func IfaceHash() string {
 	return fmt.Sprintf("%x", string(sum))
 }
 
-// Metrics represents overall system metrics.
+// Metrics represents overall system metrics. Fields that are pointers or
+// slices are provided only if their source is enabled and available.
 type Metrics struct {
 	CPUPercent float64 `json:"cpuUsage"`
 	MemPercent float64 `json:"memoryUsage"`
 	rates
+
+	Disk    *DiskUsage    `json:"diskUsage,omitempty"`
+	Load    *LoadAverage  `json:"loadAverage,omitempty"`
+	Thermal []ThermalZone `json:"thermalZones,omitempty"`
+	Uptime  *uint64       `json:"uptime,omitempty"` // seconds
+	Power   []PowerSupply `json:"powerSupplies,omitempty"`
+	CPU     *CPUInfo      `json:"cpuInfo,omitempty"`
+
+	Interfaces       []Interface `json:"networkInterfaces,omitempty"`
+	DefaultInterface string      `json:"defaultInterface,omitempty"`
 }
 
-// rates contains the number of bytes per second of network traffic over all
-// interfaces.
+// rates contains the number of bytes per second of network traffic.
 type rates struct {
 	In  uint64 `json:"inboundNetwork"`
 	Out uint64 `json:"outboundNetwork"`
 }
 
-func diff(cur, prev rates) rates {
-	return rates{
-		In:  cur.In - prev.In,
-		Out: cur.Out - prev.Out,
-	}
-}
-
-// serve generates a stream of network I/O rate values. The values sent on
-// the stream are updated once per second; consuming at a higher rate than this
-// will not increase resolution.
+// serve generates a stream of per-interface network statistics. The values
+// sent on the stream are updated once per second; consuming at a higher rate
+// than this will not increase resolution.
 func (mon Monitor) serve() {
 	defer close(mon.ioRates)
-	var prev, cur rates
+	var prev, cur counters
 	update := func() {
-		stats, err := net.IOCounters(false)
-		if err == nil && len(stats) == 1 {
-			stat := stats[0]
+		c, err := readCounters()
+		if err == nil {
 			prev = cur
-			cur = rates{In: stat.BytesRecv, Out: stat.BytesSent}
+			cur = c
 		}
 	}
 	update()
@@ -93,23 +81,33 @@ func (mon Monitor) serve() {
 			return
 		case <-tick.C:
 			update()
-		case mon.ioRates <- diff(cur, prev):
+		case mon.ioRates <- interfaces(cur, prev):
 		}
 	}
 }
 
 // Monitor provides a source of Metrics.
 type Monitor struct {
-	ioRates chan rates
+	ioRates chan []Interface
 	done    chan struct{}
+	cfg     Config
+	sys     pseudofs
+	proc    pseudofs
+	cpu     *CPUInfo // static, so read once
 }
 
-// NewMonitor returns a new Monitor.
-func NewMonitor() Monitor {
+// NewMonitor returns a new Monitor that reads the sources enabled in cfg.
+func NewMonitor(cfg Config) Monitor {
 	cpu.Percent(0, false)
 	m := Monitor{
-		ioRates: make(chan rates),
+		ioRates: make(chan []Interface),
 		done:    make(chan struct{}),
+		cfg:     cfg,
+		sys:     pseudofs{fs: afero.NewOsFs(), root: "/sys"},
+		proc:    pseudofs{fs: afero.NewOsFs(), root: "/proc"},
+	}
+	if cfg.CPUInfo {
+		m.cpu = cpuInfo()
 	}
 	go m.serve()
 	return m
@@ -119,11 +117,34 @@ func NewMonitor() Monitor {
 func (mon Monitor) GetMetrics() Metrics {
 	c, _ := cpu.Percent(0, false)
 	m, _ := mem.VirtualMemory()
-	return Metrics{
-		rates:      <-mon.ioRates,
+	ifaces := <-mon.ioRates
+	metrics := Metrics{
+		rates:      total(ifaces),
 		CPUPercent: c[0],
 		MemPercent: m.UsedPercent,
+		CPU:        mon.cpu,
+	}
+	if mon.cfg.Disk {
+		metrics.Disk = diskUsage(mon.cfg.DataDir)
+	}
+	if mon.cfg.Load {
+		metrics.Load = loadAverage()
+	}
+	if mon.cfg.Thermal {
+		metrics.Thermal = mon.sys.thermalZones()
+	}
+	if mon.cfg.Uptime {
+		metrics.Uptime = uptime()
+	}
+	if mon.cfg.Power {
+		metrics.Power = mon.sys.powerSupplies()
+	}
+	if mon.cfg.Network {
+		annotate(ifaces, mon.sys, mon.proc)
+		metrics.Interfaces = ifaces
+		metrics.DefaultInterface = mon.proc.defaultInterface()
 	}
+	return metrics
 }
 
 // Close shuts down the Monitor.
@@ -8,7 +8,7 @@ import (
 // This test covers the Monitor implementation,
 // but does not check for correctness.
 func TestMonitor(t *testing.T) {
-	m := NewMonitor()
+	m := NewMonitor(NewConfig(".", nil))
 	time.Sleep(2 * time.Second)
 	m.GetMetrics()
 	m.Close()
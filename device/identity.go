@@ -0,0 +1,92 @@
+package device
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"github.com/spf13/afero"
+
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+	"github.com/aukletio/Auklet-Client-C/fsutil"
+)
+
+// seedNamespace is the UUID namespace of identifiers derived from a seed
+// file. Hashing the seed keeps values such as /etc/machine-id private.
+var seedNamespace = uuid.NewV5(uuid.NamespaceURL, "https://auklet.io/device")
+
+// Identity provides a stable device identifier. The identifier is generated
+// once and persisted, so that it survives changes to network hardware.
+type Identity struct {
+	// Path is where the identifier is persisted.
+	Path string
+
+	// Seed is an optional file, such as /etc/machine-id or a provisioning
+	// file, from which the identifier is derived. If empty or unreadable,
+	// a random identifier is generated.
+	Seed string
+
+	// Legacy indicates that the device was registered with the backend
+	// using IfaceHash. Its identifier is kept, so that existing
+	// credentials stay valid.
+	Legacy bool
+
+	Fs afero.Fs
+}
+
+// ID returns the device identifier, generating and persisting it if
+// necessary.
+func (i Identity) ID() string {
+	if b, err := afero.ReadFile(i.Fs, i.Path); err == nil {
+		if id := strings.TrimSpace(string(b)); id != "" {
+			return id
+		}
+	}
+
+	id, how := i.generate()
+	log.Printf("device: generated identifier %v from %v", id, how)
+	if err := i.Fs.MkdirAll(filepath.Dir(i.Path), 0777); err != nil {
+		errorlog.Printf("Identity.ID: %v", err)
+	}
+	if err := fsutil.WriteFile(i.Fs.OpenFile, i.Path, []byte(id+"\n")); err != nil {
+		// The identifier will change on the next run.
+		errorlog.Printf("Identity.ID: could not persist identifier: %v", err)
+	}
+	return id
+}
+
+// generate returns a new identifier and a description of its origin.
+func (i Identity) generate() (id, how string) {
+	if i.Legacy {
+		return IfaceHash(), "MAC addresses"
+	}
+	if i.Seed != "" {
+		b, err := afero.ReadFile(i.Fs, i.Seed)
+		if seed := strings.TrimSpace(string(b)); err == nil && seed != "" {
+			return uuid.NewV5(seedNamespace, seed).String(), i.Seed
+		}
+		errorlog.Printf("Identity.generate: unusable seed file %v: %v", i.Seed, err)
+	}
+	return uuid.NewV4().String(), "random source"
+}
+
+// Rotate replaces the persisted identifier with a new, random one, so that
+// the device can register with the backend again. It returns the new
+// identifier, and a function that restores the previous one.
+func (i Identity) Rotate() (id string, restore func() error, err error) {
+	old, readErr := afero.ReadFile(i.Fs, i.Path)
+	id = uuid.NewV4().String()
+	if err := fsutil.WriteFile(i.Fs.OpenFile, i.Path, []byte(id+"\n")); err != nil {
+		return "", nil, fmt.Errorf("could not persist new identifier: %v", err)
+	}
+	log.Printf("device: rotated identifier to %v", id)
+	restore = func() error {
+		if readErr != nil {
+			return i.Fs.Remove(i.Path)
+		}
+		return fsutil.WriteFile(i.Fs.OpenFile, i.Path, old)
+	}
+	return id, restore, nil
+}
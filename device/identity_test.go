@@ -0,0 +1,95 @@
+package device
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestIdentity(t *testing.T) {
+	withFiles := func(files map[string]string) afero.Fs {
+		fs := afero.NewMemMapFs()
+		for path, content := range files {
+			if err := afero.WriteFile(fs, path, []byte(content), 0666); err != nil {
+				panic(err)
+			}
+		}
+		return fs
+	}
+
+	seeded := Identity{Path: ".auklet/device-id", Seed: "/etc/machine-id"}
+	cases := []struct {
+		id     Identity
+		fs     afero.Fs
+		expect string // empty if the identifier is random
+	}{
+		{
+			// persisted identifier wins
+			id: Identity{Path: ".auklet/device-id", Legacy: true},
+			fs: withFiles(map[string]string{
+				".auklet/device-id": "persisted\n",
+			}),
+			expect: "persisted",
+		},
+		{
+			// derived from seed; this value must never change
+			id: seeded,
+			fs: withFiles(map[string]string{
+				"/etc/machine-id": "0123456789abcdef\n",
+			}),
+			expect: "91379b41-d1ba-559e-9c83-59089d720521",
+		},
+		{
+			// legacy devices keep their MAC hash
+			id:     Identity{Path: ".auklet/device-id", Legacy: true},
+			fs:     afero.NewMemMapFs(),
+			expect: IfaceHash(),
+		},
+		{
+			// missing seed falls back to random
+			id: seeded,
+			fs: afero.NewMemMapFs(),
+		},
+	}
+
+	for i, c := range cases {
+		c.id.Fs = c.fs
+		got := c.id.ID()
+		if c.expect != "" && got != c.expect {
+			t.Errorf("case %v: expected %v, got %v", i, c.expect, got)
+		}
+		if got == "" {
+			t.Errorf("case %v: empty identifier", i)
+		}
+		// The identifier is stable across runs.
+		if again := c.id.ID(); again != got {
+			t.Errorf("case %v: identifier changed from %v to %v", i, got, again)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	for i, persisted := range []string{"persisted\n", ""} {
+		fs := afero.NewMemMapFs()
+		if persisted != "" {
+			if err := afero.WriteFile(fs, "device-id", []byte(persisted), 0666); err != nil {
+				panic(err)
+			}
+		}
+		id := Identity{Path: "device-id", Legacy: true, Fs: fs}
+		rotated, restore, err := id.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := id.ID(); got != rotated || got == "persisted" || got == IfaceHash() {
+			t.Errorf("case %v: expected %v, got %v", i, rotated, got)
+		}
+		if err := restore(); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := afero.ReadFile(fs, "device-id")
+		if string(b) != persisted {
+			t.Errorf("case %v: expected %q restored, got %q", i, persisted, b)
+		}
+	}
+}
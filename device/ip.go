@@ -0,0 +1,108 @@
+package device
+
+import (
+	"time"
+
+	"github.com/rdegges/go-ipify"
+
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+)
+
+// These parameters control how often an IPCache refreshes its address.
+const (
+	IPTTL        = time.Hour        // how long a known address is trusted
+	ipMinBackoff = 30 * time.Second // first retry delay after a failure
+)
+
+// IPCache provides the device's public IP address. It refreshes the address
+// in the background, so that callers never block on the network.
+type IPCache struct {
+	ttl    time.Duration
+	lookup func() (string, error)
+	out    chan string
+	done   chan struct{}
+}
+
+type lookupResult struct {
+	ip  string
+	err error
+}
+
+// NewIPCache returns an IPCache that refreshes its address every ttl. Until
+// the first lookup succeeds, the address is empty.
+func NewIPCache(ttl time.Duration) *IPCache {
+	// Lookups are not covered in tests, because they depend on an
+	// external service.
+	c := newIPCache(ttl, ipify.GetIp)
+	go c.serve()
+	return c
+}
+
+func newIPCache(ttl time.Duration, lookup func() (string, error)) *IPCache {
+	return &IPCache{
+		ttl:    ttl,
+		lookup: lookup,
+		out:    make(chan string),
+		done:   make(chan struct{}),
+	}
+}
+
+// backoff returns the delay before retrying a failed lookup, given the delay
+// before the previous retry, or zero if the previous lookup succeeded.
+func (c *IPCache) backoff(prev time.Duration) time.Duration {
+	next := 2 * prev
+	if next < ipMinBackoff {
+		next = ipMinBackoff
+	}
+	if next > c.ttl {
+		next = c.ttl
+	}
+	return next
+}
+
+// serve serializes access to the cached address. Lookups run in their own
+// goroutine so that readers are not blocked by a slow network.
+func (c *IPCache) serve() {
+	var (
+		ip      string
+		retry   time.Duration // zero unless the last lookup failed
+		results = make(chan lookupResult, 1)
+		timer   = time.NewTimer(0)
+	)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-timer.C:
+			go func() {
+				ip, err := c.lookup()
+				results <- lookupResult{ip, err}
+			}()
+		case r := <-results:
+			if r.err != nil {
+				errorlog.Printf("IPCache: %v", r.err)
+				retry = c.backoff(retry)
+				timer.Reset(retry)
+				continue
+			}
+			ip = r.ip
+			retry = 0
+			timer.Reset(c.ttl)
+		case c.out <- ip:
+		}
+	}
+}
+
+// IP returns the most recently known public IP address.
+func (c *IPCache) IP() string {
+	select {
+	case ip := <-c.out:
+		return ip
+	case <-c.done:
+		return ""
+	}
+}
+
+// Close stops refreshing the address.
+func (c *IPCache) Close() { close(c.done) }
@@ -0,0 +1,55 @@
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	c := newIPCache(5*time.Minute, nil)
+	cases := []struct {
+		prev, expect time.Duration
+	}{
+		{prev: 0, expect: ipMinBackoff},
+		{prev: ipMinBackoff, expect: 2 * ipMinBackoff},
+		{prev: 4 * time.Minute, expect: 5 * time.Minute},
+	}
+	for i, cas := range cases {
+		if got := c.backoff(cas.prev); got != cas.expect {
+			t.Errorf("case %v: expected %v, got %v", i, cas.expect, got)
+		}
+	}
+}
+
+func TestIPCache(t *testing.T) {
+	lookups := make(chan error, 1)
+	c := newIPCache(time.Hour, func() (string, error) {
+		return "1.2.3.4", <-lookups
+	})
+	go c.serve()
+	defer c.Close()
+
+	// Reads do not block while a lookup is pending, and the address is
+	// empty until a lookup succeeds.
+	if ip := c.IP(); ip != "" {
+		t.Errorf("expected empty address, got %q", ip)
+	}
+
+	lookups <- nil
+	timeout := time.After(time.Second)
+	for c.IP() != "1.2.3.4" {
+		select {
+		case <-timeout:
+			t.Fatal("address was not updated")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestIPCacheClosed(t *testing.T) {
+	c := newIPCache(time.Hour, func() (string, error) { return "1.2.3.4", nil })
+	c.Close()
+	if ip := c.IP(); ip != "" {
+		t.Errorf("expected empty address from closed cache, got %q", ip)
+	}
+}
@@ -0,0 +1,155 @@
+package device
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/net"
+)
+
+// Interface represents statistics of a single network interface.
+type Interface struct {
+	Name string `json:"name"`
+	rates
+
+	// Error and drop counts are totals since the interface came up.
+	ErrIn   uint64 `json:"inboundErrors"`
+	ErrOut  uint64 `json:"outboundErrors"`
+	DropIn  uint64 `json:"inboundDrops"`
+	DropOut uint64 `json:"outboundDrops"`
+
+	State    string    `json:"state,omitempty"` // up, down, dormant, etc.
+	Wireless *Wireless `json:"wireless,omitempty"`
+}
+
+// Wireless represents the link quality of a wireless interface, as reported
+// by /proc/net/wireless.
+type Wireless struct {
+	Link  float64 `json:"linkQuality"`
+	Level float64 `json:"signalLevel"` // dBm
+	Noise float64 `json:"noiseLevel"`  // dBm
+}
+
+// counters holds cumulative network counters by interface name.
+type counters map[string]net.IOCountersStat
+
+func readCounters() (counters, error) {
+	stats, err := net.IOCounters(true)
+	if err != nil {
+		return nil, err
+	}
+	c := make(counters, len(stats))
+	for _, stat := range stats {
+		c[stat.Name] = stat
+	}
+	return c, nil
+}
+
+// delta returns the difference between two cumulative counters. A counter
+// that went backwards, such as when an interface is reset, yields zero.
+func delta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return 0
+	}
+	return cur - prev
+}
+
+// interfaces computes per-interface rates from two consecutive snapshots of
+// counters taken one second apart. The result is sorted by name.
+func interfaces(cur, prev counters) []Interface {
+	ifaces := make([]Interface, 0, len(cur))
+	for name, c := range cur {
+		i := Interface{
+			Name:    name,
+			ErrIn:   c.Errin,
+			ErrOut:  c.Errout,
+			DropIn:  c.Dropin,
+			DropOut: c.Dropout,
+		}
+		if p, ok := prev[name]; ok {
+			i.In = delta(c.BytesRecv, p.BytesRecv)
+			i.Out = delta(c.BytesSent, p.BytesSent)
+		}
+		ifaces = append(ifaces, i)
+	}
+	sort.Slice(ifaces, func(a, b int) bool { return ifaces[a].Name < ifaces[b].Name })
+	return ifaces
+}
+
+// total sums the rates of all interfaces.
+func total(ifaces []Interface) rates {
+	var r rates
+	for _, i := range ifaces {
+		r.In += i.In
+		r.Out += i.Out
+	}
+	return r
+}
+
+// wireless parses /proc/net/wireless. See wireless.h for the format.
+func (s pseudofs) wireless() map[string]*Wireless {
+	text, err := s.read("net", "wireless")
+	if err != nil {
+		return nil
+	}
+	w := make(map[string]*Wireless)
+	for _, line := range strings.Split(text, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			// header line
+			continue
+		}
+		f := strings.Fields(kv[1])
+		if len(f) < 4 {
+			continue
+		}
+		// f[0] is the status; link, level and noise follow. Values
+		// that were updated since the last read end with a period.
+		parse := func(s string) float64 {
+			v, _ := strconv.ParseFloat(strings.TrimSuffix(s, "."), 64)
+			return v
+		}
+		w[strings.TrimSpace(kv[0])] = &Wireless{
+			Link:  parse(f[1]),
+			Level: parse(f[2]),
+			Noise: parse(f[3]),
+		}
+	}
+	return w
+}
+
+// defaultInterface returns the name of the interface holding the default
+// route with the lowest metric, as reported by /proc/net/route.
+func (s pseudofs) defaultInterface() string {
+	text, err := s.read("net", "route")
+	if err != nil {
+		return ""
+	}
+	name := ""
+	best := -1
+	for _, line := range strings.Split(text, "\n")[1:] {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		f := strings.Fields(line)
+		if len(f) < 8 || f[1] != "00000000" || f[7] != "00000000" {
+			continue
+		}
+		metric, err := strconv.Atoi(f[6])
+		if err != nil {
+			continue
+		}
+		if best < 0 || metric < best {
+			name, best = f[0], metric
+		}
+	}
+	return name
+}
+
+// annotate adds link state and wireless link quality to ifaces.
+func annotate(ifaces []Interface, sys, proc pseudofs) {
+	w := proc.wireless()
+	for i := range ifaces {
+		ifaces[i].State, _ = sys.read("class", "net", ifaces[i].Name, "operstate")
+		ifaces[i].Wireless = w[ifaces[i].Name]
+	}
+}
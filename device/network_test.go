@@ -0,0 +1,84 @@
+package device
+
+import (
+	"testing"
+)
+
+func TestInterfaces(t *testing.T) {
+	prev := counters{
+		"eth0":  {Name: "eth0", BytesRecv: 100, BytesSent: 50},
+		"wwan0": {Name: "wwan0", BytesRecv: 1000, BytesSent: 1000},
+	}
+	cur := counters{
+		"eth0":  {Name: "eth0", BytesRecv: 300, BytesSent: 60, Errin: 1, Dropout: 2},
+		"wwan0": {Name: "wwan0", BytesRecv: 10, BytesSent: 1010}, // reset
+		"usb0":  {Name: "usb0", BytesRecv: 500},                  // new
+	}
+	ifaces := interfaces(cur, prev)
+	want := []Interface{
+		{Name: "eth0", rates: rates{In: 200, Out: 10}, ErrIn: 1, DropOut: 2},
+		{Name: "usb0"},
+		{Name: "wwan0", rates: rates{In: 0, Out: 10}},
+	}
+	if len(ifaces) != len(want) {
+		t.Fatalf("expected %+v, got %+v", want, ifaces)
+	}
+	for i := range want {
+		if ifaces[i] != want[i] {
+			t.Errorf("case %v: expected %+v, got %+v", i, want[i], ifaces[i])
+		}
+	}
+	if r := total(ifaces); r != (rates{In: 200, Out: 20}) {
+		t.Errorf("unexpected total %+v", r)
+	}
+}
+
+func TestWireless(t *testing.T) {
+	proc := fakeFs("/proc", map[string]string{
+		"/proc/net/wireless": `Inter-| sta-|   Quality        |   Discarded packets               | Missed | WE
+ face | tus | link level noise |  nwid  crypt   frag  retry   misc | beacon | 22
+ wlan0: 0000   54.  -56.  -256        0      0      0      0      0        0
+`,
+	})
+	w := proc.wireless()
+	if got := w["wlan0"]; got == nil || *got != (Wireless{Link: 54, Level: -56, Noise: -256}) {
+		t.Errorf("unexpected wireless stats %+v", got)
+	}
+
+	if w := fakeFs("/proc", nil).wireless(); w != nil {
+		t.Errorf("expected no wireless stats, got %+v", w)
+	}
+}
+
+func TestDefaultInterface(t *testing.T) {
+	proc := fakeFs("/proc", map[string]string{
+		"/proc/net/route": `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+wwan0	00000000	0101A8C0	0003	0	0	700	00000000	0	0	0
+eth0	0001A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+`,
+	})
+	if name := proc.defaultInterface(); name != "eth0" {
+		t.Errorf("expected eth0, got %q", name)
+	}
+	if name := fakeFs("/proc", nil).defaultInterface(); name != "" {
+		t.Errorf("expected no default interface, got %q", name)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	sys := fakeFs("/sys", map[string]string{
+		"/sys/class/net/wlan0/operstate": "up\n",
+	})
+	proc := fakeFs("/proc", map[string]string{
+		"/proc/net/wireless": "Inter-| sta-|\n face | tus |\n wlan0: 0000 70. -40. -256\n",
+	})
+	ifaces := []Interface{{Name: "wlan0"}, {Name: "eth0"}}
+	annotate(ifaces, sys, proc)
+	if ifaces[0].State != "up" || ifaces[0].Wireless == nil {
+		t.Errorf("unexpected interface %+v", ifaces[0])
+	}
+	if ifaces[1].State != "" || ifaces[1].Wireless != nil {
+		t.Errorf("unexpected interface %+v", ifaces[1])
+	}
+}
@@ -0,0 +1,260 @@
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/aukletio/Auklet-Client-C/agent"
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+)
+
+// clockTicks is the number of clock ticks per second, as reported by
+// sysconf(_SC_CLK_TCK). It is 100 on all architectures we support.
+const clockTicks = 100
+
+// ProcessMetrics represents resource usage of a single process.
+type ProcessMetrics struct {
+	PID        int     `json:"pid"`
+	Name       string  `json:"name"`
+	RSS        int64   `json:"rss"` // kilobytes
+	CPUPercent float64 `json:"cpuUsage"`
+	Threads    int     `json:"threads"`
+	FDs        int     `json:"openFiles"`
+	ReadBytes  int64   `json:"readBytes"`
+	WriteBytes int64   `json:"writeBytes"`
+}
+
+// dataPoint has the format of data points generated by an agent.
+type dataPoint struct {
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload"`
+}
+
+// procStat holds the fields of /proc/<pid>/stat that we care about.
+type procStat struct {
+	name  string
+	ppid  int
+	ticks int64 // user plus system time
+}
+
+// ProcessSampler periodically samples the metrics of a process and its
+// descendants, and emits them as data points.
+type ProcessSampler struct {
+	fs     afero.Fs
+	proc   string // mount point of procfs
+	pid    int    // root of the process tree
+	period time.Duration
+	out    chan agent.Message
+	done   <-chan struct{} // cancellation requests
+
+	prevTicks map[int]int64
+	prevTime  time.Time
+}
+
+// NewProcessSampler returns a ProcessSampler for the process tree rooted at
+// pid. When done closes, the sampler closes its output and terminates.
+func NewProcessSampler(pid int, period time.Duration, done <-chan struct{}) *ProcessSampler {
+	s := newProcessSampler(afero.NewOsFs(), "/proc", pid, period, done)
+	go s.serve()
+	return s
+}
+
+func newProcessSampler(fs afero.Fs, proc string, pid int, period time.Duration, done <-chan struct{}) *ProcessSampler {
+	return &ProcessSampler{
+		fs:        fs,
+		proc:      proc,
+		pid:       pid,
+		period:    period,
+		out:       make(chan agent.Message),
+		done:      done,
+		prevTicks: make(map[int]int64),
+	}
+}
+
+// Output returns s's output stream.
+func (s *ProcessSampler) Output() <-chan agent.Message {
+	return s.out
+}
+
+func (s *ProcessSampler) serve() {
+	defer close(s.out)
+	tick := time.NewTicker(s.period)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-tick.C:
+			msg, err := s.sample(now)
+			if err != nil {
+				errorlog.Printf("ProcessSampler.serve: %v", err)
+				continue
+			}
+			select {
+			case s.out <- msg:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// sample collects metrics of the process tree and encodes them as a data
+// point message.
+func (s *ProcessSampler) sample(now time.Time) (agent.Message, error) {
+	pids, err := s.tree()
+	if err != nil {
+		return agent.Message{}, err
+	}
+	elapsed := now.Sub(s.prevTime).Seconds()
+	ticks := make(map[int]int64, len(pids))
+	procs := []ProcessMetrics{}
+	for _, pid := range pids {
+		m, t, err := s.process(pid)
+		if err != nil {
+			// The process may have exited since we listed it.
+			continue
+		}
+		if prev, ok := s.prevTicks[pid]; ok && elapsed > 0 {
+			m.CPUPercent = 100 * float64(t-prev) / clockTicks / elapsed
+		}
+		ticks[pid] = t
+		procs = append(procs, m)
+	}
+	s.prevTicks = ticks
+	s.prevTime = now
+
+	data, err := json.Marshal(dataPoint{
+		Type: "processMetrics",
+		Payload: struct {
+			Processes []ProcessMetrics `json:"processes"`
+		}{procs},
+	})
+	if err != nil {
+		return agent.Message{}, err
+	}
+	return agent.Message{Type: "datapoint", Data: data}, nil
+}
+
+// tree returns the pids of s's root process and all of its descendants.
+func (s *ProcessSampler) tree() ([]int, error) {
+	d, err := s.fs.Open(s.proc)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(0)
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[int][]int)
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		st, err := s.stat(pid)
+		if err != nil {
+			continue
+		}
+		children[st.ppid] = append(children[st.ppid], pid)
+	}
+
+	pids := []int{s.pid}
+	for i := 0; i < len(pids); i++ {
+		pids = append(pids, children[pids[i]]...)
+	}
+	return pids, nil
+}
+
+// process reads the metrics of a single process. It also returns the total
+// CPU time consumed by the process, in clock ticks.
+func (s *ProcessSampler) process(pid int) (ProcessMetrics, int64, error) {
+	st, err := s.stat(pid)
+	if err != nil {
+		return ProcessMetrics{}, 0, err
+	}
+	m := ProcessMetrics{PID: pid, Name: st.name}
+
+	status, err := s.fields(pid, "status")
+	if err != nil {
+		return ProcessMetrics{}, 0, err
+	}
+	m.RSS = parseInt(strings.TrimSuffix(status["VmRSS"], " kB"))
+	m.Threads = int(parseInt(status["Threads"]))
+
+	// io may be unreadable depending on ptrace restrictions; report zero
+	// rather than dropping the process.
+	if io, err := s.fields(pid, "io"); err == nil {
+		m.ReadBytes = parseInt(io["read_bytes"])
+		m.WriteBytes = parseInt(io["write_bytes"])
+	}
+
+	if d, err := s.fs.Open(s.path(pid, "fd")); err == nil {
+		fds, _ := d.Readdirnames(0)
+		d.Close()
+		m.FDs = len(fds)
+	}
+	return m, st.ticks, nil
+}
+
+func (s *ProcessSampler) path(pid int, file string) string {
+	return fmt.Sprintf("%v/%v/%v", s.proc, pid, file)
+}
+
+// stat parses /proc/<pid>/stat. See man 5 proc for the format.
+func (s *ProcessSampler) stat(pid int) (procStat, error) {
+	b, err := afero.ReadFile(s.fs, s.path(pid, "stat"))
+	if err != nil {
+		return procStat{}, err
+	}
+	// The command name is in parentheses and may itself contain spaces
+	// or parentheses, so we split around the last closing parenthesis.
+	open := bytes.IndexByte(b, '(')
+	end := bytes.LastIndexByte(b, ')')
+	if open < 0 || end < open {
+		return procStat{}, fmt.Errorf("stat: malformed %v", s.path(pid, "stat"))
+	}
+	// Fields following the name, starting with field 3 (state).
+	f := strings.Fields(string(b[end+1:]))
+	if len(f) < 13 {
+		return procStat{}, fmt.Errorf("stat: short %v", s.path(pid, "stat"))
+	}
+	return procStat{
+		name:  string(b[open+1 : end]),
+		ppid:  int(parseInt(f[1])),
+		ticks: parseInt(f[11]) + parseInt(f[12]), // utime + stime
+	}, nil
+}
+
+// fields parses a file of "key: value" lines, such as /proc/<pid>/status.
+func (s *ProcessSampler) fields(pid int, file string) (map[string]string, error) {
+	f, err := s.fs.Open(s.path(pid, file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := make(map[string]string)
+	line := bufio.NewScanner(f)
+	for line.Scan() {
+		kv := strings.SplitN(line.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		m[kv[0]] = strings.TrimSpace(kv[1])
+	}
+	return m, line.Err()
+}
+
+func parseInt(s string) int64 {
+	n, _ := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	return n
+}
@@ -0,0 +1,118 @@
+package device
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// procFs returns a fake procfs containing a process tree of 1 -> 2 -> 3,
+// plus an unrelated process 4.
+func procFs() afero.Fs {
+	fs := afero.NewMemMapFs()
+	files := map[string]string{
+		"/proc/1/stat":   "1 (app) S 0 0 0 0 0 0 0 0 0 0 100 50",
+		"/proc/1/status": "Name:\tapp\nVmRSS:\t   1024 kB\nThreads:\t4\n",
+		"/proc/1/io":     "read_bytes: 10\nwrite_bytes: 20\n",
+		"/proc/1/fd/0":   "",
+		"/proc/1/fd/1":   "",
+		"/proc/2/stat":   "2 (a (b) c) S 1 0 0 0 0 0 0 0 0 0 10 10",
+		"/proc/2/status": "VmRSS:\t512 kB\nThreads:\t1\n",
+		"/proc/3/stat":   "3 (child) S 2 0 0 0 0 0 0 0 0 0 0 0",
+		"/proc/3/status": "VmRSS:\t256 kB\nThreads:\t1\n",
+		"/proc/4/stat":   "4 (other) S 0 0 0 0 0 0 0 0 0 0 0 0",
+		"/proc/4/status": "VmRSS:\t128 kB\nThreads:\t1\n",
+		"/proc/self":     "",
+	}
+	for path, content := range files {
+		if err := afero.WriteFile(fs, path, []byte(content), 0666); err != nil {
+			panic(err)
+		}
+	}
+	return fs
+}
+
+func TestProcessTree(t *testing.T) {
+	s := newProcessSampler(procFs(), "/proc", 1, time.Second, nil)
+	pids, err := s.tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pids) != 3 || pids[0] != 1 || pids[1] != 2 || pids[2] != 3 {
+		t.Errorf("expected [1 2 3], got %v", pids)
+	}
+}
+
+func TestProcessStat(t *testing.T) {
+	s := newProcessSampler(procFs(), "/proc", 1, time.Second, nil)
+	st, err := s.stat(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.name != "a (b) c" || st.ppid != 1 || st.ticks != 20 {
+		t.Errorf("unexpected stat %+v", st)
+	}
+	if _, err := s.stat(5); err == nil {
+		t.Error("expected error for missing process")
+	}
+}
+
+func TestProcessSample(t *testing.T) {
+	fs := procFs()
+	s := newProcessSampler(fs, "/proc", 1, time.Second, nil)
+	start := time.Now()
+	if _, err := s.sample(start); err != nil {
+		t.Fatal(err)
+	}
+
+	// 100 more ticks over 2 seconds is 50% of one CPU.
+	stat := "1 (app) S 0 0 0 0 0 0 0 0 0 0 150 100"
+	if err := afero.WriteFile(fs, "/proc/1/stat", []byte(stat), 0666); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := s.sample(start.Add(2 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "datapoint" {
+		t.Errorf("expected datapoint, got %v", msg.Type)
+	}
+
+	var dp struct {
+		Type    string `json:"type"`
+		Payload struct {
+			Processes []ProcessMetrics `json:"processes"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(msg.Data, &dp); err != nil {
+		t.Fatal(err)
+	}
+	procs := dp.Payload.Processes
+	if len(procs) != 3 {
+		t.Fatalf("expected 3 processes, got %+v", procs)
+	}
+	want := ProcessMetrics{
+		PID:        1,
+		Name:       "app",
+		RSS:        1024,
+		CPUPercent: 50,
+		Threads:    4,
+		FDs:        2,
+		ReadBytes:  10,
+		WriteBytes: 20,
+	}
+	if procs[0] != want {
+		t.Errorf("expected %+v, got %+v", want, procs[0])
+	}
+}
+
+func TestProcessSamplerDone(t *testing.T) {
+	done := make(chan struct{})
+	s := NewProcessSampler(1, time.Hour, done)
+	close(done)
+	if _, open := <-s.Output(); open {
+		t.Fail()
+	}
+}
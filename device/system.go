@@ -0,0 +1,201 @@
+package device
+
+import (
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/host"
+	"github.com/shirou/gopsutil/load"
+	"github.com/spf13/afero"
+)
+
+// Config selects which optional sources of system metrics a Monitor reads.
+// CPU and memory usage and network rates are always provided.
+type Config struct {
+	// DataDir is the directory whose filesystem usage is reported.
+	DataDir string
+
+	Disk    bool
+	Load    bool
+	Thermal bool
+	Uptime  bool
+	Power   bool
+	CPUInfo bool
+	Network bool // per-interface statistics
+}
+
+// Sources lists the names of the optional metric sources.
+var Sources = []string{"disk", "load", "thermal", "uptime", "power", "cpu", "network"}
+
+// NewConfig returns a Config for dataDir in which every source is enabled,
+// except for those named in disabled.
+func NewConfig(dataDir string, disabled map[string]bool) Config {
+	return Config{
+		DataDir: dataDir,
+		Disk:    !disabled["disk"],
+		Load:    !disabled["load"],
+		Thermal: !disabled["thermal"],
+		Uptime:  !disabled["uptime"],
+		Power:   !disabled["power"],
+		CPUInfo: !disabled["cpu"],
+		Network: !disabled["network"],
+	}
+}
+
+// DiskUsage represents usage of the filesystem holding the data directory.
+type DiskUsage struct {
+	Path        string  `json:"path"`
+	Total       uint64  `json:"total"` // bytes
+	Free        uint64  `json:"free"`  // bytes
+	UsedPercent float64 `json:"usedPercent"`
+}
+
+// LoadAverage represents the system load averages.
+type LoadAverage struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+}
+
+// ThermalZone represents a temperature sensor.
+type ThermalZone struct {
+	Type        string  `json:"type"`
+	Temperature float64 `json:"temperature"` // degrees Celsius
+}
+
+// PowerSupply represents a battery or external power source.
+type PowerSupply struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"` // Battery, Mains, USB, etc.
+	Status   string `json:"status,omitempty"`
+	Capacity *int   `json:"capacity,omitempty"` // percent
+	Online   *bool  `json:"online,omitempty"`
+}
+
+// CPUInfo describes the processor.
+type CPUInfo struct {
+	Arch  string `json:"architecture"`
+	Model string `json:"model"`
+	Cores int    `json:"cores"`
+}
+
+func diskUsage(dir string) *DiskUsage {
+	u, err := disk.Usage(dir)
+	if err != nil {
+		return nil
+	}
+	return &DiskUsage{
+		Path:        dir,
+		Total:       u.Total,
+		Free:        u.Free,
+		UsedPercent: u.UsedPercent,
+	}
+}
+
+func loadAverage() *LoadAverage {
+	l, err := load.Avg()
+	if err != nil {
+		return nil
+	}
+	return &LoadAverage{Load1: l.Load1, Load5: l.Load5, Load15: l.Load15}
+}
+
+func uptime() *uint64 {
+	u, err := host.Uptime()
+	if err != nil {
+		return nil
+	}
+	return &u
+}
+
+func cpuInfo() *CPUInfo {
+	c := &CPUInfo{
+		Arch:  runtime.GOARCH,
+		Cores: runtime.NumCPU(),
+	}
+	if info, err := cpu.Info(); err == nil && len(info) > 0 {
+		c.Model = info[0].ModelName
+	}
+	return c
+}
+
+// pseudofs reads device information from a pseudo-filesystem, such as sysfs
+// or procfs.
+type pseudofs struct {
+	fs   afero.Fs
+	root string // mount point
+}
+
+// read returns the trimmed contents of the file at the given path, relative
+// to the root of s.
+func (s pseudofs) read(path ...string) (string, error) {
+	b, err := afero.ReadFile(s.fs, filepath.Join(append([]string{s.root}, path...)...))
+	return strings.TrimSpace(string(b)), err
+}
+
+// list returns the sorted names of entries in the directory at the given
+// path, relative to the root of s.
+func (s pseudofs) list(path ...string) []string {
+	d, err := s.fs.Open(filepath.Join(append([]string{s.root}, path...)...))
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	names, _ := d.Readdirnames(0)
+	sort.Strings(names)
+	return names
+}
+
+// thermalZones reads temperatures from /sys/class/thermal.
+func (s pseudofs) thermalZones() []ThermalZone {
+	var zones []ThermalZone
+	for _, name := range s.list("class", "thermal") {
+		if !strings.HasPrefix(name, "thermal_zone") {
+			// cooling devices share the directory
+			continue
+		}
+		temp, err := s.read("class", "thermal", name, "temp")
+		if err != nil {
+			continue
+		}
+		milli, err := strconv.Atoi(temp)
+		if err != nil {
+			continue
+		}
+		typ, _ := s.read("class", "thermal", name, "type")
+		zones = append(zones, ThermalZone{
+			Type:        typ,
+			Temperature: float64(milli) / 1000,
+		})
+	}
+	return zones
+}
+
+// powerSupplies reads battery and power status from /sys/class/power_supply.
+func (s pseudofs) powerSupplies() []PowerSupply {
+	var supplies []PowerSupply
+	for _, name := range s.list("class", "power_supply") {
+		typ, err := s.read("class", "power_supply", name, "type")
+		if err != nil {
+			continue
+		}
+		p := PowerSupply{Name: name, Type: typ}
+		p.Status, _ = s.read("class", "power_supply", name, "status")
+		if v, err := s.read("class", "power_supply", name, "capacity"); err == nil {
+			if n, err := strconv.Atoi(v); err == nil {
+				p.Capacity = &n
+			}
+		}
+		if v, err := s.read("class", "power_supply", name, "online"); err == nil {
+			online := v == "1"
+			p.Online = &online
+		}
+		supplies = append(supplies, p)
+	}
+	return supplies
+}
@@ -0,0 +1,66 @@
+package device
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func fakeFs(root string, files map[string]string) pseudofs {
+	fs := afero.NewMemMapFs()
+	for path, content := range files {
+		if err := afero.WriteFile(fs, path, []byte(content), 0666); err != nil {
+			panic(err)
+		}
+	}
+	return pseudofs{fs: fs, root: root}
+}
+
+func TestThermalZones(t *testing.T) {
+	s := fakeFs("/sys", map[string]string{
+		"/sys/class/thermal/thermal_zone0/type":   "cpu-thermal\n",
+		"/sys/class/thermal/thermal_zone0/temp":   "45312\n",
+		"/sys/class/thermal/thermal_zone1/type":   "broken\n",
+		"/sys/class/thermal/thermal_zone1/temp":   "unknown\n",
+		"/sys/class/thermal/cooling_device0/type": "fan\n",
+	})
+	zones := s.thermalZones()
+	if len(zones) != 1 {
+		t.Fatalf("expected 1 zone, got %+v", zones)
+	}
+	if zones[0].Type != "cpu-thermal" || zones[0].Temperature != 45.312 {
+		t.Errorf("unexpected zone %+v", zones[0])
+	}
+
+	if zones := fakeFs("/sys", nil).thermalZones(); zones != nil {
+		t.Errorf("expected no zones, got %+v", zones)
+	}
+}
+
+func TestPowerSupplies(t *testing.T) {
+	s := fakeFs("/sys", map[string]string{
+		"/sys/class/power_supply/AC/type":       "Mains\n",
+		"/sys/class/power_supply/AC/online":     "1\n",
+		"/sys/class/power_supply/BAT0/type":     "Battery\n",
+		"/sys/class/power_supply/BAT0/status":   "Discharging\n",
+		"/sys/class/power_supply/BAT0/capacity": "87\n",
+	})
+	supplies := s.powerSupplies()
+	if len(supplies) != 2 {
+		t.Fatalf("expected 2 supplies, got %+v", supplies)
+	}
+	ac, bat := supplies[0], supplies[1]
+	if ac.Name != "AC" || ac.Online == nil || !*ac.Online || ac.Capacity != nil {
+		t.Errorf("unexpected supply %+v", ac)
+	}
+	if bat.Status != "Discharging" || bat.Capacity == nil || *bat.Capacity != 87 || bat.Online != nil {
+		t.Errorf("unexpected supply %+v", bat)
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	cfg := NewConfig("dir", map[string]bool{"thermal": true})
+	if cfg.Thermal || !cfg.Disk || !cfg.Power || cfg.DataDir != "dir" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+}
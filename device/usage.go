@@ -0,0 +1,18 @@
+package device
+
+// Usage represents the resources consumed by a process over its lifetime.
+type Usage struct {
+	MaxRSS     int64 `json:"maxRSS"`     // kilobytes
+	UserTime   int64 `json:"userTime"`   // milliseconds
+	SystemTime int64 `json:"systemTime"` // milliseconds
+	Runtime    int64 `json:"runtime"`    // wall-clock milliseconds since start
+
+	MinorFaults int64 `json:"minorPageFaults"`
+	MajorFaults int64 `json:"majorPageFaults"`
+
+	VoluntarySwitches   int64 `json:"voluntaryContextSwitches"`
+	InvoluntarySwitches int64 `json:"involuntaryContextSwitches"`
+
+	BlockIn  int64 `json:"blockInputOps"`
+	BlockOut int64 `json:"blockOutputOps"`
+}
@@ -11,7 +11,13 @@ type OpenFileFunc func(string, int, os.FileMode) (afero.File, error)
 
 // WriteFile opens or creates the file at path and writes b to it.
 func WriteFile(openFile OpenFileFunc, path string, b []byte) error {
-	f, err := openFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	return WriteFileMode(openFile, path, b, 0666)
+}
+
+// WriteFileMode is like WriteFile, but creates the file with permissions
+// perm.
+func WriteFileMode(openFile OpenFileFunc, path string, b []byte, perm os.FileMode) error {
+	f, err := openFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return err
 	}
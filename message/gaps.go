@@ -0,0 +1,150 @@
+package message
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+)
+
+// DefaultGapPeriod is how often Gaps publishes its reports.
+const DefaultGapPeriod = time.Minute
+
+// Gaps collects the sequence numbers of messages discarded by the client, and
+// periodically publishes them as gap reports on the Log topic. A gap in a
+// topic's sequence that no report accounts for was lost in transit.
+type Gaps struct {
+	drops   chan drop
+	out     chan broker.Message
+	period  time.Duration
+	done    <-chan struct{}
+	stopped chan struct{}
+}
+
+// drop is a discarded message.
+type drop struct {
+	reason string
+	topic  broker.Topic
+	seq    uint64
+}
+
+// gapKey identifies the drops published in one report.
+type gapKey struct {
+	reason string
+	topic  broker.Topic
+}
+
+// gapReport is the payload of a gap report. Each range holds the first and
+// last sequence numbers of consecutive discarded messages.
+type gapReport struct {
+	Type      string       `json:"type"`
+	Reason    string       `json:"reason"`
+	Topic     broker.Topic `json:"topic"`
+	Ranges    [][2]uint64  `json:"ranges"`
+	Timestamp int64        `json:"timestamp"` // ms since epoch
+}
+
+// NewGaps returns a Gaps that publishes reports every period. It stops when
+// done is closed, after publishing any drops not yet reported.
+func NewGaps(period time.Duration, done <-chan struct{}) *Gaps {
+	g := &Gaps{
+		drops:   make(chan drop),
+		out:     make(chan broker.Message),
+		period:  period,
+		done:    done,
+		stopped: make(chan struct{}),
+	}
+	go g.serve()
+	return g
+}
+
+// Output returns g's output stream.
+func (g *Gaps) Output() <-chan broker.Message { return g.out }
+
+// Drop records that m, and any messages it stands for, were discarded for
+// reason. Messages without a sequence number are ignored.
+func (g *Gaps) Drop(reason string, m broker.Message) {
+	for _, p := range m.Parts() {
+		if p.Sequence == 0 {
+			continue
+		}
+		select {
+		case g.drops <- drop{reason: reason, topic: p.Topic, seq: p.Sequence}:
+		case <-g.stopped:
+			return
+		}
+	}
+}
+
+func (g *Gaps) serve() {
+	defer close(g.out)
+	ticker := time.NewTicker(g.period)
+	defer ticker.Stop()
+	pending := make(map[gapKey][][2]uint64)
+	for {
+		select {
+		case d := <-g.drops:
+			k := gapKey{d.reason, d.topic}
+			pending[k] = extend(pending[k], d.seq)
+		case <-ticker.C:
+			g.publish(pending)
+			pending = make(map[gapKey][][2]uint64)
+		case <-g.done:
+			close(g.stopped)
+			g.publish(pending)
+			return
+		}
+	}
+}
+
+// extend adds seq to ranges.
+func extend(ranges [][2]uint64, seq uint64) [][2]uint64 {
+	if n := len(ranges); n > 0 && ranges[n-1][1]+1 == seq {
+		ranges[n-1][1] = seq
+		return ranges
+	}
+	return append(ranges, [2]uint64{seq, seq})
+}
+
+// coalesce sorts ranges and merges those that overlap or adjoin.
+func coalesce(ranges [][2]uint64) [][2]uint64 {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] > last[1]+1 {
+			merged = append(merged, r)
+			continue
+		}
+		if r[1] > last[1] {
+			last[1] = r[1]
+		}
+	}
+	return merged
+}
+
+// publish sends a report for each key in pending.
+func (g *Gaps) publish(pending map[gapKey][][2]uint64) {
+	keys := make([]gapKey, 0, len(pending))
+	for k := range pending {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].topic != keys[j].topic {
+			return keys[i].topic < keys[j].topic
+		}
+		return keys[i].reason < keys[j].reason
+	})
+	now := time.Now().UnixNano() / 1e6
+	for _, k := range keys {
+		b, _ := json.Marshal(gapReport{
+			Type:      "gap",
+			Reason:    k.reason,
+			Topic:     k.topic,
+			Ranges:    coalesce(pending[k]),
+			Timestamp: now,
+		})
+		g.out <- broker.Message{Topic: broker.Log, Bytes: b}
+	}
+}
@@ -0,0 +1,92 @@
+package message
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+)
+
+func numbered(topic broker.Topic, seqs ...uint64) []broker.Message {
+	m := make([]broker.Message, len(seqs))
+	for i, s := range seqs {
+		m[i] = broker.Message{Topic: topic, Sequence: s}
+	}
+	return m
+}
+
+func TestGaps(t *testing.T) {
+	done := make(chan struct{})
+	g := NewGaps(time.Hour, done)
+	for _, m := range numbered(broker.DataPoint, 4, 5, 9, 1, 2, 3) {
+		g.Drop("budget", m)
+	}
+	g.Drop("budget", broker.Join(broker.Batch, nil, numbered(broker.Profile, 6, 7)))
+	g.Drop("storage", numbered(broker.DataPoint, 10)[0])
+	g.Drop("budget", broker.Message{Topic: broker.Log}) // not numbered
+	close(done)
+
+	expect := []gapReport{
+		{Type: "gap", Reason: "budget", Topic: broker.DataPoint, Ranges: [][2]uint64{{1, 5}, {9, 9}}},
+		{Type: "gap", Reason: "storage", Topic: broker.DataPoint, Ranges: [][2]uint64{{10, 10}}},
+		{Type: "gap", Reason: "budget", Topic: broker.Profile, Ranges: [][2]uint64{{6, 7}}},
+	}
+	var got []gapReport
+	for m := range g.Output() {
+		if m.Topic != broker.Log {
+			t.Errorf("expected topic %v, got %v", broker.Log, m.Topic)
+		}
+		var r gapReport
+		if err := json.Unmarshal(m.Bytes, &r); err != nil {
+			t.Fatal(err)
+		}
+		r.Timestamp = 0
+		got = append(got, r)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %+v, got %+v", expect, got)
+	}
+
+	// Drops after g stops are ignored.
+	g.Drop("budget", numbered(broker.DataPoint, 11)[0])
+}
+
+func TestLimiterDrops(t *testing.T) {
+	in := make(chan broker.Message)
+	done := make(chan struct{})
+	g := NewGaps(time.Hour, done)
+	l := &DataLimiter{in: in, periodTimer: new(time.Timer), drops: g}
+	go func() { in <- numbered(broker.Event, 3)[0] }()
+	l.overBudget()
+	close(done)
+
+	m := <-g.Output()
+	var r gapReport
+	if err := json.Unmarshal(m.Bytes, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Topic != broker.Event || r.Reason != "budget" || !reflect.DeepEqual(r.Ranges, [][2]uint64{{3, 3}}) {
+		t.Errorf("expected budget gap of event 3, got %+v", r)
+	}
+}
+
+func TestLimiterDropsRemove(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	p := broker.NewPersistor("msgs", fs, nil)
+	m := numbered(broker.Event, 3)[0]
+	if err := p.CreateMessage(&m); err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan broker.Message)
+	l := &DataLimiter{in: in, periodTimer: new(time.Timer)}
+	go func() { in <- m }()
+	l.overBudget()
+
+	if files, _ := afero.ReadDir(fs, "msgs"); len(files) != 0 {
+		t.Errorf("expected dropped message to be removed, got %v files", len(files))
+	}
+}
@@ -0,0 +1,93 @@
+package message
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+	"github.com/aukletio/Auklet-Client-C/version"
+)
+
+// DefaultHeartbeat is the heartbeat period used until the backend provides
+// one.
+const DefaultHeartbeat = 5 * time.Minute
+
+// Heartbeat periodically reports the client's health on the Presence topic,
+// so that a quiet app can be told apart from an offline device.
+type Heartbeat struct {
+	out    chan broker.Message
+	period <-chan int // seconds
+	done   <-chan struct{}
+	start  time.Time
+
+	limiter interface{ Usage() Usage }
+	queue   func() int // number of unsent messages
+}
+
+// NewHeartbeat returns a Heartbeat reporting the usage of limiter and the
+// depth of queue. Its period is updated by values, in seconds, received on
+// period; non-positive values restore DefaultHeartbeat. It stops when done is
+// closed.
+func NewHeartbeat(limiter interface{ Usage() Usage }, queue func() int, period <-chan int, done <-chan struct{}) *Heartbeat {
+	h := &Heartbeat{
+		out:     make(chan broker.Message),
+		period:  period,
+		done:    done,
+		start:   time.Now(),
+		limiter: limiter,
+		queue:   queue,
+	}
+	go h.serve()
+	return h
+}
+
+// Output returns h's output stream.
+func (h *Heartbeat) Output() <-chan broker.Message { return h.out }
+
+func (h *Heartbeat) serve() {
+	defer close(h.out)
+	ticker := time.NewTicker(DefaultHeartbeat)
+	defer func() { ticker.Stop() }()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			select {
+			case h.out <- h.message():
+			case <-h.done:
+				return
+			}
+		case secs := <-h.period:
+			d := DefaultHeartbeat
+			if secs > 0 {
+				d = time.Duration(secs) * time.Second
+			}
+			ticker.Stop()
+			ticker = time.NewTicker(d)
+		}
+	}
+}
+
+// heartbeat is the payload of a Heartbeat message.
+type heartbeat struct {
+	Status        string `json:"status"`
+	Timestamp     int64  `json:"timestamp"` // ms since epoch
+	Uptime        int64  `json:"uptime"`    // seconds
+	QueueDepth    int    `json:"queueDepth"`
+	DataUsage     Usage  `json:"dataUsage"`
+	ClientVersion string `json:"clientVersion"`
+}
+
+func (h *Heartbeat) message() broker.Message {
+	now := time.Now()
+	b, _ := json.Marshal(heartbeat{
+		Status:        "online",
+		Timestamp:     now.UnixNano() / 1e6,
+		Uptime:        int64(now.Sub(h.start) / time.Second),
+		QueueDepth:    h.queue(),
+		DataUsage:     h.limiter.Usage(),
+		ClientVersion: version.Version,
+	})
+	return broker.Message{Topic: broker.Presence, Bytes: b}
+}
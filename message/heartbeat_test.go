@@ -0,0 +1,35 @@
+package message
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+)
+
+type fixedUsage Usage
+
+func (u fixedUsage) Usage() Usage { return Usage(u) }
+
+func TestHeartbeat(t *testing.T) {
+	period := make(chan int)
+	done := make(chan struct{})
+	h := NewHeartbeat(fixedUsage{Count: 7}, func() int { return 3 }, period, done)
+	period <- 1
+
+	m := <-h.Output()
+	if m.Topic != broker.Presence {
+		t.Errorf("expected topic %v, got %v", broker.Presence, m.Topic)
+	}
+	var b heartbeat
+	if err := json.Unmarshal(m.Bytes, &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Status != "online" || b.QueueDepth != 3 || b.DataUsage.Count != 7 {
+		t.Errorf("unexpected heartbeat %+v", b)
+	}
+
+	close(done)
+	for range h.Output() {
+	}
+}
@@ -18,6 +18,7 @@ type DataLimiter struct {
 	// conf is a channel by which the configuration can be updated.
 	conf  <-chan api.CellularConfig
 	store Persistor
+	drops broker.DropRecorder // may be nil
 
 	// Budget is how many bytes can be transmitted per period.
 	// If HasBudget is false, any number of bytes can be transmitted.
@@ -33,13 +34,46 @@ type DataLimiter struct {
 
 	// initialized in the initial state
 	periodTimer *time.Timer
+
+	// usage serves requests for Usage; done is closed when l terminates.
+	usage chan Usage
+	done  chan struct{}
+}
+
+// Usage describes how much of its budget a DataLimiter has used.
+type Usage struct {
+	Count     int       `json:"count"`            // bytes sent this period
+	Budget    *int      `json:"budget,omitempty"` // bytes per period
+	PeriodEnd time.Time `json:"periodEnd"`
+}
+
+// Usage returns the current usage of l. After l terminates, it returns the
+// zero value.
+func (l *DataLimiter) Usage() Usage {
+	select {
+	case u := <-l.usage:
+		return u
+	case <-l.done:
+		return Usage{}
+	}
+}
+
+func (l *DataLimiter) currentUsage() Usage {
+	u := Usage{Count: l.Count, PeriodEnd: l.PeriodEnd}
+	if l.HasBudget {
+		budget := l.Budget
+		u.Budget = &budget
+	}
+	return u
 }
 
 // NewDataLimiter returns a DataLimiter for input whose state persists on
-// the filesystem.
+// the filesystem. Messages dropped for lack of budget are recorded by drops,
+// if not nil.
 func NewDataLimiter(
 	store Persistor,
 	conf <-chan api.CellularConfig,
+	drops broker.DropRecorder,
 	src ...broker.MessageSource,
 ) *DataLimiter {
 	l := &DataLimiter{
@@ -47,6 +81,9 @@ func NewDataLimiter(
 		out:   make(chan broker.Message),
 		conf:  conf,
 		store: store,
+		drops: drops,
+		usage: make(chan Usage),
+		done:  make(chan struct{}),
 	}
 	l.store.Load(l)
 	// If Load fails, there is no budget, so all messages will be sent.
@@ -157,14 +194,23 @@ func (l *DataLimiter) underBudget() state {
 		return l.handleMessage(m)
 	case conf := <-l.conf:
 		return l.apply(conf)
+	case l.usage <- l.currentUsage():
+		return underBudget
 	}
 }
 
+// exempt reports whether m is sent regardless of the budget. Session records
+// are: every later message of their session refers to them.
+func exempt(m broker.Message) bool {
+	return m.Topic == broker.Session
+}
+
 func (l *DataLimiter) handleMessage(m broker.Message) state {
 	n := len(m.Bytes)
-	if l.HasBudget {
+	if l.HasBudget && !exempt(m) {
 		if n+l.Count > l.Budget {
 			// m would put us over budget. We begin dropping messages.
+			l.drop(m)
 			return overBudget
 		} else if n+l.Count > 9*l.Budget/10 {
 			// m would put us over 90% of the budget, but not over 100%.
@@ -174,7 +220,7 @@ func (l *DataLimiter) handleMessage(m broker.Message) state {
 			return overBudget
 		}
 	}
-	// m does not put us over 90% of budget.
+	// m does not put us over 90% of budget, or is exempt.
 	l.out <- m
 	if l.increment(n) != nil {
 		// We had a problem persisting the counter. To be safe, we
@@ -183,6 +229,9 @@ func (l *DataLimiter) handleMessage(m broker.Message) state {
 			return overBudget
 		}
 	}
+	if l.HasBudget && l.Count > 9*l.Budget/10 {
+		return overBudget
+	}
 	return underBudget
 }
 
@@ -194,14 +243,31 @@ func (l *DataLimiter) overBudget() state {
 	case <-l.periodTimer.C:
 		l.startThisPeriod()
 		return initial
-	case _, open := <-l.in:
+	case m, open := <-l.in:
 		if !open {
 			return cleanup
 		}
+		if exempt(m) {
+			l.out <- m
+			l.increment(len(m.Bytes))
+			return overBudget
+		}
+		l.drop(m)
 		return overBudget
 	case conf := <-l.conf:
 		return l.apply(conf)
+	case l.usage <- l.currentUsage():
+		return overBudget
+	}
+}
+
+// drop discards m, and records that it was.
+func (l *DataLimiter) drop(m broker.Message) {
+	if l.drops != nil {
+		l.drops.Drop("budget", m)
 	}
+	// As reported, m is not sent on a later run either.
+	m.Remove()
 }
 
 // apply applies the configuration and returns the initial state.
@@ -221,6 +287,9 @@ func (l *DataLimiter) apply(conf api.CellularConfig) state {
 // down.
 func (l *DataLimiter) cleanup() state {
 	close(l.out)
+	if l.done != nil {
+		close(l.done)
+	}
 	return terminal
 }
 
@@ -178,6 +178,7 @@ func TestHandleMessage(t *testing.T) {
 		l      *DataLimiter
 		m      broker.Message
 		expect state
+		sent   bool
 	}{
 		{
 			l:      &DataLimiter{Budget: 10, HasBudget: true},
@@ -211,12 +212,27 @@ func TestHandleMessage(t *testing.T) {
 			},
 			expect: underBudget,
 		},
+		{
+			// session records are sent over budget
+			l: &DataLimiter{
+				Budget:    10,
+				HasBudget: true,
+				out:       make(chan broker.Message, 1),
+				store:     new(MemPersistor),
+			},
+			m:      broker.Message{Topic: broker.Session, Bytes: make([]byte, 100)},
+			expect: overBudget,
+			sent:   true,
+		},
 	}
 
 	for i, c := range cases {
 		if got := c.l.handleMessage(c.m); got != c.expect {
 			t.Errorf("case %v: expected %v, got %v", i, c.expect, got)
 		}
+		if c.sent && len(c.l.out) != 1 {
+			t.Errorf("case %v: expected message sent", i)
+		}
 	}
 }
 
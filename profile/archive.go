@@ -0,0 +1,191 @@
+package profile
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/aukletio/Auklet-Client-C/fsutil"
+)
+
+// DefaultArchiveLimit is the number of profiles an Archive keeps by default.
+const DefaultArchiveLimit = 1000
+
+// extensions are those of the files in which an Archive keeps a profile.
+var extensions = []string{".json", ".pb.gz", ".folded"}
+
+// Archive keeps profiles in a directory, in files named by their time in
+// Unix milliseconds: as received, in <time>.json; in the pprof format, in
+// <time>.pb.gz; and as folded stacks, in <time>.folded. Profiles of the same
+// time are told apart by a suffix, as in <time>-1.json. Only the newest
+// profiles are kept.
+type Archive struct {
+	Dir   string
+	Fs    afero.Fs
+	Limit int // most profiles kept; if zero, DefaultArchiveLimit
+}
+
+// Add stores p in a, with its functions named from sym, if not nil, and
+// removes the oldest profiles beyond the limit of a.
+func (a Archive) Add(p Profile, sym *Symbols) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := a.Fs.MkdirAll(a.Dir, 0755); err != nil {
+		return err
+	}
+	base, err := a.name(p.Time)
+	if err != nil {
+		return err
+	}
+	if err := fsutil.WriteFile(a.Fs.OpenFile, base+".json", b); err != nil {
+		return err
+	}
+	if err := a.export(base, p, sym); err != nil {
+		return err
+	}
+	return a.prune()
+}
+
+// name returns the path, without extension, of a new profile of time t.
+func (a Archive) name(t int64) (string, error) {
+	base := filepath.Join(a.Dir, strconv.FormatInt(t, 10))
+	name := base
+	for n := 1; ; n++ {
+		_, err := a.Fs.Stat(name + ".json")
+		if os.IsNotExist(err) {
+			return name, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		name = fmt.Sprintf("%v-%v", base, n)
+	}
+}
+
+// stamp is the time of an archived profile, and its suffix among profiles
+// of the same time.
+type stamp struct {
+	time int64
+	n    int
+	name string // without extension
+}
+
+// parseStamp parses the name of the JSON file of an archived profile.
+func parseStamp(file string) (stamp, bool) {
+	name := strings.TrimSuffix(file, ".json")
+	if name == file {
+		return stamp{}, false
+	}
+	s := stamp{name: name}
+	parts := strings.SplitN(name, "-", 2)
+	var err error
+	if s.time, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return stamp{}, false
+	}
+	if len(parts) == 2 {
+		if s.n, err = strconv.Atoi(parts[1]); err != nil {
+			return stamp{}, false
+		}
+	}
+	return s, true
+}
+
+// prune removes the oldest profiles in a beyond its limit. Files not named
+// as archived profiles are left alone.
+func (a Archive) prune() error {
+	limit := a.Limit
+	if limit <= 0 {
+		limit = DefaultArchiveLimit
+	}
+	infos, err := afero.ReadDir(a.Fs, a.Dir)
+	if err != nil {
+		return err
+	}
+	var stamps []stamp
+	for _, info := range infos {
+		if s, ok := parseStamp(info.Name()); ok {
+			stamps = append(stamps, s)
+		}
+	}
+	if len(stamps) <= limit {
+		return nil
+	}
+	sort.Slice(stamps, func(i, j int) bool {
+		if stamps[i].time != stamps[j].time {
+			return stamps[i].time < stamps[j].time
+		}
+		return stamps[i].n < stamps[j].n
+	})
+	for _, s := range stamps[:len(stamps)-limit] {
+		for _, ext := range extensions {
+			path := filepath.Join(a.Dir, s.name+ext)
+			if err := a.Fs.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// export writes the pprof and folded forms of p, named from base.
+func (a Archive) export(base string, p Profile, sym *Symbols) error {
+	b, err := p.PProf(sym)
+	if err != nil {
+		return err
+	}
+	if err := fsutil.WriteFile(a.Fs.OpenFile, base+".pb.gz", b); err != nil {
+		return err
+	}
+	return fsutil.WriteFile(a.Fs.OpenFile, base+".folded", p.Folded(sym))
+}
+
+// Convert rewrites the pprof and folded forms of the profiles in a, and
+// returns how many it converted. Functions are named from sym, if not nil,
+// or else from the executable recorded with each profile, if it can be read.
+func (a Archive) Convert(sym *Symbols) (int, error) {
+	infos, err := afero.ReadDir(a.Fs, a.Dir)
+	if err != nil {
+		return 0, err
+	}
+	opened := make(map[string]*Symbols)
+	n := 0
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(a.Dir, info.Name())
+		data, err := afero.ReadFile(a.Fs, path)
+		if err != nil {
+			return n, err
+		}
+		p, err := Parse(data)
+		if err != nil {
+			return n, fmt.Errorf("%v: %v", path, err)
+		}
+
+		s := sym
+		if s == nil && p.Executable != "" {
+			var ok bool
+			if s, ok = opened[p.Executable]; !ok {
+				if s, err = OpenSymbols(p.Executable); err != nil {
+					log.Printf("profile: cannot resolve functions of %v: %v", path, err)
+				}
+				opened[p.Executable] = s
+			}
+		}
+		if err := a.export(strings.TrimSuffix(path, ".json"), p, s); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
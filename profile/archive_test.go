@@ -0,0 +1,100 @@
+package profile
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestArchive(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	a := Archive{Dir: "profiles", Fs: fs}
+	p := parseSample(t)
+	if err := a.Add(p, sampleSymbols); err != nil {
+		t.Fatal(err)
+	}
+	p.Time++
+	if err := a.Add(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"1540000000000", "1540000000001"} {
+		for _, ext := range []string{".json", ".pb.gz", ".folded"} {
+			if _, err := fs.Stat("profiles/" + name + ext); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	// The recorded executable does not exist, so functions are named by
+	// address.
+	if err := fs.Remove("profiles/1540000000000.folded"); err != nil {
+		t.Fatal(err)
+	}
+	n, err := a.Convert(nil)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 converted, got %v %v", n, err)
+	}
+	folded, err := afero.ReadFile(fs, "profiles/1540000000000.folded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := string(p.Folded(nil)); string(folded) != expect {
+		t.Errorf("expected %q, got %q", expect, folded)
+	}
+
+	if _, err := (Archive{Dir: "noexist", Fs: fs}).Convert(nil); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestArchiveNames(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	a := Archive{Dir: "profiles", Fs: fs}
+	p := parseSample(t)
+	for i := 0; i < 3; i++ {
+		if err := a.Add(p, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"1540000000000", "1540000000000-1", "1540000000000-2"} {
+		if _, err := fs.Stat("profiles/" + name + ".json"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestArchivePrune(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	a := Archive{Dir: "profiles", Fs: fs, Limit: 2}
+	if err := afero.WriteFile(fs, "profiles/notes.txt", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := parseSample(t)
+	for _, time := range []int64{900, 1000, 1000, 20} {
+		p.Time = time
+		if err := a.Add(p, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name string
+		kept bool
+	}{
+		{name: "20", kept: false},
+		{name: "900", kept: false},
+		{name: "1000", kept: true},
+		{name: "1000-1", kept: true},
+	}
+	for i, c := range cases {
+		for _, ext := range extensions {
+			_, err := fs.Stat("profiles/" + c.name + ext)
+			if kept := err == nil; kept != c.kept {
+				t.Errorf("case %v: expected %v%v kept %v, got %v", i, c.name, ext, c.kept, kept)
+			}
+		}
+	}
+	if _, err := fs.Stat("profiles/notes.txt"); err != nil {
+		t.Errorf("expected other files kept, got %v", err)
+	}
+}
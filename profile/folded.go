@@ -0,0 +1,38 @@
+package profile
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Folded returns p as folded stacks, as read by flame graph tools and
+// speedscope. Each line holds the functions of a stack, root first,
+// separated by semicolons, and the number of samples taken in the last.
+// Functions are named from sym, if not nil, and otherwise by address.
+func (p Profile) Folded(sym *Symbols) []byte {
+	counts := make(map[string]int)
+	p.walk(func(stack []*Node) {
+		n := stack[len(stack)-1]
+		if n.NSamples == 0 {
+			return
+		}
+		names := make([]string, len(stack))
+		for i, f := range stack {
+			names[i], _ = sym.resolve(function(f), p.Mapping)
+		}
+		counts[strings.Join(names, ";")] += n.NSamples
+	})
+
+	stacks := make([]string, 0, len(counts))
+	for s := range counts {
+		stacks = append(stacks, s)
+	}
+	sort.Strings(stacks)
+	var b bytes.Buffer
+	for _, s := range stacks {
+		fmt.Fprintf(&b, "%v %v\n", s, counts[s])
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,20 @@
+package profile
+
+import "testing"
+
+func TestFolded(t *testing.T) {
+	p := parseSample(t)
+	cases := []struct {
+		sym    *Symbols
+		expect string
+	}{
+		{sym: sampleSymbols, expect: "main 1\nmain;mid 2\nmain;mid;leaf 5\n"},
+		{sym: nil, expect: "0x555555555151 1\n0x555555555151;0x555555555137 2\n0x555555555151;0x555555555137;0x555555555129 5\n"},
+	}
+
+	for i, c := range cases {
+		if got := string(p.Folded(c.sym)); got != c.expect {
+			t.Errorf("case %v: expected %q, got %q", i, c.expect, got)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math"
+)
+
+// This file writes profiles in the protobuf format of pprof, defined by
+// profile.proto in github.com/google/pprof. Each node of the tree becomes a
+// sample of the samples taken, and the calls made, in its function at its
+// stack.
+
+// Fields of messages in profile.proto
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileMapping           = 3
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profileTimeNanos         = 9
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	mappingID           = 1
+	mappingMemoryStart  = 2
+	mappingMemoryLimit  = 3
+	mappingFileOffset   = 4
+	mappingFilename     = 5
+	mappingHasFunctions = 7
+
+	locationID        = 1
+	locationMappingID = 2
+	locationAddress   = 3
+	locationLine      = 4
+
+	lineFunctionID = 1
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+)
+
+// pb builds a protobuf message.
+type pb []byte
+
+func (b *pb) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	*b = append(*b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// uint appends a varint field.
+func (b *pb) uint(field int, v uint64) {
+	b.varint(uint64(field) << 3)
+	b.varint(v)
+}
+
+// bytes appends a length-delimited field.
+func (b *pb) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+// packed appends a packed repeated varint field.
+func (b *pb) packed(field int, v []uint64) {
+	var p pb
+	for _, x := range v {
+		p.varint(x)
+	}
+	b.bytes(field, p)
+}
+
+type location struct {
+	addr, fn uint64
+}
+
+// pprofBuilder accumulates the tables of a pprof profile.
+type pprofBuilder struct {
+	p   Profile
+	sym *Symbols
+	out pb
+
+	strings   map[string]uint64
+	table     pb // of strings
+	locations map[location]uint64
+	functions map[uint64]uint64
+}
+
+// str returns the index of s in the string table.
+func (b *pprofBuilder) str(s string) uint64 {
+	i, ok := b.strings[s]
+	if !ok {
+		i = uint64(len(b.strings))
+		b.strings[s] = i
+		b.table.bytes(profileStringTable, []byte(s))
+	}
+	return i
+}
+
+// function returns the ID of the function at fn.
+func (b *pprofBuilder) function(fn uint64) uint64 {
+	id, ok := b.functions[fn]
+	if ok {
+		return id
+	}
+	id = uint64(len(b.functions) + 1)
+	b.functions[fn] = id
+	name, _ := b.sym.resolve(fn, b.p.Mapping)
+	var f pb
+	f.uint(functionID, id)
+	f.uint(functionName, b.str(name))
+	f.uint(functionSystemName, b.str(name))
+	b.out.bytes(profileFunction, f)
+	return id
+}
+
+// location returns the ID of the location at addr in the function at fn.
+func (b *pprofBuilder) location(l location) uint64 {
+	id, ok := b.locations[l]
+	if ok {
+		return id
+	}
+	id = uint64(len(b.locations) + 1)
+	b.locations[l] = id
+	var loc pb
+	loc.uint(locationID, id)
+	if b.p.Executable != "" {
+		loc.uint(locationMappingID, 1)
+	}
+	loc.uint(locationAddress, l.addr)
+	if b.sym != nil {
+		// Without symbols, pprof tools resolve addresses from the
+		// executable.
+		var line pb
+		line.uint(lineFunctionID, b.function(l.fn))
+		loc.bytes(locationLine, line)
+	}
+	b.out.bytes(profileLocation, loc)
+	return id
+}
+
+func (b *pprofBuilder) valueType(field int, typ, unit string) {
+	var v pb
+	v.uint(valueTypeType, b.str(typ))
+	v.uint(valueTypeUnit, b.str(unit))
+	b.out.bytes(field, v)
+}
+
+func (b *pprofBuilder) mapping() {
+	if b.p.Executable == "" {
+		return
+	}
+	m := b.p.Mapping
+	limit := m.Limit
+	if limit == 0 {
+		limit = math.MaxUint64
+	}
+	var mp pb
+	mp.uint(mappingID, 1)
+	mp.uint(mappingMemoryStart, m.Start)
+	mp.uint(mappingMemoryLimit, limit)
+	mp.uint(mappingFileOffset, m.Offset)
+	mp.uint(mappingFilename, b.str(b.p.Executable))
+	if b.sym != nil {
+		mp.uint(mappingHasFunctions, 1)
+	}
+	b.out.bytes(profileMapping, mp)
+}
+
+// PProf returns p in the gzipped protobuf format of pprof, with sample types
+// samples and calls. Functions are named from sym, if not nil; otherwise,
+// pprof tools can resolve them from the executable.
+func (p Profile) PProf(sym *Symbols) ([]byte, error) {
+	b := &pprofBuilder{
+		p:         p,
+		sym:       sym,
+		strings:   make(map[string]uint64),
+		locations: make(map[location]uint64),
+		functions: make(map[uint64]uint64),
+	}
+	b.str("") // index 0 is always the empty string
+	b.valueType(profileSampleType, "samples", "count")
+	b.valueType(profileSampleType, "calls", "count")
+	b.mapping()
+
+	p.walk(func(stack []*Node) {
+		n := stack[len(stack)-1]
+		if n.NSamples == 0 && n.NCalls == 0 {
+			return
+		}
+		// Locations are listed leaf first.
+		ids := make([]uint64, len(stack))
+		for i := range stack {
+			l := location{addr: address(stack, i), fn: function(stack[i])}
+			ids[len(stack)-1-i] = b.location(l)
+		}
+		var s pb
+		s.packed(sampleLocationID, ids)
+		s.packed(sampleValue, []uint64{uint64(n.NSamples), uint64(n.NCalls)})
+		b.out.bytes(profileSample, s)
+	})
+
+	b.out.uint(profileTimeNanos, uint64(p.Time)*1e6)
+	b.out.uint(profileDefaultSampleType, b.str("samples"))
+	b.out = append(b.out, b.table...)
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b.out); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
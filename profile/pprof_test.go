@@ -0,0 +1,122 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+// message holds the fields of a protobuf message by number: varints, and
+// the contents of length-delimited fields.
+type message map[int][]interface{}
+
+func decode(t *testing.T, b []byte) message {
+	m := make(message)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("bad tag")
+		}
+		b = b[n:]
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("bad varint")
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			m[int(tag>>3)] = append(m[int(tag>>3)], v)
+		case 2:
+			m[int(tag>>3)] = append(m[int(tag>>3)], b[:v])
+			b = b[v:]
+		default:
+			t.Fatalf("unexpected wire type %v", tag&7)
+		}
+	}
+	return m
+}
+
+// packed decodes a packed repeated varint field.
+func packed(b []byte) []uint64 {
+	var v []uint64
+	for len(b) > 0 {
+		x, n := binary.Uvarint(b)
+		v = append(v, x)
+		b = b[n:]
+	}
+	return v
+}
+
+func TestPProf(t *testing.T) {
+	p := parseSample(t)
+	cases := []struct {
+		sym       *Symbols
+		functions int
+		names     []string
+	}{
+		{sym: sampleSymbols, functions: 4, names: []string{"main", "mid", "leaf", "/app"}},
+		{sym: nil, functions: 0, names: []string{"/app"}},
+	}
+
+	for i, c := range cases {
+		gz, err := p.PProf(c.sym)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := gzip.NewReader(bytes.NewReader(gz))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := decode(t, b)
+
+		strings := make(map[string]bool)
+		for j, s := range m[profileStringTable] {
+			if j == 0 && len(s.([]byte)) != 0 {
+				t.Errorf("case %v: first string is %q", i, s)
+			}
+			strings[string(s.([]byte))] = true
+		}
+		for _, name := range append(c.names, "samples", "calls", "count") {
+			if !strings[name] {
+				t.Errorf("case %v: %q not in string table", i, name)
+			}
+		}
+		if n := len(m[profileSampleType]); n != 2 {
+			t.Errorf("case %v: expected 2 sample types, got %v", i, n)
+		}
+		if n := len(m[profileMapping]); n != 1 {
+			t.Errorf("case %v: expected 1 mapping, got %v", i, n)
+		}
+		if n := len(m[profileLocation]); n != 7 {
+			t.Errorf("case %v: expected 7 locations, got %v", i, n)
+		}
+		if n := len(m[profileFunction]); n != c.functions {
+			t.Errorf("case %v: expected %v functions, got %v", i, c.functions, n)
+		}
+		if tm := m[profileTimeNanos]; len(tm) != 1 || tm[0].(uint64) != 1540000000000*1e6 {
+			t.Errorf("case %v: unexpected time %v", i, tm)
+		}
+
+		// stack depth, samples, and calls of each node
+		expect := [][3]uint64{{1, 1, 1}, {2, 2, 1}, {3, 5, 3}, {2, 0, 1}}
+		samples := m[profileSample]
+		if len(samples) != len(expect) {
+			t.Fatalf("case %v: expected %v samples, got %v", i, len(expect), len(samples))
+		}
+		for j, s := range samples {
+			sm := decode(t, s.([]byte))
+			ids := packed(sm[sampleLocationID][0].([]byte))
+			values := packed(sm[sampleValue][0].([]byte))
+			got := [3]uint64{uint64(len(ids)), values[0], values[1]}
+			if got != expect[j] {
+				t.Errorf("case %v: sample %v: expected %v, got %v", i, j, expect[j], got)
+			}
+		}
+	}
+}
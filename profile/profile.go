@@ -0,0 +1,116 @@
+// Package profile converts the profile trees sent by agents to the pprof
+// format and to folded stacks, resolving the names of functions from the
+// executable, and keeps profiles in an archive on disk.
+package profile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// Node is a node of a profile tree. It stands for a function called from a
+// call site in the function of its parent.
+type Node struct {
+	Fn       *int64 `json:"functionAddress"`
+	Cs       int64  `json:"callSiteAddress"`
+	NCalls   int    `json:"nCalls"`
+	NSamples int    `json:"nSamples"` // taken in the function itself
+	Callees  []Node `json:"callees"`
+}
+
+// Mapping gives where the text of an executable was mapped in memory.
+type Mapping struct {
+	Start  uint64 `json:"start"`
+	Limit  uint64 `json:"limit"`
+	Offset uint64 `json:"offset"` // in the file, of Start
+}
+
+// Profile is a profile tree of an app. The executable and its mapping, if
+// known, allow its addresses to be resolved later.
+type Profile struct {
+	Time       int64   `json:"timestamp"` // Unix milliseconds
+	Executable string  `json:"executable,omitempty"`
+	Mapping    Mapping `json:"mapping"`
+	Tree       Node    `json:"tree"`
+}
+
+// Parse parses a profile as sent by an agent, or as kept in an Archive.
+func Parse(data []byte) (Profile, error) {
+	var p Profile
+	err := json.Unmarshal(data, &p)
+	return p, err
+}
+
+// walk calls f with each node of p's tree, and the stack of nodes leading to
+// it, root first. The root stands for the whole program, and is not part of
+// stacks unless it has a function address.
+func (p Profile) walk(f func(stack []*Node)) {
+	var visit func(stack []*Node, n *Node)
+	visit = func(stack []*Node, n *Node) {
+		stack = append(stack, n)
+		f(stack)
+		for i := range n.Callees {
+			visit(stack, &n.Callees[i])
+		}
+	}
+	if p.Tree.Fn != nil {
+		visit(nil, &p.Tree)
+		return
+	}
+	for i := range p.Tree.Callees {
+		visit(nil, &p.Tree.Callees[i])
+	}
+}
+
+// address returns the address at which the function of stack[i] was
+// executing: the call site of the next function, or the function's own
+// address if it is the last.
+func address(stack []*Node, i int) uint64 {
+	if i+1 < len(stack) && stack[i+1].Cs != 0 {
+		return uint64(stack[i+1].Cs)
+	}
+	return function(stack[i])
+}
+
+func function(n *Node) uint64 {
+	if n.Fn == nil {
+		return 0
+	}
+	return uint64(*n.Fn)
+}
+
+// ReadMapping returns the mapping of the text of the executable exe in the
+// process pid, as listed in /proc/pid/maps in fs.
+func ReadMapping(fs afero.Fs, pid int, exe string) (Mapping, error) {
+	b, err := afero.ReadFile(fs, fmt.Sprintf("/proc/%v/maps", pid))
+	if err != nil {
+		return Mapping{}, err
+	}
+	// Each line is: start-limit perms offset dev inode path
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 6 || strings.Join(fields[5:], " ") != exe || !strings.Contains(fields[1], "x") {
+			continue
+		}
+		bounds := strings.SplitN(fields[0], "-", 2)
+		if len(bounds) != 2 {
+			continue
+		}
+		var m Mapping
+		var errs [3]error
+		m.Start, errs[0] = strconv.ParseUint(bounds[0], 16, 64)
+		m.Limit, errs[1] = strconv.ParseUint(bounds[1], 16, 64)
+		m.Offset, errs[2] = strconv.ParseUint(fields[2], 16, 64)
+		if errs[0] == nil && errs[1] == nil && errs[2] == nil {
+			return m, nil
+		}
+	}
+	return Mapping{}, fmt.Errorf("%v is not mapped in process %v", exe, pid)
+}
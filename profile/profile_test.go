@@ -0,0 +1,88 @@
+package profile
+
+import (
+	"debug/elf"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"github.com/aukletio/Auklet-Client-C/fsutil"
+)
+
+// sample is a profile of a position-independent executable whose text is
+// mapped at 0x555555555000, in which main calls mid, which calls leaf.
+const sample = `{"timestamp": 1540000000000, "executable": "/app",
+	"mapping": {"start": 93824992235520, "limit": 93824992239616, "offset": 4096},
+	"tree": {"functionAddress": null, "callSiteAddress": 0, "nCalls": 0, "nSamples": 0, "callees": [
+		{"functionAddress": 93824992235857, "callSiteAddress": 0, "nCalls": 1, "nSamples": 1, "callees": [
+			{"functionAddress": 93824992235831, "callSiteAddress": 93824992235873, "nCalls": 1, "nSamples": 2, "callees": [
+				{"functionAddress": 93824992235817, "callSiteAddress": 93824992235847, "nCalls": 3, "nSamples": 5, "callees": []}
+			]},
+			{"functionAddress": 93824992235900, "callSiteAddress": 93824992235880, "nCalls": 1, "nSamples": 0, "callees": []}
+		]}
+	]}}`
+
+// sampleSymbols are the symbols of the executable of sample.
+var sampleSymbols = &Symbols{
+	pie: true,
+	loads: []*elf.Prog{
+		{ProgHeader: elf.ProgHeader{Type: elf.PT_LOAD, Off: 0, Vaddr: 0, Filesz: 0x5e0}},
+		{ProgHeader: elf.ProgHeader{Type: elf.PT_LOAD, Off: 0x1000, Vaddr: 0x1000, Filesz: 0x16d}},
+	},
+	funcs: []symbol{
+		{start: 0x1129, end: 0x1137, name: "leaf"},
+		{start: 0x1137, end: 0x1151, name: "mid"},
+		{start: 0x1151, end: 0x116d, name: "main"},
+	},
+}
+
+func parseSample(t *testing.T) Profile {
+	p, err := Parse([]byte(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestWalk(t *testing.T) {
+	p := parseSample(t)
+	var depths []int
+	p.walk(func(stack []*Node) { depths = append(depths, len(stack)) })
+	expect := []int{1, 2, 3, 2}
+	if len(depths) != len(expect) {
+		t.Fatalf("expected %v, got %v", expect, depths)
+	}
+	for i := range expect {
+		if depths[i] != expect[i] {
+			t.Fatalf("expected %v, got %v", expect, depths)
+		}
+	}
+}
+
+func TestReadMapping(t *testing.T) {
+	maps := `555555554000-555555555000 r--p 00000000 08:01 42 /usr/bin/my app
+555555555000-555555556000 r-xp 00001000 08:01 42 /usr/bin/my app
+7ffff7dd3000-7ffff7dfc000 r-xp 00000000 08:01 43 /lib/ld.so
+`
+	fs := afero.NewMemMapFs()
+	if err := fsutil.WriteFile(fs.OpenFile, "/proc/7/maps", []byte(maps)); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		pid    int
+		exe    string
+		expect Mapping
+		ok     bool
+	}{
+		{pid: 7, exe: "/usr/bin/my app", expect: Mapping{Start: 0x555555555000, Limit: 0x555555556000, Offset: 0x1000}, ok: true},
+		{pid: 7, exe: "/usr/bin/other", ok: false},
+		{pid: 8, exe: "/usr/bin/my app", ok: false},
+	}
+
+	for i, c := range cases {
+		got, err := ReadMapping(fs, c.pid, c.exe)
+		if ok := err == nil; ok != c.ok || got != c.expect {
+			t.Errorf("case %v: expected %+v %v, got %+v %v", i, c.expect, c.ok, got, err)
+		}
+	}
+}
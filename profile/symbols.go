@@ -0,0 +1,89 @@
+package profile
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Symbols resolves addresses in an executable to the names of its
+// functions. Names are as in the symbol table; C++ names are mangled, and are
+// demangled by pprof tools.
+type Symbols struct {
+	funcs []symbol // by start
+	pie   bool     // whether the executable is position-independent
+	loads []*elf.Prog
+}
+
+type symbol struct {
+	start, end uint64 // end equals start if the size is unknown
+	name       string
+}
+
+// OpenSymbols reads the function symbols of the ELF executable at path. If
+// the executable is stripped, its dynamic symbols are used.
+func OpenSymbols(path string) (*Symbols, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	syms, err := f.Symbols()
+	if err != nil {
+		if syms, err = f.DynamicSymbols(); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Symbols{pie: f.Type == elf.ET_DYN}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD {
+			s.loads = append(s.loads, p)
+		}
+	}
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Value == 0 {
+			continue
+		}
+		s.funcs = append(s.funcs, symbol{
+			start: sym.Value,
+			end:   sym.Value + sym.Size,
+			name:  sym.Name,
+		})
+	}
+	if len(s.funcs) == 0 {
+		return nil, errors.New("no function symbols in " + path)
+	}
+	sort.Slice(s.funcs, func(i, j int) bool { return s.funcs[i].start < s.funcs[j].start })
+	return s, nil
+}
+
+// bias returns the difference between the addresses of the executable, when
+// mapped at m, and the addresses in its symbol table. Position-dependent
+// executables are always mapped at the addresses in their symbol tables.
+func (s *Symbols) bias(m Mapping) uint64 {
+	if !s.pie || m.Start == 0 {
+		return 0
+	}
+	for _, p := range s.loads {
+		if p.Off <= m.Offset && m.Offset < p.Off+p.Filesz {
+			return m.Start - (p.Vaddr + m.Offset - p.Off)
+		}
+	}
+	return m.Start - m.Offset
+}
+
+// resolve returns the name of the function containing addr, in the
+// executable mapped at m, or the address in hexadecimal if it is unknown.
+// The boolean reports whether the name was resolved.
+func (s *Symbols) resolve(addr uint64, m Mapping) (string, bool) {
+	if s != nil {
+		a := addr - s.bias(m)
+		i := sort.Search(len(s.funcs), func(i int) bool { return s.funcs[i].start > a }) - 1
+		if i >= 0 && (s.funcs[i].end == s.funcs[i].start || a < s.funcs[i].end) {
+			return s.funcs[i].name, true
+		}
+	}
+	return fmt.Sprintf("0x%x", addr), false
+}
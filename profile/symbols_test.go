@@ -0,0 +1,65 @@
+package profile
+
+import (
+	"debug/elf"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestResolve(t *testing.T) {
+	m := parseSample(t).Mapping
+	cases := []struct {
+		sym    *Symbols
+		addr   uint64
+		expect string
+		ok     bool
+	}{
+		{sym: sampleSymbols, addr: 0x555555555151, expect: "main", ok: true},
+		{sym: sampleSymbols, addr: 0x555555555147, expect: "mid", ok: true},
+		{sym: sampleSymbols, addr: 0x555555555200, expect: "0x555555555200", ok: false},
+		{sym: sampleSymbols, addr: 0x555555555000, expect: "0x555555555000", ok: false},
+		{sym: nil, addr: 0x555555555151, expect: "0x555555555151", ok: false},
+	}
+
+	for i, c := range cases {
+		got, ok := c.sym.resolve(c.addr, m)
+		if got != c.expect || ok != c.ok {
+			t.Errorf("case %v: expected %v %v, got %v %v", i, c.expect, c.ok, got, ok)
+		}
+	}
+}
+
+func TestOpenSymbols(t *testing.T) {
+	// The test binary resolves its own functions.
+	exe, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		t.Skip(err)
+	}
+	if f, err := elf.Open(exe); err == nil {
+		_, err = f.Symbols()
+		f.Close()
+		if err != nil {
+			t.Skip("test binary has no symbol table")
+		}
+	}
+	sym, err := OpenSymbols(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadMapping(afero.NewOsFs(), os.Getpid(), exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := uint64(reflect.ValueOf(TestOpenSymbols).Pointer())
+	if name, ok := sym.resolve(addr, m); !ok || !strings.HasSuffix(name, "profile.TestOpenSymbols") {
+		t.Errorf("expected profile.TestOpenSymbols, got %v", name)
+	}
+
+	if _, err := OpenSymbols("noexist"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,302 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+)
+
+// BatchConfig bounds the batches formed by a Batcher. A batch is sent when it
+// holds Count messages or Bytes of encoded messages, or Window after its first
+// message arrived, whichever comes first.
+type BatchConfig struct {
+	Count  int
+	Bytes  int
+	Window time.Duration
+}
+
+// DefaultBatchCount and DefaultBatchBytes bound batches whose Count or Bytes
+// is zero.
+const (
+	DefaultBatchCount = 100
+	DefaultBatchBytes = 64 << 10
+)
+
+// batch is a group of messages on one topic. Metadata common to all of them
+// is given once; each item holds the rest of a message.
+type batch struct {
+	Topic    broker.Topic     `json:"topic"`
+	Metadata map[string]raw   `json:"metadata"`
+	Items    []map[string]raw `json:"items"`
+}
+
+// shared lists the metadata fields hoisted out of batch items, and replaced by
+// the session ID in compact messages. Messages are batched together only if
+// these fields are equal.
+var shared = []string{
+	"version",
+	"device",
+	"clientVersion",
+	"agentVersion",
+	"application",
+	"release",
+	"macAddressHash",
+	"publicIP",
+	"boot",
+	"session",
+}
+
+// batchable reports whether messages on topic are batched. Events are sent
+// as soon as they occur.
+func batchable(topic broker.Topic) bool {
+	return topic == broker.Profile || topic == broker.DataPoint
+}
+
+// raw is an encoded value, which is copied as-is into an enclosing value.
+type raw []byte
+
+// MarshalJSON returns r.
+func (r raw) MarshalJSON() ([]byte, error) { return r, nil }
+
+// UnmarshalJSON sets r to a copy of b.
+func (r *raw) UnmarshalJSON(b []byte) error {
+	*r = append((*r)[:0], b...)
+	return nil
+}
+
+// MarshalMsgpack returns r.
+func (r raw) MarshalMsgpack() ([]byte, error) { return r, nil }
+
+// fields splits the encoded map in data into its encoded values, by key.
+func (e Encoding) fields(data []byte) (map[string]raw, error) {
+	f := make(map[string]raw)
+	switch e {
+	case JSON:
+		err := json.Unmarshal(data, &f)
+		return f, err
+	case Compact:
+		return compactFields(data)
+	case Protobuf:
+		return protoFields(data)
+	case CBOR:
+		return cborFields(data)
+	}
+
+	r := bytes.NewReader(data)
+	dec := msgpack.NewDecoder(r)
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		k, err := dec.DecodeString()
+		if err != nil {
+			return nil, err
+		}
+		start := len(data) - r.Len()
+		if err := dec.Skip(); err != nil {
+			return nil, err
+		}
+		f[k] = raw(data[start : len(data)-r.Len()])
+	}
+	return f, nil
+}
+
+// marshal encodes the message v, which may be a map of fields returned by
+// fields and encodeField.
+func (e Encoding) marshal(v interface{}) ([]byte, error) {
+	switch e {
+	case JSON:
+		return json.Marshal(v)
+	case Compact:
+		return compactMarshal(v)
+	case Protobuf:
+		return protoMarshal(v)
+	case CBOR:
+		return cborMarshal(v)
+	}
+	return msgpackMarshal(v)
+}
+
+// encodeField encodes v as the value of the field name, for use in the map
+// passed to marshal.
+func (e Encoding) encodeField(name string, v interface{}) (raw, error) {
+	switch e {
+	case JSON:
+		return json.Marshal(v)
+	case Compact:
+		return compactMarshal(v)
+	case Protobuf:
+		return protoEncodeField(name, v)
+	case CBOR:
+		return cborMarshal(v)
+	}
+	return msgpackMarshal(v)
+}
+
+// decodeField decodes r, the value of the field name returned by fields,
+// into v.
+func (e Encoding) decodeField(name string, r raw, v interface{}) error {
+	switch e {
+	case JSON:
+		return json.Unmarshal(r, v)
+	case Compact:
+		return compactUnmarshal(r, v)
+	case Protobuf:
+		return protoDecodeField(name, r, v)
+	case CBOR:
+		return cborUnmarshal(r, v)
+	}
+	return msgpack.Unmarshal(r, v)
+}
+
+// group is a batch being formed.
+type group struct {
+	key   string
+	batch batch
+	parts []broker.Message
+	size  int
+}
+
+// Batcher groups messages of the same topic and metadata into single messages
+// on the Batch topic. Other messages, and messages that cannot be decoded,
+// are passed through unchanged.
+type Batcher struct {
+	in  broker.MessageSource
+	out chan broker.Message
+	BatchConfig
+	Encoding
+}
+
+// NewBatcher returns a Batcher of the messages from in, which are encoded with
+// enc.
+func NewBatcher(cfg BatchConfig, enc Encoding, in broker.MessageSource) Batcher {
+	if cfg.Count <= 0 {
+		cfg.Count = DefaultBatchCount
+	}
+	if cfg.Bytes <= 0 {
+		cfg.Bytes = DefaultBatchBytes
+	}
+	b := Batcher{
+		in:          in,
+		out:         make(chan broker.Message),
+		BatchConfig: cfg,
+		Encoding:    enc,
+	}
+	go b.serve()
+	return b
+}
+
+// Output returns b's output stream.
+func (b Batcher) Output() <-chan broker.Message { return b.out }
+
+func (b Batcher) serve() {
+	defer close(b.out)
+	done := make(chan struct{})
+	defer close(done)
+	expired := make(chan *group)
+	groups := make(map[string]*group)
+
+	flush := func(g *group) {
+		delete(groups, g.key)
+		b.out <- b.join(g)
+	}
+
+	src := b.in.Output()
+	for {
+		select {
+		case m, ok := <-src:
+			if !ok {
+				keys := make([]string, 0, len(groups))
+				for k := range groups {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					flush(groups[k])
+				}
+				return
+			}
+			if m.Error != "" || !batchable(m.Topic) {
+				b.out <- m
+				continue
+			}
+			f, err := b.fields(m.Bytes)
+			if err != nil {
+				errorlog.Printf("Batcher.serve: %v", err)
+				b.out <- m
+				continue
+			}
+
+			meta, key := hoist(f, m.Topic)
+			g := groups[key]
+			if g != nil && g.size+len(m.Bytes) > b.Bytes {
+				flush(g)
+				g = nil
+			}
+			if g == nil {
+				g = &group{key: key, batch: batch{Topic: m.Topic, Metadata: meta}}
+				groups[key] = g
+				time.AfterFunc(b.Window, func() {
+					select {
+					case expired <- g:
+					case <-done:
+					}
+				})
+			}
+			g.batch.Items = append(g.batch.Items, f)
+			g.parts = append(g.parts, m)
+			g.size += len(m.Bytes)
+			if len(g.parts) >= b.Count || g.size >= b.Bytes {
+				flush(g)
+			}
+		case g := <-expired:
+			// g may have been flushed already.
+			if groups[g.key] == g {
+				flush(g)
+			}
+		}
+	}
+}
+
+// hoist removes the shared metadata fields from f, and returns them, and a
+// key identifying messages on topic with the same metadata.
+func hoist(f map[string]raw, topic broker.Topic) (map[string]raw, string) {
+	meta := make(map[string]raw)
+	key := []byte(topic)
+	for _, name := range shared {
+		v, ok := f[name]
+		if !ok {
+			continue
+		}
+		meta[name] = v
+		delete(f, name)
+		key = append(key, 0)
+		key = append(key, name...)
+		key = append(key, 0)
+		key = append(key, v...)
+	}
+	return meta, string(key)
+}
+
+// join returns the message that stands for the messages in g. A single
+// message is sent as-is.
+func (b Batcher) join(g *group) broker.Message {
+	if len(g.parts) == 1 {
+		return g.parts[0]
+	}
+	data, err := b.marshal(g.batch)
+	if err != nil {
+		errorlog.Printf("Batcher.join: %v", err)
+		return broker.Message{Error: err.Error(), Topic: broker.Log}
+	}
+	m := broker.Join(broker.Batch, data, g.parts)
+	m.Encoding = b.Encoding.String()
+	return m
+}
@@ -0,0 +1,139 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+)
+
+type messages chan broker.Message
+
+func (m messages) Output() <-chan broker.Message { return m }
+
+// dataPoints returns n datapoints encoded with enc.
+func dataPoints(enc Encoding, n int) []broker.Message {
+	c := newConverter(Config{App: app{}, IP: ip("1.2.3.4"), Username: "username", Encoding: enc})
+	msgs := make([]broker.Message, n)
+	for i := range msgs {
+		msgs[i] = c.marshal(c.genericDataPoint("type", []byte(`{"n": 1.50}`)), broker.DataPoint)
+	}
+	return msgs
+}
+
+// send returns a source of msgs, which is closed after them if last is true.
+func send(msgs []broker.Message, last bool) messages {
+	in := make(messages)
+	go func() {
+		for _, m := range msgs {
+			in <- m
+		}
+		if last {
+			close(in)
+		}
+	}()
+	return in
+}
+
+func TestBatcher(t *testing.T) {
+	cases := []struct {
+		cfg    BatchConfig
+		enc    Encoding
+		input  []broker.Message
+		expect []broker.Topic
+	}{
+		{
+			cfg:    BatchConfig{Count: 3, Window: time.Hour},
+			enc:    JSON,
+			input:  dataPoints(JSON, 7),
+			expect: []broker.Topic{broker.Batch, broker.Batch, broker.DataPoint},
+		}, {
+			cfg:    BatchConfig{Count: 2, Window: time.Hour},
+			enc:    MsgPack,
+			input:  dataPoints(MsgPack, 4),
+			expect: []broker.Topic{broker.Batch, broker.Batch},
+		}, {
+			cfg:    BatchConfig{Bytes: 1, Window: time.Hour},
+			enc:    JSON,
+			input:  dataPoints(JSON, 2),
+			expect: []broker.Topic{broker.DataPoint, broker.DataPoint},
+		}, {
+			cfg:    BatchConfig{Window: time.Hour},
+			enc:    JSON,
+			input:  []broker.Message{{Topic: broker.Event}, {Topic: broker.DataPoint, Bytes: []byte("not a map")}},
+			expect: []broker.Topic{broker.Event, broker.DataPoint},
+		},
+	}
+
+	for i, c := range cases {
+		var got []broker.Topic
+		for m := range NewBatcher(c.cfg, c.enc, send(c.input, true)).Output() {
+			got = append(got, m.Topic)
+		}
+		if len(got) != len(c.expect) {
+			t.Errorf("case %v: expected %v, got %v", i, c.expect, got)
+			continue
+		}
+		for j := range got {
+			if got[j] != c.expect[j] {
+				t.Errorf("case %v: expected %v, got %v", i, c.expect, got)
+				break
+			}
+		}
+	}
+}
+
+func TestBatcherWindow(t *testing.T) {
+	in := send(dataPoints(JSON, 2), false)
+	b := NewBatcher(BatchConfig{Window: 10 * time.Millisecond}, JSON, in)
+	select {
+	case m := <-b.Output():
+		if m.Topic != broker.Batch {
+			t.Errorf("expected %v, got %v", broker.Batch, m.Topic)
+		}
+	case <-time.After(time.Second):
+		t.Error("batch not sent after its window")
+	}
+	close(in)
+}
+
+func TestBatchContents(t *testing.T) {
+	unmarshal := map[Encoding]func([]byte, interface{}) error{
+		JSON: json.Unmarshal,
+		MsgPack: func(b []byte, v interface{}) error {
+			dec := msgpack.NewDecoder(bytes.NewReader(b))
+			dec.UseJSONTag(true)
+			return dec.Decode(v)
+		},
+	}
+	for _, enc := range []Encoding{JSON, MsgPack} {
+		m := <-NewBatcher(BatchConfig{Count: 2, Window: time.Hour}, enc, send(dataPoints(enc, 2), true)).Output()
+		// Items are decoded into structs, so that payloads holding
+		// msgpack extensions are skipped.
+		var got struct {
+			Topic    string            `json:"topic"`
+			Metadata map[string]string `json:"metadata"`
+			Items    []struct {
+				ID     string `json:"id"`
+				Device string `json:"device"`
+				Type   string `json:"type"`
+			} `json:"items"`
+		}
+		if err := unmarshal[enc](m.Bytes, &got); err != nil {
+			t.Fatalf("encoding %v: %v", enc, err)
+		}
+		if got.Topic != string(broker.DataPoint) || got.Metadata["device"] != "username" || len(got.Items) != 2 {
+			t.Errorf("encoding %v: unexpected batch %+v", enc, got)
+			continue
+		}
+		for _, item := range got.Items {
+			if item.Device != "" || item.ID == "" || item.Type != "type" {
+				t.Errorf("encoding %v: unexpected item %+v", enc, item)
+			}
+		}
+	}
+}
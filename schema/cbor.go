@@ -0,0 +1,461 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file implements the CBOR encoding (RFC 8949) of messages. Messages
+// are encoded from the same trees as the compact encoding. Map keys are
+// sorted as in deterministic encoding, and numbers take the smallest form
+// that holds them exactly: integers, float32 or float64, bignums, or decimal
+// fractions.
+
+// Major types
+const (
+	majorUint   = 0
+	majorNegint = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorTag    = 6
+	majorSimple = 7
+)
+
+// Tags
+const (
+	tagPosBignum    = 2
+	tagNegBignum    = 3
+	tagDecimal      = 4
+	tagSelfDescribe = 55799
+)
+
+// Simple values
+const (
+	cborFalse   = 0xf4
+	cborTrue    = 0xf5
+	cborNull    = 0xf6
+	cborUndef   = 0xf7
+	cborFloat16 = 0xf9
+	cborFloat32 = 0xfa
+	cborFloat64 = 0xfb
+)
+
+// cborMarshal encodes v in CBOR. Maps are encoded as messages, beginning
+// with the self-describe tag, so that consumers can recognize them.
+func cborMarshal(v interface{}) ([]byte, error) {
+	t, err := tree(v)
+	if err != nil {
+		return nil, err
+	}
+	var e cborEncoder
+	if _, ok := t.(map[string]interface{}); ok {
+		e.head(majorTag, tagSelfDescribe)
+	}
+	if err := e.value(t); err != nil {
+		return nil, err
+	}
+	return e.Bytes(), nil
+}
+
+type cborEncoder struct {
+	bytes.Buffer
+}
+
+// head writes the initial bytes of an item of major type major with
+// argument n.
+func (e *cborEncoder) head(major byte, n uint64) {
+	m := major << 5
+	switch {
+	case n < 24:
+		e.WriteByte(m | byte(n))
+	case n <= math.MaxUint8:
+		e.Write([]byte{m | 24, byte(n)})
+	case n <= math.MaxUint16:
+		e.WriteByte(m | 25)
+		binary.Write(e, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		e.WriteByte(m | 26)
+		binary.Write(e, binary.BigEndian, uint32(n))
+	default:
+		e.WriteByte(m | 27)
+		binary.Write(e, binary.BigEndian, n)
+	}
+}
+
+func (e *cborEncoder) string(s string) {
+	e.head(majorText, uint64(len(s)))
+	e.WriteString(s)
+}
+
+func (e *cborEncoder) value(v interface{}) error {
+	switch v := v.(type) {
+	case raw:
+		e.Write(v)
+	case nil:
+		e.WriteByte(cborNull)
+	case bool:
+		if v {
+			e.WriteByte(cborTrue)
+		} else {
+			e.WriteByte(cborFalse)
+		}
+	case string:
+		e.string(v)
+	case json.Number:
+		return e.number(v)
+	case []interface{}:
+		e.head(majorArray, uint64(len(v)))
+		for _, x := range v {
+			if err := e.value(x); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		// Shorter keys have smaller encodings.
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		e.head(majorMap, uint64(len(v)))
+		for _, k := range keys {
+			e.string(k)
+			if err := e.value(v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: cannot encode %T", v)
+	}
+	return nil
+}
+
+// number encodes n in the smallest form that holds it exactly.
+func (e *cborEncoder) number(n json.Number) error {
+	s := n.String()
+	if !strings.ContainsAny(s, ".eE") {
+		i, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return fmt.Errorf("cbor: invalid number %q", s)
+		}
+		e.integer(i)
+		return nil
+	}
+	if f, err := n.Float64(); err == nil && significantDigits(s) <= 15 {
+		if f32 := float32(f); float64(f32) == f {
+			e.WriteByte(cborFloat32)
+			binary.Write(e, binary.BigEndian, math.Float32bits(f32))
+			return nil
+		}
+		e.WriteByte(cborFloat64)
+		binary.Write(e, binary.BigEndian, math.Float64bits(f))
+		return nil
+	}
+	mantissa, exp, err := decimal(s)
+	if err != nil {
+		return err
+	}
+	e.head(majorTag, tagDecimal)
+	e.head(majorArray, 2)
+	e.integer(big.NewInt(exp))
+	e.integer(mantissa)
+	return nil
+}
+
+// integer encodes i as an integer if it fits in 64 bits, and as a bignum
+// otherwise.
+func (e *cborEncoder) integer(i *big.Int) {
+	major, tag := byte(majorUint), uint64(tagPosBignum)
+	n := new(big.Int).Set(i)
+	if n.Sign() < 0 {
+		// Negative integers are encoded as -1-n.
+		major, tag = majorNegint, tagNegBignum
+		n.Neg(n).Sub(n, big.NewInt(1))
+	}
+	if n.IsUint64() {
+		e.head(major, n.Uint64())
+		return
+	}
+	b := n.Bytes()
+	e.head(majorTag, tag)
+	e.head(majorBytes, uint64(len(b)))
+	e.Write(b)
+}
+
+// decimal splits the decimal number s into a mantissa and a power of ten.
+func decimal(s string) (*big.Int, int64, error) {
+	var exp int64
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		var err error
+		if exp, err = strconv.ParseInt(s[i+1:], 10, 64); err != nil {
+			return nil, 0, fmt.Errorf("cbor: invalid number %q", s)
+		}
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		exp -= int64(len(s) - i - 1)
+		s = s[:i] + s[i+1:]
+	}
+	mantissa, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, 0, fmt.Errorf("cbor: invalid number %q", s)
+	}
+	return mantissa, exp, nil
+}
+
+var errCBORSyntax = errors.New("cbor: malformed message")
+
+type cborDecoder struct {
+	*bytes.Reader
+}
+
+// head reads the initial bytes of an item, and returns its major type, the
+// additional information, and the argument.
+func (d cborDecoder) head() (major, info byte, n uint64, err error) {
+	b, err := d.ReadByte()
+	if err != nil {
+		return 0, 0, 0, errCBORSyntax
+	}
+	major, info = b>>5, b&31
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		// Indefinite lengths are not used by the client.
+		return 0, 0, 0, errCBORSyntax
+	}
+	buf := make([]byte, 8)
+	if n, _ := d.Read(buf[8-size:]); n != size {
+		return 0, 0, 0, errCBORSyntax
+	}
+	return major, info, binary.BigEndian.Uint64(buf), nil
+}
+
+func (d cborDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(d.Len()) {
+		return nil, errCBORSyntax
+	}
+	b := make([]byte, n)
+	d.Read(b)
+	return b, nil
+}
+
+// value decodes an item as a tree, with numbers as JSON numbers.
+func (d cborDecoder) value() (interface{}, error) {
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case majorUint:
+		return json.Number(strconv.FormatUint(n, 10)), nil
+	case majorNegint:
+		i := new(big.Int).SetUint64(n)
+		return json.Number(i.Neg(i).Sub(i, big.NewInt(1)).String()), nil
+	case majorBytes:
+		b, err := d.bytes(n)
+		return base64.StdEncoding.EncodeToString(b), err
+	case majorText:
+		b, err := d.bytes(n)
+		return string(b), err
+	case majorArray:
+		if n > uint64(d.Len()) {
+			return nil, errCBORSyntax
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case majorMap:
+		if n > uint64(d.Len()) {
+			return nil, errCBORSyntax
+		}
+		m := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, errors.New("cbor: map key is not a string")
+			}
+			if m[key], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case majorTag:
+		return d.tagged(n)
+	}
+
+	switch info {
+	case cborFalse & 31:
+		return false, nil
+	case cborTrue & 31:
+		return true, nil
+	case cborNull & 31, cborUndef & 31:
+		return nil, nil
+	case cborFloat16 & 31:
+		return cborNumber(float16(uint16(n)), 32), nil
+	case cborFloat32 & 31:
+		return cborNumber(float64(math.Float32frombits(uint32(n))), 32), nil
+	case cborFloat64 & 31:
+		return cborNumber(math.Float64frombits(n), 64), nil
+	}
+	return nil, errCBORSyntax
+}
+
+// tagged decodes the item following tag.
+func (d cborDecoder) tagged(tag uint64) (interface{}, error) {
+	switch tag {
+	case tagPosBignum, tagNegBignum:
+		major, _, n, err := d.head()
+		if err != nil || major != majorBytes {
+			return nil, errCBORSyntax
+		}
+		b, err := d.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		i := new(big.Int).SetBytes(b)
+		if tag == tagNegBignum {
+			i.Neg(i).Sub(i, big.NewInt(1))
+		}
+		return json.Number(i.String()), nil
+	case tagDecimal:
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		a, ok := v.([]interface{})
+		if !ok || len(a) != 2 {
+			return nil, errCBORSyntax
+		}
+		exp, eok := a[0].(json.Number)
+		mantissa, mok := a[1].(json.Number)
+		if !eok || !mok {
+			return nil, errCBORSyntax
+		}
+		return json.Number(mantissa.String() + "e" + exp.String()), nil
+	}
+	// The meaning of other tags, such as self-describe, does not change
+	// the JSON form of the item.
+	return d.value()
+}
+
+// float16 returns the value of the half-precision float h.
+func float16(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	frac := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(frac, -24)
+	case 0x1f:
+		if frac == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(frac+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+// cborNumber returns f, a float of bitSize bits, as a JSON number. Integers
+// are written without an exponent.
+func cborNumber(f float64, bitSize int) json.Number {
+	if f == math.Trunc(f) && math.Abs(f) < 1e21 {
+		return json.Number(strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, bitSize))
+}
+
+// cborMessage returns the reader of the CBOR message data, positioned after
+// its self-describe tag, if any.
+func cborMessage(data []byte) cborDecoder {
+	self := []byte{0xd9, 0xd9, 0xf7}
+	return cborDecoder{bytes.NewReader(bytes.TrimPrefix(data, self))}
+}
+
+// cborFields splits the CBOR message in data into its encoded values, by key.
+func cborFields(data []byte) (map[string]raw, error) {
+	d := cborMessage(data)
+	major, _, n, err := d.head()
+	if err != nil || major != majorMap || n > uint64(d.Len()) {
+		return nil, errors.New("cbor: not a map")
+	}
+	f := make(map[string]raw, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New("cbor: map key is not a string")
+		}
+		start := len(data) - d.Len()
+		if _, err := d.value(); err != nil {
+			return nil, err
+		}
+		f[key] = raw(data[start : len(data)-d.Len()])
+	}
+	return f, nil
+}
+
+// cborUnmarshal decodes the CBOR value or message in b into v, as
+// json.Unmarshal would decode its JSON form.
+func cborUnmarshal(b []byte, v interface{}) error {
+	j, err := cborJSON(b)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+// cborJSON returns the CBOR value in b as JSON.
+func cborJSON(b []byte) ([]byte, error) {
+	d := cborMessage(b)
+	t, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.Len() != 0 {
+		return nil, errCBORSyntax
+	}
+	return json.Marshal(t)
+}
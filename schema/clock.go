@@ -0,0 +1,174 @@
+package schema
+
+import (
+	"log"
+	"time"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+	"github.com/aukletio/Auklet-Client-C/device"
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+)
+
+// DefaultClockJump is the least change of the wall clock taken to mean that
+// it was set by time synchronization.
+const DefaultClockJump = 24 * time.Hour
+
+// minWall is the earliest wall time taken to mean that the wall clock was
+// set. Devices without a real-time clock boot at 1970.
+var minWall = time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// clockCheck is how often a Converter checks its Clock for jumps.
+var clockCheck = 10 * time.Second
+
+// Clock stamps messages with the wall time and the time since boot, and
+// tells whether the wall clock can be trusted. It detects when the wall
+// clock is set by watching the wall time of boot, which changes only then.
+type Clock struct {
+	Boot device.Boot
+	Jump time.Duration // least jump taken as time synchronization
+
+	boot   time.Time // wall time of boot, as of the last reading
+	synced bool      // whether the wall clock can be trusted
+}
+
+// NewClock returns a Clock for boot that takes jumps of at least jump to mean
+// that the wall clock was set.
+func NewClock(boot device.Boot, jump time.Duration) *Clock {
+	if jump <= 0 {
+		jump = DefaultClockJump
+	}
+	c := &Clock{Boot: boot, Jump: jump}
+	r := c.now()
+	c.boot = r.wall.Add(-r.up)
+	c.synced = !r.wall.Before(minWall)
+	if !c.synced {
+		log.Printf("clock: wall clock not set (%v); timestamps are uncertain", r.wall)
+	}
+	return c
+}
+
+// reading is a time according to the wall clock, and to the monotonic clock
+// as time since boot.
+type reading struct {
+	wall time.Time
+	up   time.Duration
+}
+
+func (c *Clock) now() reading {
+	t := time.Now()
+	return reading{wall: t.Round(0), up: c.Boot.Since(t)}
+}
+
+// observe updates c with r, and reports whether the wall clock has just been
+// set, and if so, by how much it jumped.
+func (c *Clock) observe(r reading) (time.Duration, bool) {
+	boot := r.wall.Add(-r.up)
+	jump := boot.Sub(c.boot)
+	c.boot = boot
+	if jump > -time.Second && jump < time.Second {
+		// slewing or measurement noise
+		return 0, false
+	}
+	log.Printf("clock: wall clock jumped by %v", jump)
+	if jump > -c.Jump && jump < c.Jump && (c.synced || r.wall.Before(minWall)) {
+		return 0, false
+	}
+	c.synced = true
+	return jump, true
+}
+
+// stamp returns the timestamp and uptime of r, in milliseconds.
+func (r reading) stamp() (int64, int64) {
+	return r.wall.UnixNano() / 1e6, int64(r.up / time.Millisecond)
+}
+
+// checkClock corrects the stored messages of this boot if the wall clock has
+// just been set.
+func (c Converter) checkClock() {
+	if c.Clock == nil {
+		return
+	}
+	jump, set := c.Clock.observe(c.Clock.now())
+	if !set {
+		return
+	}
+	log.Printf("clock: wall clock set by a jump of %v; correcting stored messages", jump)
+	n, err := c.correct()
+	if err != nil {
+		errorlog.Printf("Converter.checkClock: %v", err)
+	}
+	log.Printf("clock: corrected %v stored messages", n)
+}
+
+// Rewriter can rewrite the messages it stores. It saves those that f reports
+// it changed.
+type Rewriter interface {
+	Rewrite(f func(*broker.Message) bool) error
+}
+
+// correct recomputes the timestamps of the stored messages of this boot from
+// their uptime and the wall time of boot, and clears their clockUncertain
+// flags. Messages of other boots cannot be corrected, and keep their flags.
+func (c Converter) correct() (int, error) {
+	r, ok := c.Persistor.(Rewriter)
+	if !ok || c.Clock.Boot.ID == "" {
+		return 0, nil
+	}
+	boot, err := c.Encoding.encodeField("boot", c.Clock.Boot.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Compact messages name their session instead of their boot. The
+	// sessions of this boot are those started by this run, whose records
+	// may already be sent, and those of earlier runs, which we learn from
+	// their stored records.
+	sessions := make(map[string]bool)
+	if c.Session != nil {
+		for _, id := range c.Session.started {
+			if s, err := c.Encoding.encodeField("session", id); err == nil {
+				sessions[string(s)] = true
+			}
+		}
+	}
+	err = r.Rewrite(func(m *broker.Message) bool {
+		if m.Topic != broker.Session {
+			return false
+		}
+		if f, err := c.Encoding.fields(m.Bytes); err == nil && string(f["boot"]) == string(boot) {
+			sessions[string(f["session"])] = true
+		}
+		return false
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = r.Rewrite(func(m *broker.Message) bool {
+		f, err := c.Encoding.fields(m.Bytes)
+		if err != nil {
+			return false
+		}
+		if string(f["boot"]) != string(boot) && !sessions[string(f["session"])] {
+			return false
+		}
+		var up int64
+		if err := c.Encoding.decodeField("uptime", f["uptime"], &up); err != nil {
+			return false
+		}
+		wall := c.Clock.boot.Add(time.Duration(up) * time.Millisecond)
+		if f["timestamp"], err = c.Encoding.encodeField("timestamp", wall.UnixNano()/1e6); err != nil {
+			return false
+		}
+		delete(f, "clockUncertain")
+		b, err := c.Encoding.marshal(f)
+		if err != nil {
+			return false
+		}
+		m.Bytes = b
+		n++
+		return true
+	})
+	return n, err
+}
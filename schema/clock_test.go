@@ -0,0 +1,129 @@
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+	"github.com/aukletio/Auklet-Client-C/device"
+)
+
+func TestObserve(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	synced := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		boot   time.Time // as last seen
+		synced bool
+		r      reading
+		set    bool
+		jump   time.Duration
+	}{
+		// no jump
+		{boot: epoch, r: reading{wall: epoch.Add(time.Minute), up: time.Minute}},
+		// clock set from 1970
+		{boot: epoch, r: reading{wall: synced, up: time.Minute}, set: true, jump: synced.Sub(epoch) - time.Minute},
+		// small correction of a synced clock
+		{boot: synced, synced: true, r: reading{wall: synced.Add(time.Minute), up: 0}},
+		// large correction of a synced clock, such as a stale RTC
+		{boot: synced, synced: true, r: reading{wall: synced.Add(48 * time.Hour), up: 0}, set: true, jump: 48 * time.Hour},
+		// small jump, still before minWall
+		{boot: epoch, r: reading{wall: epoch.Add(time.Minute), up: 0}},
+	}
+
+	for i, c := range cases {
+		clock := &Clock{Jump: DefaultClockJump, boot: c.boot, synced: c.synced}
+		jump, set := clock.observe(c.r)
+		if set != c.set || jump != c.jump {
+			t.Errorf("case %v: expected %v %v, got %v %v", i, c.set, c.jump, set, jump)
+		}
+		if !clock.boot.Equal(c.r.wall.Add(-c.r.up)) {
+			t.Errorf("case %v: boot not updated", i)
+		}
+	}
+}
+
+// store is a Persistor and Rewriter in memory.
+type store []broker.Message
+
+func (s *store) CreateMessage(m *broker.Message) error {
+	*s = append(*s, *m)
+	return nil
+}
+
+func (s *store) Rewrite(f func(*broker.Message) bool) error {
+	for i := range *s {
+		f(&(*s)[i])
+	}
+	return nil
+}
+
+func TestCorrect(t *testing.T) {
+	boot := device.ReadBoot()
+	boot.ID = "this boot"
+	c := newConverter(cfg)
+	c.Encoding = JSON
+	c.Persistor = new(store)
+	c.Session = NewSession()
+	c.Clock = &Clock{Boot: boot, Jump: DefaultClockJump}
+
+	rec, _ := c.record(c.metadata())
+	other := []byte(`{"boot": "other boot", "uptime": 5, "timestamp": 5, "clockUncertain": true}`)
+	for _, m := range []broker.Message{
+		rec,
+		c.marshal(c.exit(), broker.Event),
+		{Topic: broker.Event, Bytes: other},
+	} {
+		c.Persistor.CreateMessage(&m)
+	}
+
+	// The clock is set.
+	c.Clock.boot = time.Unix(1e9, 0)
+	if n, err := c.correct(); n != 2 || err != nil {
+		t.Errorf("expected 2 messages corrected, got %v: %v", n, err)
+	}
+
+	for i, m := range *c.Persistor.(*store) {
+		var got struct {
+			Time      int64 `json:"timestamp"`
+			Uptime    int64 `json:"uptime"`
+			Uncertain bool  `json:"clockUncertain"`
+		}
+		if err := json.Unmarshal(m.Bytes, &got); err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 {
+			if string(m.Bytes) != string(other) {
+				t.Errorf("expected message of other boot unchanged, got %s", m.Bytes)
+			}
+			continue
+		}
+		if expect := 1e12 + got.Uptime; got.Time != expect || got.Uncertain {
+			t.Errorf("message %v: expected timestamp %v and certain, got %+v", i, expect, got)
+		}
+	}
+}
+
+func TestCorrectSentRecords(t *testing.T) {
+	boot := device.ReadBoot()
+	boot.ID = "this boot"
+	c := newConverter(cfg)
+	c.Encoding = JSON
+	c.Persistor = new(store)
+	c.Session = NewSession()
+	c.Clock = &Clock{Boot: boot, Jump: DefaultClockJump}
+
+	// Two sessions are started, and their records sent; only their
+	// compact messages remain stored.
+	for i := 0; i < 2; i++ {
+		c.Session.static = nil
+		c.record(c.metadata())
+		m := c.marshal(c.exit(), broker.Event)
+		c.Persistor.CreateMessage(&m)
+	}
+
+	c.Clock.boot = time.Unix(1e9, 0)
+	if n, err := c.correct(); n != 2 || err != nil {
+		t.Errorf("expected 2 messages corrected, got %v: %v", n, err)
+	}
+}
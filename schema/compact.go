@@ -0,0 +1,503 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file defines the compact encoding, for links on which every byte
+// counts, such as LoRa and satellite links.
+//
+// A message is CompactHeader, the dictionary version, and a map. Each value
+// is a tag byte followed by its contents:
+//
+//	cNull, cFalse, cTrue  nothing
+//	cInt                  zigzag varint
+//	cFloat32, cFloat64    IEEE 754, little endian
+//	cNumber               length-prefixed decimal, for numbers that neither
+//	                      int64 nor float64 can hold exactly
+//	cString               uvarint length and UTF-8 bytes
+//	cWord                 uvarint index of a string in the dictionary
+//	cArray                uvarint length and elements
+//	cMap                  uvarint length and key-value pairs; a key is a
+//	                      uvarint dictionary index plus one, or zero followed
+//	                      by a length-prefixed string
+//	cAddress              zigzag varint offset from the base address
+//
+// Addresses in profile trees and stack traces are encoded relative to a base
+// address: the first address in the enclosing map's parent, such as the
+// caller's function address, or zero at the top of a message. Top-level
+// fields are thus self-contained, and can be hoisted and copied like those
+// of other encodings.
+
+// CompactHeader begins every message in the compact encoding. It is never
+// the first byte of a JSON or MessagePack message.
+const CompactHeader = 0xc2
+
+const (
+	cNull byte = iota
+	cFalse
+	cTrue
+	cInt
+	cFloat32
+	cFloat64
+	cNumber
+	cString
+	cWord
+	cArray
+	cMap
+	cAddress
+)
+
+// dictionaryVersion identifies dictionary. Entries may only be appended to
+// dictionary, and doing so requires a new version.
+const dictionaryVersion = 2
+
+// dictionary holds the field names and common strings of messages. The keys
+// of a map are encoded in dictionary order, so that address fields precede
+// nested values.
+var dictionary = []string{
+	// addresses
+	"functionAddress", "callSiteAddress",
+
+	// metadata
+	"version", "device", "clientVersion", "agentVersion", "application",
+	"release", "macAddressHash", "publicIP", "id", "timestamp", "error",
+	"uptime", "boot", "clockUncertain", "session", "sequence",
+
+	// profiles, events, and datapoints
+	"tree", "nCalls", "nSamples", "callees", "exitStatus", "signal",
+	"stackTrace", "systemMetrics", "resourceUsage", "type", "payload",
+
+	// batches
+	"topic", "metadata", "items",
+
+	// system metrics and resource usage
+	"cpuUsage", "memoryUsage", "diskUsage", "loadAverage", "inboundNetwork",
+	"outboundNetwork", "thermalZones", "powerSupplies", "cpuInfo",
+	"networkInterfaces", "defaultInterface", "name", "state", "total",
+	"free", "usedPercent", "temperature", "status", "capacity", "online",
+	"maxRSS", "userTime", "systemTime", "minorPageFaults",
+	"majorPageFaults", "voluntaryContextSwitches",
+	"involuntaryContextSwitches", "blockInputOps", "blockOutputOps",
+	"processes", "pid", "rss", "threads", "openFiles", "readBytes",
+	"writeBytes",
+
+	// topics and values
+	"profiler", "events", "logs", "datapoints", "sessions",
+
+	// version 2
+	"schemaVersion",
+}
+
+var dictionaryIndex = func() map[string]int {
+	m := make(map[string]int, len(dictionary))
+	for i, s := range dictionary {
+		m[s] = i
+	}
+	return m
+}()
+
+// addressKeys are the fields encoded as addresses.
+var addressKeys = map[string]bool{
+	"functionAddress": true,
+	"callSiteAddress": true,
+}
+
+// compactMarshal encodes v in the compact encoding. Maps are encoded as
+// messages, beginning with CompactHeader.
+func compactMarshal(v interface{}) ([]byte, error) {
+	t, err := tree(v)
+	if err != nil {
+		return nil, err
+	}
+	var e compactEncoder
+	_, top := t.(map[string]interface{})
+	if top {
+		e.WriteByte(CompactHeader)
+		e.WriteByte(dictionaryVersion)
+	}
+	if err := e.value(t, 0, top); err != nil {
+		return nil, err
+	}
+	return e.Bytes(), nil
+}
+
+// tree returns v as a tree of maps, slices, strings, numbers, booleans, and
+// raw compact values.
+func tree(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case raw:
+		return v, nil
+	case map[string]raw:
+		m := make(map[string]interface{}, len(v))
+		for k, r := range v {
+			m[k] = r
+		}
+		return m, nil
+	case batch:
+		items := make([]interface{}, len(v.Items))
+		for i, item := range v.Items {
+			items[i], _ = tree(item)
+		}
+		metadata, _ := tree(v.Metadata)
+		return map[string]interface{}{
+			"topic":    string(v.Topic),
+			"metadata": metadata,
+			"items":    items,
+		}, nil
+	case string, bool, nil:
+		return v, nil
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10)), nil
+	case uint64:
+		return json.Number(strconv.FormatUint(v, 10)), nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var t interface{}
+	err = unmarshalLossless(b, &t)
+	return t, err
+}
+
+type compactEncoder struct {
+	bytes.Buffer
+}
+
+func (e *compactEncoder) uvarint(n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func (e *compactEncoder) varint(n int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], n)])
+}
+
+func (e *compactEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.WriteString(s)
+}
+
+// value encodes v, whose addresses are relative to base. The addresses of a
+// map other than the top one set the base of its nested values.
+func (e *compactEncoder) value(v interface{}, base int64, top bool) error {
+	switch v := v.(type) {
+	case nil:
+		e.WriteByte(cNull)
+	case bool:
+		if v {
+			e.WriteByte(cTrue)
+		} else {
+			e.WriteByte(cFalse)
+		}
+	case json.Number:
+		e.number(v)
+	case string:
+		if i, ok := dictionaryIndex[v]; ok {
+			e.WriteByte(cWord)
+			e.uvarint(uint64(i))
+			break
+		}
+		e.WriteByte(cString)
+		e.string(v)
+	case raw:
+		e.Write(v)
+	case []interface{}:
+		e.WriteByte(cArray)
+		e.uvarint(uint64(len(v)))
+		for _, x := range v {
+			if err := e.value(x, base, false); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		e.WriteByte(cMap)
+		e.uvarint(uint64(len(v)))
+		nested, found := base, false
+		for _, k := range sortedKeys(v) {
+			if i, ok := dictionaryIndex[k]; ok {
+				e.uvarint(uint64(i) + 1)
+			} else {
+				e.uvarint(0)
+				e.string(k)
+			}
+			if n, ok := v[k].(json.Number); ok && addressKeys[k] {
+				if a, err := n.Int64(); err == nil {
+					e.WriteByte(cAddress)
+					e.varint(a - base)
+					if !found && !top {
+						nested, found = a, true
+					}
+					continue
+				}
+			}
+			if err := e.value(v[k], nested, false); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("compact: cannot encode %T", v)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in dictionary order, followed by the
+// other keys in lexical order.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, aok := dictionaryIndex[keys[i]]
+		b, bok := dictionaryIndex[keys[j]]
+		switch {
+		case aok && bok:
+			return a < b
+		case aok != bok:
+			return aok
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// number encodes n in the smallest form that holds it exactly.
+func (e *compactEncoder) number(n json.Number) {
+	if i, err := n.Int64(); err == nil {
+		e.WriteByte(cInt)
+		e.varint(i)
+		return
+	}
+	f, err := n.Float64()
+	if err != nil || significantDigits(n.String()) > 15 {
+		e.WriteByte(cNumber)
+		e.string(n.String())
+		return
+	}
+	if f32 := float32(f); float64(f32) == f {
+		e.WriteByte(cFloat32)
+		binary.Write(e, binary.LittleEndian, math.Float32bits(f32))
+		return
+	}
+	e.WriteByte(cFloat64)
+	binary.Write(e, binary.LittleEndian, math.Float64bits(f))
+}
+
+// significantDigits returns the number of significant digits in the decimal
+// number s.
+func significantDigits(s string) int {
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.Trim(strings.Replace(strings.TrimLeft(s, "+-"), ".", "", 1), "0")
+	return len(s)
+}
+
+var errCompactSyntax = errors.New("compact: malformed message")
+
+// Expand decodes a message in the compact encoding, and returns it in the
+// standard JSON schema.
+func Expand(b []byte) ([]byte, error) {
+	if len(b) < 2 || b[0] != CompactHeader {
+		return nil, errors.New("compact: not a compact message")
+	}
+	// Earlier versions use a prefix of the dictionary.
+	if b[1] == 0 || b[1] > dictionaryVersion {
+		return nil, fmt.Errorf("compact: unknown dictionary version %v", b[1])
+	}
+	d := compactDecoder{bytes.NewReader(b[2:])}
+	v, err := d.value(0, true)
+	if err != nil {
+		return nil, err
+	}
+	if d.Len() != 0 {
+		return nil, errCompactSyntax
+	}
+	return json.Marshal(v)
+}
+
+type compactDecoder struct {
+	*bytes.Reader
+}
+
+// length reads a length, which cannot exceed the number of bytes left.
+func (d compactDecoder) length() (int, error) {
+	n, err := binary.ReadUvarint(d)
+	if err != nil || n > uint64(d.Len()) {
+		return 0, errCompactSyntax
+	}
+	return int(n), nil
+}
+
+func (d compactDecoder) string() (string, error) {
+	n, err := d.length()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = d.Read(b)
+	return string(b), err
+}
+
+func (d compactDecoder) word() (string, error) {
+	i, err := binary.ReadUvarint(d)
+	if err != nil || i >= uint64(len(dictionary)) {
+		return "", errCompactSyntax
+	}
+	return dictionary[i], nil
+}
+
+// value decodes a value whose addresses are relative to base, mirroring
+// compactEncoder.value.
+func (d compactDecoder) value(base int64, top bool) (interface{}, error) {
+	tag, err := d.ReadByte()
+	if err != nil {
+		return nil, errCompactSyntax
+	}
+	switch tag {
+	case cNull:
+		return nil, nil
+	case cFalse, cTrue:
+		return tag == cTrue, nil
+	case cInt:
+		i, err := binary.ReadVarint(d)
+		return json.Number(strconv.FormatInt(i, 10)), err
+	case cFloat32:
+		var bits uint32
+		err := binary.Read(d, binary.LittleEndian, &bits)
+		f := float64(math.Float32frombits(bits))
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 32)), err
+	case cFloat64:
+		var bits uint64
+		err := binary.Read(d, binary.LittleEndian, &bits)
+		f := math.Float64frombits(bits)
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), err
+	case cNumber:
+		s, err := d.string()
+		return json.Number(s), err
+	case cString:
+		return d.string()
+	case cWord:
+		return d.word()
+	case cArray:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = d.value(base, false); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case cMap:
+		n, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, n)
+		nested, found := base, false
+		for i := 0; i < n; i++ {
+			k, err := d.key()
+			if err != nil {
+				return nil, err
+			}
+			if b, _ := d.ReadByte(); b == cAddress {
+				offset, err := binary.ReadVarint(d)
+				if err != nil {
+					return nil, errCompactSyntax
+				}
+				a := base + offset
+				m[k] = json.Number(strconv.FormatInt(a, 10))
+				if !found && !top {
+					nested, found = a, true
+				}
+				continue
+			}
+			d.UnreadByte()
+			if m[k], err = d.value(nested, false); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("compact: unknown tag %v", tag)
+}
+
+func (d compactDecoder) key() (string, error) {
+	i, err := binary.ReadUvarint(d)
+	switch {
+	case err != nil:
+		return "", errCompactSyntax
+	case i == 0:
+		return d.string()
+	case i > uint64(len(dictionary)):
+		return "", errCompactSyntax
+	}
+	return dictionary[i-1], nil
+}
+
+// compactFields splits the compact message in data into its encoded values,
+// by key.
+func compactFields(data []byte) (map[string]raw, error) {
+	if len(data) < 2 || data[0] != CompactHeader {
+		return nil, errors.New("compact: not a compact message")
+	}
+	r := bytes.NewReader(data[2:])
+	d := compactDecoder{r}
+	if tag, err := d.ReadByte(); err != nil || tag != cMap {
+		return nil, errCompactSyntax
+	}
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	f := make(map[string]raw, n)
+	for i := 0; i < n; i++ {
+		k, err := d.key()
+		if err != nil {
+			return nil, err
+		}
+		start := len(data) - r.Len()
+		if _, err := d.value(0, false); err != nil {
+			return nil, err
+		}
+		f[k] = raw(data[start : len(data)-r.Len()])
+	}
+	return f, nil
+}
+
+// compactUnmarshal decodes the compact value or message in b into v, as
+// json.Unmarshal would decode its JSON form.
+func compactUnmarshal(b []byte, v interface{}) error {
+	top := len(b) > 0 && b[0] == CompactHeader
+	if top {
+		j, err := Expand(b)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(j, v)
+	}
+	d := compactDecoder{bytes.NewReader(b)}
+	t, err := d.value(0, false)
+	if err != nil {
+		return err
+	}
+	j, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
@@ -0,0 +1,154 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+)
+
+func TestParseEncoding(t *testing.T) {
+	cases := []struct {
+		name   string
+		expect Encoding
+		ok     bool
+	}{
+		{name: "", expect: MsgPack, ok: true},
+		{name: "msgpack", expect: MsgPack, ok: true},
+		{name: "json", expect: JSON, ok: true},
+		{name: "compact", expect: Compact, ok: true},
+		{name: "protobuf", expect: Protobuf, ok: true},
+		{name: "cbor", expect: CBOR, ok: true},
+		{name: "xml", ok: false},
+	}
+
+	for i, c := range cases {
+		got, err := ParseEncoding(c.name)
+		if ok := err == nil; ok != c.ok || got != c.expect {
+			t.Errorf("case %v: expected %v %v, got %v %v", i, c.expect, c.ok, got, ok)
+		}
+	}
+}
+
+// decodeJSON decodes b, keeping numbers as written.
+func decodeJSON(t *testing.T, b []byte) interface{} {
+	var v interface{}
+	if err := unmarshalLossless(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestCompact(t *testing.T) {
+	tree := `{"tree": {"functionAddress": 94558234567890, "callSiteAddress": 0, "nCalls": 1, "nSamples": 2, "callees": [
+		{"functionAddress": 94558234560000, "callSiteAddress": 94558234567900, "nCalls": 3, "nSamples": 4, "callees": [
+			{"functionAddress": 94558234590000, "callSiteAddress": 94558234560010, "nCalls": 5, "nSamples": 6, "callees": []}
+		]},
+		{"functionAddress": 140737488355328, "callSiteAddress": 94558234567920, "nCalls": 7, "nSamples": 8, "callees": []}
+	]}}`
+	trace := `{"stackTrace": [{"functionAddress": 94558234567890, "callSiteAddress": 94558234567900}, {"functionAddress": null, "callSiteAddress": 3}]}`
+	payload := `{"type": "reading", "payload": {
+		"temperature": 21.25, "ratio": 0.1, "pi": 3.14159265358979323846264,
+		"big": 123456789012345678901234567890, "negative": -42, "label": "datapoints",
+		"unit": "°C", "ok": true, "missing": null, "series": [1, 2.5, "x"]}}`
+
+	c := newConverter(cfg)
+	values := []struct {
+		v     interface{}
+		topic broker.Topic
+	}{
+		{c.profile([]byte(tree)), broker.Profile},
+		{c.errorSig([]byte(trace)), broker.Event},
+		{c.exit(), broker.Event},
+		{c.dataPoint([]byte(payload)), broker.DataPoint},
+	}
+
+	for i, v := range values {
+		c.Encoding = JSON
+		j := c.encode(v.v, v.topic)
+		c.Encoding = MsgPack
+		m := c.encode(v.v, v.topic)
+		c.Encoding = Compact
+		b := c.encode(v.v, v.topic)
+		if b.Error != "" {
+			t.Errorf("case %v: %v", i, b.Error)
+			continue
+		}
+		if len(b.Bytes) >= len(m.Bytes) {
+			t.Errorf("case %v: expected compact smaller than msgpack, got %v and %v bytes", i, len(b.Bytes), len(m.Bytes))
+		}
+
+		got, err := Expand(b.Bytes)
+		if err != nil {
+			t.Errorf("case %v: %v", i, err)
+			continue
+		}
+		if expect := decodeJSON(t, j.Bytes); !reflect.DeepEqual(decodeJSON(t, got), expect) {
+			t.Errorf("case %v: expected %s, got %s", i, j.Bytes, got)
+		}
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	c := newConverter(cfg)
+	c.Encoding = Compact
+	good := c.encode(c.exit(), broker.Event).Bytes
+	cases := [][]byte{
+		nil,
+		[]byte("{}"),
+		{CompactHeader, dictionaryVersion + 1, cMap, 0},
+		good[:len(good)-1],
+		append(append([]byte{}, good...), 0),
+		{CompactHeader, dictionaryVersion, cMap, 1, 0, 100},
+		{CompactHeader, dictionaryVersion, cWord, 200},
+		{CompactHeader, dictionaryVersion, 99},
+	}
+
+	for i, b := range cases {
+		if _, err := Expand(b); err == nil {
+			t.Errorf("case %v: expected error", i)
+		}
+	}
+}
+
+func TestCompactBatch(t *testing.T) {
+	tree := `{"tree": {"functionAddress": 1000, "callSiteAddress": 0, "nCalls": 1, "nSamples": 1, "callees": [
+		{"functionAddress": 1200, "callSiteAddress": 1010, "nCalls": 1, "nSamples": 1, "callees": []}]}}`
+	conf := cfg
+	conf.Encoding = Compact
+	c := newConverter(conf)
+	in := make(messages)
+	b := NewBatcher(BatchConfig{Count: 2, Window: time.Hour}, Compact, in)
+	go func() {
+		in <- c.marshal(c.profile([]byte(tree)), broker.Profile)
+		in <- c.marshal(c.profile([]byte(tree)), broker.Profile)
+		close(in)
+	}()
+
+	m := <-b.Output()
+	got, err := Expand(m.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch struct {
+		Topic    broker.Topic `json:"topic"`
+		Metadata struct {
+			Device string `json:"device"`
+		} `json:"metadata"`
+		Items []profile `json:"items"`
+	}
+	if err := json.Unmarshal(got, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Topic != broker.Profile || batch.Metadata.Device != "username" || len(batch.Items) != 2 {
+		t.Fatalf("unexpected batch %s", got)
+	}
+	for i, p := range batch.Items {
+		callee := p.Tree.Callees[0]
+		if *p.Tree.Fn != 1000 || *callee.Fn != 1200 || callee.Cs != 1010 {
+			t.Errorf("item %v: addresses changed: %s", i, got)
+		}
+	}
+}
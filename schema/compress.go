@@ -0,0 +1,181 @@
+package schema
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+)
+
+// Compression selects how message payloads are compressed.
+type Compression string
+
+// NoCompression, Gzip, and Zlib are Compressions. Zlib uses Dictionary.
+const (
+	NoCompression Compression = "none"
+	Gzip                      = "gzip"
+	Zlib                      = "zlib"
+)
+
+// ParseCompression returns the Compression named s. The empty string names
+// NoCompression. Zstandard is not supported, as it is not provided by the
+// standard library.
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case "":
+		return NoCompression, nil
+	case NoCompression, Gzip, Zlib:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown compression %q", s)
+}
+
+// A compressed payload starts with Compressed, which is never used in
+// MessagePack and cannot start JSON, followed by the ID of its codec.
+const (
+	Compressed byte = 0xc1
+	gzipID     byte = 1
+	zlibID     byte = 2
+)
+
+// Dictionary primes Zlib compression with strings common in profile trees
+// and message metadata. Consumers must decompress with the same bytes; the
+// zlib header identifies them by their Adler-32 checksum.
+var Dictionary = []byte("macAddressHashpublicIPclientVersionagentVersionapplicationreleasedeviceversiontimestampidsystemMetricsexitStatussignalstackTracetypepayloadtreecallSiteAddressfunctionAddressnSamplesnCallscallees")
+
+// compress returns b compressed with codec, preceded by its header.
+func compress(codec Compression, b []byte) ([]byte, error) {
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+		err error
+	)
+	buf.WriteByte(Compressed)
+	switch codec {
+	case Gzip:
+		buf.WriteByte(gzipID)
+		w = gzip.NewWriter(&buf)
+	case Zlib:
+		buf.WriteByte(zlibID)
+		w, err = zlib.NewWriterLevelDict(&buf, zlib.BestCompression, Dictionary)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return b, nil
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress returns the uncompressed payload of b. Payloads without a
+// compression header are returned unchanged.
+func Decompress(b []byte) ([]byte, error) {
+	if len(b) < 2 || b[0] != Compressed {
+		return b, nil
+	}
+	var (
+		r   io.ReadCloser
+		err error
+	)
+	switch body := bytes.NewReader(b[2:]); b[1] {
+	case gzipID:
+		r, err = gzip.NewReader(body)
+	case zlibID:
+		r, err = zlib.NewReaderDict(body, Dictionary)
+	default:
+		return nil, fmt.Errorf("unknown compression codec %v", b[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// CompressionStats report the bytes of payload a Compressor has received and
+// sent.
+type CompressionStats struct {
+	In  int64 `json:"in"`
+	Out int64 `json:"out"`
+}
+
+// Ratio returns the ratio of bytes received to bytes sent.
+func (s CompressionStats) Ratio() float64 {
+	if s.Out == 0 {
+		return 1
+	}
+	return float64(s.In) / float64(s.Out)
+}
+
+// Compressor compresses the payloads of messages. A payload that does not
+// shrink is sent uncompressed.
+type Compressor struct {
+	in    broker.MessageSource
+	out   chan broker.Message
+	codec Compression
+
+	mu    sync.Mutex
+	stats CompressionStats
+}
+
+// NewCompressor returns a Compressor of the messages from in.
+func NewCompressor(codec Compression, in broker.MessageSource) *Compressor {
+	c := &Compressor{
+		in:    in,
+		out:   make(chan broker.Message),
+		codec: codec,
+	}
+	go c.serve()
+	return c
+}
+
+// Output returns c's output stream.
+func (c *Compressor) Output() <-chan broker.Message { return c.out }
+
+// Stats returns the bytes c has received and sent so far.
+func (c *Compressor) Stats() CompressionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *Compressor) serve() {
+	defer close(c.out)
+	for m := range c.in.Output() {
+		if m.Error == "" {
+			m.Bytes = c.compress(m.Bytes)
+		}
+		c.out <- m
+	}
+	s := c.Stats()
+	log.Printf("compression: %v bytes sent as %v (ratio %.2f)", s.In, s.Out, s.Ratio())
+}
+
+func (c *Compressor) compress(b []byte) []byte {
+	z, err := compress(c.codec, b)
+	if err != nil {
+		errorlog.Printf("Compressor.compress: %v", err)
+		z = b
+	}
+	if len(z) >= len(b) {
+		z = b
+	}
+	c.mu.Lock()
+	c.stats.In += int64(len(b))
+	c.stats.Out += int64(len(z))
+	c.mu.Unlock()
+	return z
+}
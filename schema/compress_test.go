@@ -0,0 +1,91 @@
+package schema
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+)
+
+func TestParseCompression(t *testing.T) {
+	cases := []struct {
+		name   string
+		expect Compression
+		ok     bool
+	}{
+		{name: "", expect: NoCompression, ok: true},
+		{name: "gzip", expect: Gzip, ok: true},
+		{name: "zlib", expect: Zlib, ok: true},
+		{name: "zstd", ok: false},
+	}
+
+	for i, c := range cases {
+		got, err := ParseCompression(c.name)
+		if ok := err == nil; ok != c.ok || got != c.expect {
+			t.Errorf("case %v: expected %v %v, got %v %v", i, c.expect, c.ok, got, ok)
+		}
+	}
+}
+
+// profileMessage returns an encoded profile with a tree of n nodes.
+func profileMessage(n int) broker.Message {
+	node := `{"functionAddress": 1, "callSiteAddress": 2, "nCalls": 3, "nSamples": 4, "callees": []}`
+	tree := `{"tree": {"functionAddress": 0, "callSiteAddress": 0, "callees": [` +
+		strings.Repeat(node+",", n-1) + node + `]}}`
+	c := newConverter(Config{App: app{}})
+	return c.marshal(c.profile([]byte(tree)), broker.Profile)
+}
+
+func TestCompressor(t *testing.T) {
+	cases := []struct {
+		codec  Compression
+		input  broker.Message
+		shrink bool
+	}{
+		{codec: Gzip, input: profileMessage(50), shrink: true},
+		{codec: Zlib, input: profileMessage(50), shrink: true},
+		{codec: NoCompression, input: profileMessage(50), shrink: false},
+		{codec: Zlib, input: broker.Message{Topic: broker.Log, Bytes: []byte("{}")}, shrink: false},
+	}
+
+	for i, c := range cases {
+		in := make(messages)
+		go func() {
+			in <- c.input
+			close(in)
+		}()
+		comp := NewCompressor(c.codec, in)
+		m := <-comp.Output()
+		for range comp.Output() {
+		}
+
+		if shrunk := len(m.Bytes) < len(c.input.Bytes); shrunk != c.shrink {
+			t.Errorf("case %v: expected shrink %v, got %v -> %v bytes", i, c.shrink, len(c.input.Bytes), len(m.Bytes))
+		}
+		got, err := Decompress(m.Bytes)
+		if err != nil {
+			t.Errorf("case %v: %v", i, err)
+		}
+		if !bytes.Equal(got, c.input.Bytes) {
+			t.Errorf("case %v: payload changed", i)
+		}
+		s := comp.Stats()
+		if s.In != int64(len(c.input.Bytes)) || s.Out != int64(len(m.Bytes)) {
+			t.Errorf("case %v: unexpected stats %+v", i, s)
+		}
+	}
+}
+
+func TestDictionary(t *testing.T) {
+	// The dictionary should help compress small profiles.
+	m := profileMessage(2)
+	gz, _ := compress(Gzip, m.Bytes)
+	z, _ := compress(Zlib, m.Bytes)
+	if len(z) >= len(gz) {
+		t.Errorf("expected zlib with dictionary to beat gzip, got %v and %v bytes", len(z), len(gz))
+	}
+	if _, err := Decompress([]byte{Compressed, 9}); err == nil {
+		t.Error("expected error for unknown codec")
+	}
+}
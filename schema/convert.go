@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"time"
 
 	"github.com/vmihailenco/msgpack"
 
@@ -28,6 +29,7 @@ type ExitSignalApp interface {
 	CheckSum() string
 	ExitStatus() int
 	Signal() string
+	Usage() device.Usage
 }
 
 // MessageSource is a source of agent messages.
@@ -46,27 +48,77 @@ type Monitor interface {
 	Close()
 }
 
+// IPProvider provides the device's public IP address.
+type IPProvider interface {
+	IP() string
+}
+
 // Config provides parameters needed by a Converter.
 type Config struct {
 	Monitor     Monitor
 	Persistor   Persistor
+	IP          IPProvider // if nil, no public IP address is reported
 	App         ExitSignalApp
 	Username    string
 	UserVersion string
 	AppID       string
 	MacHash     string
 	Encoding    Encoding
+
+	// Session, if not nil, replaces the metadata shared by messages with
+	// a session ID.
+	Session *Session
+
+	// Sequences, if not nil, numbers the messages on each topic.
+	Sequences *Sequences
+
+	// Clock, if not nil, stamps messages with their time since boot, and
+	// flags those stamped before the wall clock was set. When it is set,
+	// stored messages of this boot are corrected.
+	Clock *Clock
 }
 
 // Encoding represents the serialization encoding.
 type Encoding int
 
-// These are the available encodings.
+// These are the available encodings. Compact is for low-bandwidth links; see
+// Expand. Protobuf messages are described by auklet.proto.
 const (
 	MsgPack Encoding = iota
 	JSON
+	Compact
+	Protobuf
+	CBOR
 )
 
+var encodingNames = map[Encoding]string{
+	MsgPack:  "msgpack",
+	JSON:     "json",
+	Compact:  "compact",
+	Protobuf: "protobuf",
+	CBOR:     "cbor",
+}
+
+// String returns the name of e, which is given to consumers as the encoding
+// of its messages.
+func (e Encoding) String() string {
+	return encodingNames[e]
+}
+
+// ParseEncoding returns the Encoding named s: msgpack, json, compact,
+// protobuf, or cbor. The empty string names MsgPack.
+func ParseEncoding(s string) (Encoding, error) {
+	if s == "" {
+		return MsgPack, nil
+	}
+	for e, name := range encodingNames {
+		if s == name {
+			return e, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encoding %q", s)
+}
+
 // NewConverter returns a converter for the given input streams that uses the
 // given persistor and app.
 func NewConverter(cfg Config, in ...agent.MessageSource) Converter {
@@ -91,30 +143,68 @@ func (c Converter) Output() <-chan broker.Message {
 func (c Converter) serve() {
 	defer close(c.out)
 	defer c.Monitor.Close()
-	for agentMsg := range c.in.Output() {
-		switch agentMsg.Type {
-		case "applog", "log":
-			// Drop these messages for now, because consumers do not handle them.
-			continue
-		}
-
-		brokerMsg := c.convert(agentMsg)
-		if c.Persistor != nil {
-			if err := c.Persistor.CreateMessage(&brokerMsg); err != nil {
-				// Let the backend know we ran out of local storage.
-				c.out <- broker.Message{
-					Error: err.Error(),
-					Topic: broker.Log,
-				}
-				errorlog.Printf("Converter.serve: %v", err)
+	if c.Sequences != nil {
+		defer c.Sequences.Close()
+	}
+	ticker := time.NewTicker(clockCheck)
+	defer ticker.Stop()
+	c.startSession()
+	in := c.in.Output()
+	for {
+		select {
+		case agentMsg, ok := <-in:
+			if !ok {
+				return
+			}
+			switch agentMsg.Type {
+			case "applog", "log":
+				// Drop these messages for now, because consumers do not handle them.
 				continue
 			}
+
+			c.checkClock()
+			c.startSession()
+			c.emit(c.convert(agentMsg))
+		case <-ticker.C:
+			c.checkClock()
 		}
+	}
+}
 
-		c.out <- brokerMsg
+// startSession emits a session record if a new session has begun, or if
+// the record of the current session could not be persisted. The record is
+// published once it is persisted, since it is then sent until it reaches
+// the broker.
+func (c Converter) startSession() {
+	if c.Session == nil {
+		return
+	}
+	if rec, ok := c.record(c.metadata()); ok {
+		if c.Session.published = c.emit(rec); c.Session.published {
+			log.Printf("session %v started", c.Session.id)
+		}
 	}
 }
 
+// emit persists brokerMsg and sends it. It reports whether brokerMsg was
+// sent.
+func (c Converter) emit(brokerMsg broker.Message) bool {
+	if c.Persistor != nil {
+		if err := c.Persistor.CreateMessage(&brokerMsg); err != nil {
+			// Let the backend know we ran out of local storage.
+			c.out <- broker.Message{
+				Error: err.Error(),
+				Topic: broker.Log,
+			}
+			errorlog.Printf("Converter.serve: %v", err)
+			return false
+		}
+	}
+
+	c.out <- brokerMsg
+	return true
+}
+
 func (c Converter) convert(m agent.Message) broker.Message {
 	switch m.Type {
 	case "profile":
@@ -152,14 +242,55 @@ func msgpackMarshal(v interface{}) ([]byte, error) {
 	return buf.Bytes(), err
 }
 
+// marshal encodes v as a message on topic, replacing its metadata with that
+// of c's session, if any, and numbering it, if c numbers messages.
 func (c Converter) marshal(v interface{}, topic broker.Topic) broker.Message {
+	m := c.encode(v, topic)
+	compact := c.Session != nil && topic != broker.Session
+	if m.Error != "" || !compact && c.Sequences == nil {
+		return m
+	}
+	f, err := c.Encoding.fields(m.Bytes)
+	if err != nil {
+		errorlog.Printf("Converter.marshal: %v", err)
+		return m
+	}
+	if compact {
+		if err := c.compact(f); err != nil {
+			errorlog.Printf("Converter.marshal: %v", err)
+			return m
+		}
+	}
+	if c.Sequences != nil {
+		// The number is used even if marshaling fails, so that the
+		// backend sees a gap.
+		m.Sequence = c.Sequences.next(topic)
+		if f["sequence"], err = c.Encoding.encodeField("sequence", m.Sequence); err != nil {
+			errorlog.Printf("Converter.marshal: %v", err)
+			return m
+		}
+	}
+	b, err := c.Encoding.marshal(f)
+	if err != nil {
+		errorlog.Printf("Converter.marshal: %v", err)
+		return m
+	}
+	m.Bytes = b
+	return m
+}
+
+// encode encodes v as a message on topic.
+func (c Converter) encode(v interface{}, topic broker.Topic) broker.Message {
 	marshaler := map[Encoding]func(interface{}) ([]byte, error){
-		MsgPack: msgpackMarshal,
-		JSON:    json.Marshal,
+		MsgPack:  msgpackMarshal,
+		JSON:     json.Marshal,
+		Compact:  compactMarshal,
+		Protobuf: protoMarshal,
+		CBOR:     cborMarshal,
 	}[c.Encoding]
 	bytes, err := marshaler(v)
 	if err != nil {
-		errorlog.Printf("Converter.marshal: %v", err)
+		errorlog.Printf("Converter.encode: %v", err)
 	}
 	return broker.Message{
 		Error: func() string {
@@ -168,8 +299,9 @@ func (c Converter) marshal(v interface{}, topic broker.Topic) broker.Message {
 			}
 			return ""
 		}(),
-		Bytes: bytes,
-		Topic: topic,
+		Bytes:    bytes,
+		Topic:    topic,
+		Encoding: c.Encoding.String(),
 	}
 }
 
@@ -25,15 +25,21 @@ func (app) CheckSum() string     { return "checksum" }
 func (app) ExitStatus() int      { return 42 }
 func (app) Signal() string       { return "something" }
 func (app) AgentVersion() string { return "something" }
+func (app) Usage() device.Usage  { return device.Usage{} }
 
 type monitor struct{}
 
 func (monitor) GetMetrics() device.Metrics { return device.Metrics{} }
 func (monitor) Close()                     {}
 
+type ip string
+
+func (i ip) IP() string { return string(i) }
+
 var cfg = Config{
 	Monitor:     monitor{},
 	Persistor:   persistor{},
+	IP:          ip("1.2.3.4"),
 	App:         app{},
 	Username:    "username",
 	UserVersion: "userVersion",
@@ -197,6 +203,19 @@ func from(data string) numberTest {
 	}
 }
 
+func TestPublicIP(t *testing.T) {
+	c := newConverter(cfg)
+	if got := c.metadata().IP; got != "1.2.3.4" {
+		t.Errorf("expected 1.2.3.4, got %q", got)
+	}
+	noIP := cfg
+	noIP.IP = nil
+	c = newConverter(noIP)
+	if got := c.metadata().IP; got != "" {
+		t.Errorf("expected no IP, got %q", got)
+	}
+}
+
 var numberTests = []numberTest{
 	{
 		number: "1",
@@ -0,0 +1,249 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// samples returns a message of each kind, with fixed metadata.
+func samples(t *testing.T) []struct {
+	name  string
+	v     interface{}
+	topic broker.Topic
+} {
+	tree := `{"tree": {"functionAddress": 94558234567890, "callSiteAddress": 0, "nCalls": 1, "nSamples": 2, "callees": [
+		{"functionAddress": 94558234560000, "callSiteAddress": 94558234567900, "nCalls": 3, "nSamples": 4, "callees": []}
+	]}}`
+	trace := `{"stackTrace": [{"functionAddress": 94558234567890, "callSiteAddress": 94558234567900}, {"functionAddress": null, "callSiteAddress": 3}]}`
+	payload := `{"type": "reading", "payload": {
+		"temperature": 21.25, "ratio": 0.1, "pi": 3.14159265358979323846264,
+		"big": 123456789012345678901234567890, "negative": -42, "label": "datapoints",
+		"unit": "°C", "ok": true, "missing": null, "series": [1, 2.5, "x"]}}`
+
+	c := newConverter(cfg)
+	md := c.metadata()
+	md.UUID = "3f1e6a52-8d0c-4b7e-9a61-2f5c7d9e0b14"
+	md.Time = 1540000000000
+	md.ClientVersion = "1.0.0"
+
+	p := c.profile([]byte(tree))
+	p.metadata = md
+	e := c.errorSig([]byte(trace))
+	e.metadata = md
+	x := c.exit()
+	x.metadata = md
+	d := c.dataPoint([]byte(payload))
+	d.metadata = md
+	for _, v := range []metadata{p.metadata, e.metadata, d.metadata} {
+		if v.Error != "" {
+			t.Fatal(v.Error)
+		}
+	}
+
+	return []struct {
+		name  string
+		v     interface{}
+		topic broker.Topic
+	}{
+		{"profile", p, broker.Profile},
+		{"errorSig", e, broker.Event},
+		{"exit", x, broker.Event},
+		{"dataPoint", d, broker.DataPoint},
+	}
+}
+
+// normalize returns the tree v with its numbers as exact fractions, or, if
+// lossy, as float64s, and without top-level nulls.
+func normalize(v interface{}, lossy, top bool) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if lossy {
+			f, _ := v.Float64()
+			return f
+		}
+		r, _ := new(big.Rat).SetString(v.String())
+		return r.RatString()
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, x := range v {
+			a[i] = normalize(x, lossy, false)
+		}
+		return a
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			if x == nil && top {
+				continue
+			}
+			m[k] = normalize(x, lossy, false)
+		}
+		return m
+	}
+	return v
+}
+
+// golden compares b with the golden file name, or updates the file if the
+// -update flag is given.
+func golden(t *testing.T, name string, b []byte) {
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expect, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, expect) {
+		t.Errorf("%v: expected % x, got % x", name, expect, b)
+	}
+}
+
+// testEncoding checks that the samples round-trip through enc, whose
+// messages decode decodes to JSON, and match their golden files.
+func testEncoding(t *testing.T, enc Encoding, ext string, lossy bool, decode func([]byte) ([]byte, error)) {
+	c := newConverter(cfg)
+	for _, s := range samples(t) {
+		c.Encoding = JSON
+		j := c.encode(s.v, s.topic)
+		c.Encoding = enc
+		m := c.encode(s.v, s.topic)
+		if m.Error != "" {
+			t.Errorf("%v: %v", s.name, m.Error)
+			continue
+		}
+		if m.Encoding != enc.String() {
+			t.Errorf("%v: expected encoding %v, got %v", s.name, enc, m.Encoding)
+		}
+		golden(t, s.name+ext, m.Bytes)
+
+		got, err := decode(m.Bytes)
+		if err != nil {
+			t.Errorf("%v: %v", s.name, err)
+			continue
+		}
+		expect := normalize(decodeJSON(t, j.Bytes), lossy, true)
+		if !reflect.DeepEqual(normalize(decodeJSON(t, got), lossy, true), expect) {
+			t.Errorf("%v: expected %s, got %s", s.name, j.Bytes, got)
+		}
+	}
+}
+
+func protoJSON(b []byte) ([]byte, error) {
+	m, err := protoRecord.decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+func TestProtobuf(t *testing.T) {
+	// google.protobuf.Value holds numbers as doubles.
+	testEncoding(t, Protobuf, ".pb", true, protoJSON)
+}
+
+func TestCBOR(t *testing.T) {
+	testEncoding(t, CBOR, ".cbor", false, cborJSON)
+}
+
+func TestEncodeFields(t *testing.T) {
+	c := newConverter(cfg)
+	for _, enc := range []Encoding{MsgPack, JSON, Compact, Protobuf, CBOR} {
+		c.Encoding = enc
+		m := c.encode(c.exit(), broker.Event)
+		f, err := enc.fields(m.Bytes)
+		if err != nil {
+			t.Errorf("%v: %v", enc, err)
+			continue
+		}
+		if f["sequence"], err = enc.encodeField("sequence", uint64(7)); err != nil {
+			t.Errorf("%v: %v", enc, err)
+			continue
+		}
+		b, err := enc.marshal(f)
+		if err != nil {
+			t.Errorf("%v: %v", enc, err)
+			continue
+		}
+		if f, err = enc.fields(b); err != nil {
+			t.Errorf("%v: %v", enc, err)
+			continue
+		}
+		var seq uint64
+		var signal string
+		if err := enc.decodeField("sequence", f["sequence"], &seq); err != nil || seq != 7 {
+			t.Errorf("%v: expected sequence 7, got %v %v", enc, seq, err)
+		}
+		if err := enc.decodeField("signal", f["signal"], &signal); err != nil || signal != "something" {
+			t.Errorf("%v: expected signal something, got %q %v", enc, signal, err)
+		}
+	}
+}
+
+func TestProtobufBatch(t *testing.T) {
+	conf := cfg
+	conf.Encoding = Protobuf
+	c := newConverter(conf)
+	in := make(messages)
+	b := NewBatcher(BatchConfig{Count: 2, Window: time.Hour}, Protobuf, in)
+	go func() {
+		for i := 0; i < 2; i++ {
+			in <- c.marshal(c.dataPoint([]byte(`{"type": "reading", "payload": 1}`)), broker.DataPoint)
+		}
+		close(in)
+	}()
+
+	m := <-b.Output()
+	if m.Encoding != "protobuf" {
+		t.Errorf("expected encoding protobuf, got %v", m.Encoding)
+	}
+	batch, err := protoBatch.decode(m.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, _ := batch["items"].([]interface{})
+	meta, _ := batch["metadata"].(map[string]interface{})
+	if batch["topic"] != string(broker.DataPoint) || meta["device"] != "username" || len(items) != 2 {
+		t.Fatalf("unexpected batch %v", batch)
+	}
+	for i, item := range items {
+		if typ := item.(map[string]interface{})["type"]; typ != "reading" {
+			t.Errorf("item %v: expected type reading, got %v", i, typ)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	cases := []struct {
+		enc  Encoding
+		data []byte
+	}{
+		{Protobuf, []byte{0x0a, 5, 'a'}},
+		{Protobuf, []byte{0x80}},
+		{Protobuf, []byte{0x0b}},
+		{CBOR, nil},
+		{CBOR, []byte{0x81, 0x01}},
+		{CBOR, []byte{0xa1, 0x01, 0x01}},
+		{CBOR, []byte{0xa1, 0x61}},
+		{CBOR, []byte{0xbf}},
+	}
+
+	for i, c := range cases {
+		if _, err := c.enc.fields(c.data); err == nil {
+			t.Errorf("case %v: expected error", i)
+		}
+	}
+}
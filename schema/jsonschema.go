@@ -0,0 +1,207 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// messageTypes lists the payloads of broker messages, by kind.
+var messageTypes = []struct {
+	kind string
+	v    interface{}
+}{
+	{"profile", profile{}},
+	{"errorSig", errorSig{}},
+	{"exit", exit{}},
+	{"dataPoint", dataPoint{}},
+	{"session", sessionRecord{}},
+}
+
+// JSONSchemas returns the JSON Schema (draft-07) of each kind of message, in
+// the JSON form of the current SchemaVersion. Messages other than session
+// records may omit the metadata given in their session's record.
+func JSONSchemas() (map[string][]byte, error) {
+	schemas := make(map[string][]byte, len(messageTypes))
+	for _, m := range messageTypes {
+		g := schemaGen{defs: make(map[string]jsonSchema)}
+		s, err := g.object(reflect.TypeOf(m.v))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", m.kind, err)
+		}
+
+		props := s["properties"].(jsonSchema)
+		props["schemaVersion"] = jsonSchema{"const": SchemaVersion}
+		props["sequence"] = jsonSchema{"type": "integer", "minimum": 0}
+		if m.kind != "session" {
+			props["session"] = jsonSchema{"type": "string"}
+			s["required"] = without(s["required"].([]string), shared)
+		}
+
+		s["$schema"] = "http://json-schema.org/draft-07/schema#"
+		s["title"] = m.kind
+		if len(g.defs) > 0 {
+			s["definitions"] = g.defs
+		}
+		b, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		schemas[m.kind] = append(b, '\n')
+	}
+	return schemas, nil
+}
+
+// without returns the strings in a that are not in b.
+func without(a, b []string) []string {
+	c := []string{}
+outer:
+	for _, s := range a {
+		for _, t := range b {
+			if s == t {
+				continue outer
+			}
+		}
+		c = append(c, s)
+	}
+	return c
+}
+
+type jsonSchema map[string]interface{}
+
+// schemaGen generates JSON Schemas from Go types as encoding/json encodes
+// them. Named struct types other than the message are given in defs.
+type schemaGen struct {
+	defs map[string]jsonSchema
+}
+
+var (
+	numberType = reflect.TypeOf(json.Number(""))
+	rawType    = reflect.TypeOf(raw(nil))
+)
+
+func (g schemaGen) schema(t reflect.Type) (jsonSchema, error) {
+	switch t {
+	case numberType:
+		return jsonSchema{"type": "number"}, nil
+	case rawType:
+		return jsonSchema{}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return jsonSchema{"type": "integer"}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer", "minimum": 0}, nil
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}, nil
+	case reflect.String:
+		return jsonSchema{"type": "string"}, nil
+	case reflect.Interface:
+		return jsonSchema{}, nil
+	case reflect.Ptr:
+		s, err := g.schema(t.Elem())
+		return nullable(s), err
+	case reflect.Slice:
+		items, err := g.schema(t.Elem())
+		return jsonSchema{"type": []string{"array", "null"}, "items": items}, err
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			break
+		}
+		values, err := g.schema(t.Elem())
+		return jsonSchema{"type": []string{"object", "null"}, "additionalProperties": values}, err
+	case reflect.Struct:
+		ref := jsonSchema{"$ref": "#/definitions/" + t.Name()}
+		if _, ok := g.defs[t.Name()]; ok {
+			return ref, nil
+		}
+		g.defs[t.Name()] = nil // for recursive types
+		s, err := g.object(t)
+		g.defs[t.Name()] = s
+		return ref, err
+	}
+	return nil, fmt.Errorf("cannot describe %v", t)
+}
+
+// nullable returns s, allowing null.
+func nullable(s jsonSchema) jsonSchema {
+	switch typ := s["type"].(type) {
+	case string:
+		n := jsonSchema{"type": []string{typ, "null"}}
+		for k, v := range s {
+			if k != "type" {
+				n[k] = v
+			}
+		}
+		return n
+	case []string:
+		return s
+	}
+	if len(s) == 0 {
+		return s
+	}
+	return jsonSchema{"oneOf": []jsonSchema{s, {"type": "null"}}}
+}
+
+// object returns the schema of the struct type t. Fields without omitempty
+// are required, and no others are allowed.
+func (g schemaGen) object(t reflect.Type) (jsonSchema, error) {
+	props := make(jsonSchema)
+	required := []string{}
+	if err := g.fields(t, props, &required); err != nil {
+		return nil, err
+	}
+	return jsonSchema{
+		"type":                 "object",
+		"properties":           props,
+		"required":             required,
+		"additionalProperties": false,
+	}, nil
+}
+
+func (g schemaGen) fields(t reflect.Type, props jsonSchema, required *[]string) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			// The fields of embedded structs are promoted.
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if err := g.fields(ft, props, required); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s, err := g.schema(f.Type)
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+		props[name] = s
+		omitempty := false
+		for _, opt := range tag[1:] {
+			omitempty = omitempty || opt == "omitempty"
+		}
+		if !omitempty {
+			*required = append(*required, name)
+		}
+	}
+	return nil
+}
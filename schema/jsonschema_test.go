@@ -0,0 +1,215 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+)
+
+// TestSchemaVersion fails if the schema of a message changes without a new
+// SchemaVersion. The schemas of each version are kept in testdata, and are
+// only written by -update for a version that has none.
+func TestSchemaVersion(t *testing.T) {
+	schemas, err := JSONSchemas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join("testdata", "schema", fmt.Sprintf("v%v", SchemaVersion))
+	for kind, s := range schemas {
+		path := filepath.Join(dir, kind+".json")
+		expect, err := ioutil.ReadFile(path)
+		switch {
+		case os.IsNotExist(err) && *update:
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, s, 0644); err != nil {
+				t.Fatal(err)
+			}
+		case err != nil:
+			t.Errorf("%v: %v", kind, err)
+		case !bytes.Equal(s, expect):
+			t.Errorf("%v changed without a new SchemaVersion: expected %s, got %s", kind, expect, s)
+		}
+	}
+}
+
+func TestSchemaSamples(t *testing.T) {
+	schemas, err := JSONSchemas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConverter(cfg)
+	c.Encoding = JSON
+	c.Session = NewSession()
+	record := sessionRecord{metadata: c.metadata(), Session: "session"}
+	values := append(samples(t), struct {
+		name  string
+		v     interface{}
+		topic broker.Topic
+	}{"session", record, broker.Session})
+
+	for _, v := range values {
+		var s jsonSchema
+		if err := json.Unmarshal(schemas[v.name], &s); err != nil {
+			t.Fatal(err)
+		}
+		m := c.encode(v.v, v.topic)
+		if err := validate(s, s, decodeJSON(t, m.Bytes)); err != nil {
+			t.Errorf("%v: %v in %s", v.name, err, m.Bytes)
+		}
+		if v.topic == broker.Session {
+			continue
+		}
+
+		// as sent with session and sequence number
+		f, err := JSON.fields(m.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.compact(f); err != nil {
+			t.Fatal(err)
+		}
+		f["sequence"], _ = JSON.encodeField("sequence", uint64(1))
+		b, _ := JSON.marshal(f)
+		if err := validate(s, s, decodeJSON(t, b)); err != nil {
+			t.Errorf("%v: %v in %s", v.name, err, b)
+		}
+	}
+}
+
+func TestSchemaRejects(t *testing.T) {
+	schemas, err := JSONSchemas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s jsonSchema
+	if err := json.Unmarshal(schemas["exit"], &s); err != nil {
+		t.Fatal(err)
+	}
+	c := newConverter(cfg)
+	c.Encoding = JSON
+	m := c.encode(c.exit(), broker.Event)
+	cases := []struct {
+		old, new string
+	}{
+		{`"exitStatus"`, `"exitCode"`},
+		{`"schemaVersion":1`, `"schemaVersion":2`},
+		{`"signal":"something"`, `"signal":3`},
+	}
+
+	for i, x := range cases {
+		b := strings.Replace(string(m.Bytes), x.old, x.new, 1)
+		if err := validate(s, s, decodeJSON(t, []byte(b))); err == nil {
+			t.Errorf("case %v: expected error for %s", i, b)
+		}
+	}
+}
+
+// validate checks v against s, supporting the keywords used by JSONSchemas.
+// References are resolved in root.
+func validate(root, s map[string]interface{}, v interface{}) error {
+	if ref, ok := s["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/definitions/")
+		def, _ := root["definitions"].(map[string]interface{})[name].(map[string]interface{})
+		return validate(root, def, v)
+	}
+	if alts, ok := s["oneOf"].([]interface{}); ok {
+		n := 0
+		for _, alt := range alts {
+			if validate(root, alt.(map[string]interface{}), v) == nil {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("%v matches %v alternatives", v, n)
+		}
+		return nil
+	}
+	if c, ok := s["const"]; ok && fmt.Sprint(c) != fmt.Sprint(v) {
+		return fmt.Errorf("expected %v, got %v", c, v)
+	}
+	if typ, ok := s["type"]; ok {
+		types, ok := typ.([]interface{})
+		if !ok {
+			types = []interface{}{typ}
+		}
+		match := false
+		for _, t := range types {
+			match = match || jsonType(v, t.(string))
+		}
+		if !match {
+			return fmt.Errorf("%v is not of type %v", v, typ)
+		}
+	}
+	if min, ok := s["minimum"].(float64); ok {
+		if n, ok := v.(json.Number); ok {
+			if f, _ := n.Float64(); f < min {
+				return fmt.Errorf("%v is less than %v", v, min)
+			}
+		}
+	}
+
+	switch v := v.(type) {
+	case []interface{}:
+		items, _ := s["items"].(map[string]interface{})
+		for i, x := range v {
+			if err := validate(root, items, x); err != nil {
+				return fmt.Errorf("%v: %v", i, err)
+			}
+		}
+	case map[string]interface{}:
+		props, _ := s["properties"].(map[string]interface{})
+		required, _ := s["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := v[name.(string)]; !ok {
+				return fmt.Errorf("%v is required", name)
+			}
+		}
+		for name, x := range v {
+			p, ok := props[name].(map[string]interface{})
+			if !ok {
+				switch extra := s["additionalProperties"].(type) {
+				case bool:
+					if !extra {
+						return fmt.Errorf("%v is not allowed", name)
+					}
+					continue
+				case map[string]interface{}:
+					p = extra
+				default:
+					continue
+				}
+			}
+			if err := validate(root, p, x); err != nil {
+				return fmt.Errorf("%v: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func jsonType(v interface{}, typ string) bool {
+	switch v := v.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case string:
+		return typ == "string"
+	case json.Number:
+		return typ == "number" || typ == "integer" && !strings.ContainsAny(v.String(), ".eE")
+	case []interface{}:
+		return typ == "array"
+	case map[string]interface{}:
+		return typ == "object"
+	}
+	return false
+}
@@ -0,0 +1,645 @@
+package schema
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// This file implements the protobuf encoding of the messages described by
+// auklet.proto. Messages are encoded from the same trees as the compact
+// encoding, guided by descriptors of the messages that mirror auklet.proto.
+// Fields are written in order of their numbers, with zero values written
+// explicitly, and null fields omitted.
+
+type protoKind int
+
+const (
+	pString protoKind = iota
+	pInt64
+	pUint64
+	pBool
+	pMessage // described by protoField.msg
+	pValue   // google.protobuf.Value
+	pStruct  // google.protobuf.Struct
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type protoField struct {
+	name     string
+	num      int
+	kind     protoKind
+	repeated bool
+	msg      *protoMessage
+}
+
+// protoMessage describes a protobuf message.
+type protoMessage struct {
+	byName map[string]protoField
+	byNum  map[int]protoField
+
+	// defaults is whether absent fields decode as their default values,
+	// and absent optional fields as null. Absent fields of top-level
+	// messages are left out, as they are in compact messages.
+	defaults bool
+	optional map[string]bool
+}
+
+func newProtoMessage(defaults bool, fields ...protoField) *protoMessage {
+	m := &protoMessage{
+		byName:   make(map[string]protoField),
+		byNum:    make(map[int]protoField),
+		defaults: defaults,
+		optional: make(map[string]bool),
+	}
+	for _, f := range fields {
+		m.add(f)
+	}
+	return m
+}
+
+func (m *protoMessage) add(f protoField) {
+	m.byName[f.name] = f
+	m.byNum[f.num] = f
+}
+
+var (
+	protoNode = newProtoMessage(true,
+		protoField{name: "functionAddress", num: 1, kind: pInt64},
+		protoField{name: "callSiteAddress", num: 2, kind: pInt64},
+		protoField{name: "nCalls", num: 3, kind: pInt64},
+		protoField{name: "nSamples", num: 4, kind: pInt64},
+	)
+	protoFrame = newProtoMessage(true,
+		protoField{name: "functionAddress", num: 1, kind: pInt64},
+		protoField{name: "callSiteAddress", num: 2, kind: pInt64},
+	)
+
+	// protoRecord describes Record, which has the fields of all messages
+	// but Batch.
+	protoRecord = newProtoMessage(false,
+		protoField{name: "version", num: 1, kind: pString},
+		protoField{name: "device", num: 2, kind: pString},
+		protoField{name: "clientVersion", num: 3, kind: pString},
+		protoField{name: "agentVersion", num: 4, kind: pString},
+		protoField{name: "application", num: 5, kind: pString},
+		protoField{name: "release", num: 6, kind: pString},
+		protoField{name: "macAddressHash", num: 7, kind: pString},
+		protoField{name: "publicIP", num: 8, kind: pString},
+		protoField{name: "id", num: 9, kind: pString},
+		protoField{name: "timestamp", num: 10, kind: pInt64},
+		protoField{name: "error", num: 11, kind: pString},
+		protoField{name: "uptime", num: 12, kind: pInt64},
+		protoField{name: "boot", num: 13, kind: pString},
+		protoField{name: "clockUncertain", num: 14, kind: pBool},
+		protoField{name: "session", num: 15, kind: pString},
+		protoField{name: "sequence", num: 16, kind: pUint64},
+		protoField{name: "schemaVersion", num: 17, kind: pInt64},
+		protoField{name: "tree", num: 20, kind: pMessage, msg: protoNode},
+		protoField{name: "exitStatus", num: 21, kind: pInt64},
+		protoField{name: "signal", num: 22, kind: pString},
+		protoField{name: "stackTrace", num: 23, kind: pMessage, msg: protoFrame, repeated: true},
+		protoField{name: "systemMetrics", num: 24, kind: pStruct},
+		protoField{name: "resourceUsage", num: 25, kind: pStruct},
+		protoField{name: "type", num: 26, kind: pString},
+		protoField{name: "payload", num: 27, kind: pValue},
+	)
+
+	protoBatch = newProtoMessage(false,
+		protoField{name: "topic", num: 1, kind: pString},
+		protoField{name: "metadata", num: 2, kind: pMessage, msg: protoRecord},
+		protoField{name: "items", num: 3, kind: pMessage, msg: protoRecord, repeated: true},
+	)
+)
+
+func init() {
+	protoNode.add(protoField{name: "callees", num: 5, kind: pMessage, msg: protoNode, repeated: true})
+	protoNode.optional["functionAddress"] = true
+	protoFrame.optional["functionAddress"] = true
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendTag(b []byte, num, wire int) []byte {
+	return appendUvarint(b, uint64(num)<<3|uint64(wire))
+}
+
+// appendBytes appends a length-delimited field.
+func appendBytes(b []byte, num int, data []byte) []byte {
+	b = appendTag(b, num, wireBytes)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// protoMarshal encodes v as a Record, or a Batch.
+func protoMarshal(v interface{}) ([]byte, error) {
+	if b, ok := v.(batch); ok {
+		return protoMarshalBatch(b)
+	}
+	t, err := tree(v)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := t.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("protobuf: cannot encode %T as a message", v)
+	}
+	return protoRecord.encode(nil, m)
+}
+
+func protoMarshalBatch(b batch) ([]byte, error) {
+	out := appendBytes(nil, 1, []byte(b.Topic))
+	meta, err := protoMarshal(b.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	out = appendBytes(out, 2, meta)
+	for _, item := range b.Items {
+		data, err := protoMarshal(item)
+		if err != nil {
+			return nil, err
+		}
+		out = appendBytes(out, 3, data)
+	}
+	return out, nil
+}
+
+// number returns the field number of name, or a number greater than all
+// others if name is not a field of m.
+func (m *protoMessage) number(name string) int {
+	if f, ok := m.byName[name]; ok {
+		return f.num
+	}
+	return math.MaxInt32
+}
+
+// encode appends the fields in v to b. Raw values are encoded fields, as
+// returned by protoFields, and are appended as they are.
+func (m *protoMessage) encode(b []byte, v map[string]interface{}) ([]byte, error) {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := m.number(names[i]), m.number(names[j])
+		if a != b {
+			return a < b
+		}
+		return names[i] < names[j]
+	})
+	var err error
+	for _, name := range names {
+		if r, ok := v[name].(raw); ok {
+			b = append(b, r...)
+			continue
+		}
+		f, ok := m.byName[name]
+		if !ok {
+			return nil, fmt.Errorf("protobuf: no field %q", name)
+		}
+		if b, err = f.encode(b, v[name]); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// encode appends the field f with value v to b.
+func (f protoField) encode(b []byte, v interface{}) ([]byte, error) {
+	if v == nil {
+		return b, nil
+	}
+	if f.repeated {
+		a, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("protobuf: field %q is not a list", f.name)
+		}
+		single := f
+		single.repeated = false
+		var err error
+		for _, x := range a {
+			if b, err = single.encode(b, x); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+
+	mismatch := fmt.Errorf("protobuf: field %q cannot hold %T", f.name, v)
+	switch f.kind {
+	case pString:
+		s, ok := v.(string)
+		if !ok {
+			return nil, mismatch
+		}
+		return appendBytes(b, f.num, []byte(s)), nil
+	case pInt64, pUint64:
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, mismatch
+		}
+		var u uint64
+		var err error
+		if f.kind == pInt64 {
+			var i int64
+			i, err = n.Int64()
+			u = uint64(i)
+		} else {
+			u, err = strconv.ParseUint(n.String(), 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("protobuf: field %q: %v", f.name, err)
+		}
+		return appendUvarint(appendTag(b, f.num, wireVarint), u), nil
+	case pBool:
+		x, ok := v.(bool)
+		if !ok {
+			return nil, mismatch
+		}
+		var u uint64
+		if x {
+			u = 1
+		}
+		return appendUvarint(appendTag(b, f.num, wireVarint), u), nil
+	case pMessage:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, mismatch
+		}
+		data, err := f.msg.encode(nil, m)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(b, f.num, data), nil
+	case pStruct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, mismatch
+		}
+		data, err := protoStruct(m)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(b, f.num, data), nil
+	case pValue:
+		data, err := protoValue(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(b, f.num, data), nil
+	}
+	return nil, mismatch
+}
+
+// protoStruct encodes m as a google.protobuf.Struct.
+func protoStruct(m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b []byte
+	for _, k := range keys {
+		value, err := protoValue(m[k])
+		if err != nil {
+			return nil, err
+		}
+		entry := appendBytes(nil, 1, []byte(k))
+		entry = appendBytes(entry, 2, value)
+		b = appendBytes(b, 1, entry)
+	}
+	return b, nil
+}
+
+// protoValue encodes v as a google.protobuf.Value. Numbers become doubles.
+func protoValue(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return appendUvarint(appendTag(nil, 1, wireVarint), 0), nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil && !isRangeError(err) {
+			return nil, err
+		}
+		b := appendTag(nil, 2, wireFixed64)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+		return append(b, buf[:]...), nil
+	case string:
+		return appendBytes(nil, 3, []byte(v)), nil
+	case bool:
+		var u uint64
+		if v {
+			u = 1
+		}
+		return appendUvarint(appendTag(nil, 4, wireVarint), u), nil
+	case map[string]interface{}:
+		s, err := protoStruct(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(nil, 5, s), nil
+	case []interface{}:
+		var list []byte
+		for _, x := range v {
+			value, err := protoValue(x)
+			if err != nil {
+				return nil, err
+			}
+			list = appendBytes(list, 1, value)
+		}
+		return appendBytes(nil, 6, list), nil
+	}
+	return nil, fmt.Errorf("protobuf: cannot encode %T as a value", v)
+}
+
+// isRangeError reports whether err is a strconv error for a number too
+// large to represent, which is nonetheless converted to infinity.
+func isRangeError(err error) bool {
+	e, ok := err.(*strconv.NumError)
+	return ok && e.Err == strconv.ErrRange
+}
+
+var errProtoSyntax = errors.New("protobuf: malformed message")
+
+// protoReader reads the fields of a protobuf message.
+type protoReader struct {
+	b   []byte
+	off int
+}
+
+func (r *protoReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.b[r.off:])
+	if n <= 0 {
+		return 0, errProtoSyntax
+	}
+	r.off += n
+	return v, nil
+}
+
+// next reads the next field, and returns its number, wire type, and value:
+// the varint or fixed value, or the contents of a length-delimited field.
+func (r *protoReader) next() (num, wire int, v uint64, data []byte, err error) {
+	tag, err := r.uvarint()
+	if err != nil {
+		return
+	}
+	num, wire = int(tag>>3), int(tag&7)
+	switch wire {
+	case wireVarint:
+		v, err = r.uvarint()
+	case wireFixed64:
+		if len(r.b)-r.off < 8 {
+			return 0, 0, 0, nil, errProtoSyntax
+		}
+		v = binary.LittleEndian.Uint64(r.b[r.off:])
+		r.off += 8
+	case wireFixed32:
+		if len(r.b)-r.off < 4 {
+			return 0, 0, 0, nil, errProtoSyntax
+		}
+		v = uint64(binary.LittleEndian.Uint32(r.b[r.off:]))
+		r.off += 4
+	case wireBytes:
+		var n uint64
+		if n, err = r.uvarint(); err != nil {
+			return
+		}
+		if n > uint64(len(r.b)-r.off) {
+			return 0, 0, 0, nil, errProtoSyntax
+		}
+		data = r.b[r.off : r.off+int(n)]
+		r.off += int(n)
+	default:
+		err = errProtoSyntax
+	}
+	return
+}
+
+func (r *protoReader) done() bool { return r.off == len(r.b) }
+
+// decode decodes the message b described by m. Unknown fields are skipped.
+func (m *protoMessage) decode(b []byte) (map[string]interface{}, error) {
+	v := make(map[string]interface{})
+	r := &protoReader{b: b}
+	for !r.done() {
+		num, wire, x, data, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		f, ok := m.byNum[num]
+		if !ok {
+			continue
+		}
+		value, err := f.decode(wire, x, data)
+		if err != nil {
+			return nil, err
+		}
+		if f.repeated {
+			a, _ := v[f.name].([]interface{})
+			v[f.name] = append(a, value)
+		} else {
+			v[f.name] = value
+		}
+	}
+	if m.defaults {
+		for name, f := range m.byName {
+			if _, ok := v[name]; ok {
+				continue
+			}
+			v[name] = f.zero(m.optional[name])
+		}
+	}
+	return v, nil
+}
+
+// zero returns the value of f when it is absent.
+func (f protoField) zero(optional bool) interface{} {
+	switch {
+	case f.repeated:
+		return []interface{}{}
+	case optional:
+		return nil
+	}
+	switch f.kind {
+	case pString:
+		return ""
+	case pInt64, pUint64:
+		return json.Number("0")
+	case pBool:
+		return false
+	}
+	return nil
+}
+
+func (f protoField) decode(wire int, x uint64, data []byte) (interface{}, error) {
+	expect := wireVarint
+	switch f.kind {
+	case pString, pMessage, pStruct, pValue:
+		expect = wireBytes
+	}
+	if wire != expect {
+		return nil, fmt.Errorf("protobuf: field %q has wire type %v", f.name, wire)
+	}
+	switch f.kind {
+	case pString:
+		return string(data), nil
+	case pInt64:
+		return json.Number(strconv.FormatInt(int64(x), 10)), nil
+	case pUint64:
+		return json.Number(strconv.FormatUint(x, 10)), nil
+	case pBool:
+		return x != 0, nil
+	case pMessage:
+		return f.msg.decode(data)
+	case pStruct:
+		return protoDecodeStruct(data)
+	}
+	return protoDecodeValue(data)
+}
+
+func protoDecodeStruct(b []byte) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	r := &protoReader{b: b}
+	for !r.done() {
+		num, wire, _, entry, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if num != 1 || wire != wireBytes {
+			continue
+		}
+		var key string
+		var value interface{} = nil
+		er := &protoReader{b: entry}
+		for !er.done() {
+			num, wire, _, data, err := er.next()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case num == 1 && wire == wireBytes:
+				key = string(data)
+			case num == 2 && wire == wireBytes:
+				if value, err = protoDecodeValue(data); err != nil {
+					return nil, err
+				}
+			}
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+func protoDecodeValue(b []byte) (interface{}, error) {
+	var v interface{}
+	r := &protoReader{b: b}
+	for !r.done() {
+		num, wire, x, data, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case num == 1 && wire == wireVarint:
+			v = nil
+		case num == 2 && wire == wireFixed64:
+			v = protoNumber(math.Float64frombits(x))
+		case num == 3 && wire == wireBytes:
+			v = string(data)
+		case num == 4 && wire == wireVarint:
+			v = x != 0
+		case num == 5 && wire == wireBytes:
+			if v, err = protoDecodeStruct(data); err != nil {
+				return nil, err
+			}
+		case num == 6 && wire == wireBytes:
+			list := []interface{}{}
+			lr := &protoReader{b: data}
+			for !lr.done() {
+				num, wire, _, item, err := lr.next()
+				if err != nil {
+					return nil, err
+				}
+				if num != 1 || wire != wireBytes {
+					continue
+				}
+				x, err := protoDecodeValue(item)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, x)
+			}
+			v = list
+		}
+	}
+	return v, nil
+}
+
+// protoNumber returns f as a JSON number, written without an exponent if it
+// is an integer of reasonable size.
+func protoNumber(f float64) json.Number {
+	if f == math.Trunc(f) && math.Abs(f) < 1e21 {
+		return json.Number(strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// protoFields splits the Record in data into its encoded fields, by name.
+// The value of each name holds all of its occurrences, tags included.
+func protoFields(data []byte) (map[string]raw, error) {
+	f := make(map[string]raw)
+	r := &protoReader{b: data}
+	for !r.done() {
+		start := r.off
+		num, _, _, _, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		name := strconv.Itoa(num)
+		if field, ok := protoRecord.byNum[num]; ok {
+			name = field.name
+		}
+		f[name] = append(f[name], data[start:r.off]...)
+	}
+	return f, nil
+}
+
+// protoEncodeField encodes the Record field name with value v.
+func protoEncodeField(name string, v interface{}) (raw, error) {
+	f, ok := protoRecord.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("protobuf: no field %q", name)
+	}
+	t, err := tree(v)
+	if err != nil {
+		return nil, err
+	}
+	return f.encode(nil, t)
+}
+
+// protoDecodeField decodes the Record field name, encoded in r, into v.
+func protoDecodeField(name string, r raw, v interface{}) error {
+	m, err := protoRecord.decode(r)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(m[name])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -13,7 +13,14 @@ import (
 	"github.com/aukletio/Auklet-Client-C/version"
 )
 
+// SchemaVersion is the version of the schema of broker messages, given in
+// their schemaVersion field. It must be incremented whenever a field of a
+// message is added, removed, renamed, or changes type.
+const SchemaVersion = 1
+
 type metadata struct {
+	SchemaVersion int `json:"schemaVersion"`
+
 	Version       string `json:"version"` // user-defined version
 	Username      string `json:"device"`
 	ClientVersion string `json:"clientVersion"`
@@ -25,6 +32,14 @@ type metadata struct {
 	UUID          string `json:"id"`        // identifier for this message
 	Time          int64  `json:"timestamp"` // Unix milliseconds
 	Error         string `json:"error,omitempty"`
+
+	// Uptime is the time since boot in milliseconds, by the monotonic
+	// clock. Boot identifies the boot. Both are set only if the Converter
+	// has a Clock, as is ClockUncertain, which means that Time may be
+	// wrong because the wall clock was not set.
+	Uptime         int64  `json:"uptime,omitempty"`
+	Boot           string `json:"boot,omitempty"`
+	ClockUncertain bool   `json:"clockUncertain,omitempty"`
 }
 
 func nowMilli() int64 {
@@ -32,7 +47,8 @@ func nowMilli() int64 {
 }
 
 func (c Converter) metadata() metadata {
-	return metadata{
+	m := metadata{
+		SchemaVersion: SchemaVersion,
 		Version:       c.UserVersion,
 		Username:      c.Username,
 		ClientVersion: version.Version,
@@ -40,10 +56,24 @@ func (c Converter) metadata() metadata {
 		AppID:         c.AppID,
 		CheckSum:      c.App.CheckSum(),
 		MacHash:       c.MacHash,
-		IP:            device.CurrentIP(),
+		IP:            c.publicIP(),
 		UUID:          uuid.NewV4().String(),
-		Time:          nowMilli(),
 	}
+	if c.Clock == nil {
+		m.Time = nowMilli()
+		return m
+	}
+	m.Time, m.Uptime = c.Clock.now().stamp()
+	m.Boot = c.Clock.Boot.ID
+	m.ClockUncertain = !c.Clock.synced
+	return m
+}
+
+func (c Converter) publicIP() string {
+	if c.IP == nil {
+		return ""
+	}
+	return c.IP.IP()
 }
 
 // profile represents profile data as expected by broker consumers.
@@ -80,6 +110,7 @@ type errorSig struct {
 	Signal  string         `json:"signal"`
 	Trace   []frame        `json:"stackTrace"`
 	Metrics device.Metrics `json:"systemMetrics"`
+	Usage   device.Usage   `json:"resourceUsage"`
 }
 
 type frame struct {
@@ -97,6 +128,7 @@ func (c Converter) errorSig(data []byte) errorSig {
 	e.metadata = c.metadata()
 	e.Status = c.App.ExitStatus()
 	e.Metrics = c.Monitor.GetMetrics()
+	e.Usage = c.App.Usage()
 	return e
 }
 
@@ -108,6 +140,7 @@ type exit struct {
 	Status  int            `json:"exitStatus"`
 	Signal  string         `json:"signal"`
 	Metrics device.Metrics `json:"systemMetrics"`
+	Usage   device.Usage   `json:"resourceUsage"`
 }
 
 func (c Converter) exit() exit {
@@ -116,6 +149,7 @@ func (c Converter) exit() exit {
 		Status:   c.App.ExitStatus(),
 		Signal:   c.App.Signal(),
 		Metrics:  c.Monitor.GetMetrics(),
+		Usage:    c.App.Usage(),
 	}
 }
 
@@ -0,0 +1,81 @@
+package schema
+
+import (
+	"encoding/json"
+
+	"github.com/spf13/afero"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+	"github.com/aukletio/Auklet-Client-C/errorlog"
+	"github.com/aukletio/Auklet-Client-C/fsutil"
+)
+
+// sequenceBlock is how many numbers are reserved on a topic at a time.
+const sequenceBlock = 100
+
+// Sequences numbers the messages on each topic consecutively from 1. So that
+// numbering continues across runs of the client without writing to storage
+// for every message, numbers are reserved in blocks, and the last number
+// reserved on each topic is saved at Path. The unused rest of a block is
+// skipped if the client stops without Close.
+type Sequences struct {
+	Path     string
+	Fs       afero.Fs
+	last     map[broker.Topic]uint64 // last number used
+	reserved map[broker.Topic]uint64 // last number saved at Path
+}
+
+// NewSequences returns the Sequences saved at path, or new ones if there are
+// none.
+func NewSequences(path string, fs afero.Fs) *Sequences {
+	s := &Sequences{
+		Path:     path,
+		Fs:       fs,
+		last:     make(map[broker.Topic]uint64),
+		reserved: make(map[broker.Topic]uint64),
+	}
+	b, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return s // no messages numbered yet
+	}
+	if err := json.Unmarshal(b, &s.last); err != nil {
+		errorlog.Printf("NewSequences: %v", err)
+	}
+	if s.last == nil {
+		s.last = make(map[broker.Topic]uint64)
+	}
+	for topic, n := range s.last {
+		s.reserved[topic] = n
+	}
+	return s
+}
+
+// next returns the next number on topic. A new block is reserved, and saved,
+// before its first number is used, so that no number is used twice.
+func (s *Sequences) next(topic broker.Topic) uint64 {
+	s.last[topic]++
+	if n := s.last[topic]; n > s.reserved[topic] {
+		s.reserved[topic] = n + sequenceBlock - 1
+		if err := s.save(s.reserved); err != nil {
+			errorlog.Printf("Sequences.next: %v", err)
+		}
+	}
+	return s.last[topic]
+}
+
+// Close saves the last numbers used, so that the next run skips none.
+func (s *Sequences) Close() {
+	if err := s.save(s.last); err != nil {
+		errorlog.Printf("Sequences.Close: %v", err)
+		return
+	}
+	for topic, n := range s.last {
+		s.reserved[topic] = n
+	}
+}
+
+// save writes the numbers in m to s.Path.
+func (s *Sequences) save(m map[broker.Topic]uint64) error {
+	b, _ := json.Marshal(m)
+	return fsutil.WriteFile(s.Fs.OpenFile, s.Path, b)
+}
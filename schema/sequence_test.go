@@ -0,0 +1,80 @@
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+)
+
+func TestSequences(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s := NewSequences("sequences.json", fs)
+	cases := []struct {
+		topic  broker.Topic
+		expect uint64
+	}{
+		{topic: broker.Profile, expect: 1},
+		{topic: broker.Profile, expect: 2},
+		{topic: broker.Event, expect: 1},
+	}
+	for i, c := range cases {
+		if got := s.next(c.topic); got != c.expect {
+			t.Errorf("case %v: expected %v, got %v", i, c.expect, got)
+		}
+	}
+
+	// After a crash, numbering skips the rest of the reserved block.
+	if got := NewSequences("sequences.json", fs).next(broker.Profile); got != sequenceBlock+1 {
+		t.Errorf("expected %v after crash, got %v", sequenceBlock+1, got)
+	}
+
+	// After Close, numbering continues where the last run left off.
+	s = NewSequences("closed.json", fs)
+	s.next(broker.Event)
+	s.next(broker.Event)
+	s.Close()
+	if got := NewSequences("closed.json", fs).next(broker.Event); got != 3 {
+		t.Errorf("expected 3 after reload, got %v", got)
+	}
+}
+
+func TestSequencesWrites(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s := NewSequences("sequences.json", fs)
+	for i := 0; i < sequenceBlock; i++ {
+		s.next(broker.Event)
+	}
+	// Only the first number of the block was saved.
+	fs.Remove("sequences.json")
+	s.next(broker.Event)
+	if _, err := fs.Stat("sequences.json"); err != nil {
+		t.Errorf("expected a new block saved, got %v", err)
+	}
+	fs.Remove("sequences.json")
+	s.next(broker.Event)
+	if _, err := fs.Stat("sequences.json"); err == nil {
+		t.Error("expected no write within a block")
+	}
+}
+
+func TestMarshalSequence(t *testing.T) {
+	conf := cfg
+	conf.Encoding = JSON
+	conf.Sequences = NewSequences("sequences.json", afero.NewMemMapFs())
+	c := newConverter(conf)
+	for seq := uint64(1); seq <= 2; seq++ {
+		m := c.marshal(c.exit(), broker.Event)
+		var got struct {
+			Sequence uint64 `json:"sequence"`
+		}
+		if err := json.Unmarshal(m.Bytes, &got); err != nil {
+			t.Fatal(err)
+		}
+		if m.Sequence != seq || got.Sequence != seq {
+			t.Errorf("expected sequence %v, got %v in message and %v in payload", seq, m.Sequence, got.Sequence)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package schema
+
+import (
+	"github.com/satori/go.uuid"
+
+	"github.com/aukletio/Auklet-Client-C/broker"
+)
+
+// Session holds the metadata shared by the messages of a run of the client.
+// It is published once, in a session record on the Session topic; other
+// messages carry only the session ID, and their own ID, timestamp and
+// sequence number.
+type Session struct {
+	id        string
+	static    *metadata // of the current session; nil until the first record
+	published bool      // whether the record of the current session is persisted
+	started   []string  // IDs of the sessions started by this run, hence this boot
+}
+
+// NewSession returns a Session that has not yet been published.
+func NewSession() *Session {
+	return new(Session)
+}
+
+// sessionRecord is the payload of a message on the Session topic.
+type sessionRecord struct {
+	metadata
+	Session string `json:"session"`
+}
+
+// static returns the fields of m that are published in session records.
+func static(m metadata) metadata {
+	m.UUID, m.Time, m.Error = "", 0, ""
+	m.Uptime, m.ClockUncertain = 0, false
+	return m
+}
+
+// record returns a session record, if the static metadata in m differs from
+// that of the current session, or if the record of the current session has
+// not been persisted. Since a session's metadata never changes, a changed
+// one starts a new session.
+func (c Converter) record(m metadata) (broker.Message, bool) {
+	s := c.Session
+	if st := static(m); s.static == nil || *s.static != st {
+		s.id = uuid.NewV4().String()
+		s.started = append(s.started, s.id)
+		s.static = &st
+		s.published = false
+	}
+	if s.published {
+		return broker.Message{}, false
+	}
+	return c.marshal(sessionRecord{metadata: m, Session: s.id}, broker.Session), true
+}
+
+// compact replaces the shared metadata in the encoded message fields f with
+// the session ID.
+func (c Converter) compact(f map[string]raw) (err error) {
+	for _, name := range shared {
+		delete(f, name)
+	}
+	f["session"], err = c.Encoding.encodeField("session", c.Session.id)
+	return
+}
@@ -0,0 +1,101 @@
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"github.com/aukletio/Auklet-Client-C/agent"
+	"github.com/aukletio/Auklet-Client-C/broker"
+)
+
+// changingIP is an IPProvider whose address can be changed.
+type changingIP struct{ ip *string }
+
+func (c changingIP) IP() string { return *c.ip }
+
+func TestSession(t *testing.T) {
+	addr := "1.2.3.4"
+	c := cfg
+	c.Encoding = JSON
+	c.IP = changingIP{&addr}
+	c.Session = NewSession()
+	c.Sequences = NewSequences("sequences.json", afero.NewMemMapFs())
+
+	s := make(source)
+	converter := NewConverter(c, s)
+	dp := agent.Message{Type: "datapoint", Data: json.RawMessage(`{"type": "t", "payload": {}}`)}
+
+	type message struct {
+		Session  string `json:"session"`
+		Sequence uint64 `json:"sequence"`
+		Device   string `json:"device"`
+		IP       string `json:"publicIP"`
+	}
+	next := func() (broker.Topic, message) {
+		m := <-converter.Output()
+		var got message
+		if err := json.Unmarshal(m.Bytes, &got); err != nil {
+			t.Fatal(err)
+		}
+		return m.Topic, got
+	}
+
+	// The session record precedes the messages of its session.
+	topic, rec := next()
+	if topic != broker.Session || rec.Session == "" || rec.Sequence != 1 || rec.Device != "username" || rec.IP != addr {
+		t.Errorf("expected session record, got %v %+v", topic, rec)
+	}
+	for seq := uint64(1); seq <= 2; seq++ {
+		s <- dp
+		topic, got := next()
+		if topic != broker.DataPoint || got.Session != rec.Session || got.Sequence != seq || got.Device != "" {
+			t.Errorf("expected datapoint %v of session %v, got %v %+v", seq, rec.Session, topic, got)
+		}
+	}
+
+	// A change of metadata starts a new session.
+	addr = "5.6.7.8"
+	s <- dp
+	topic, rec2 := next()
+	if topic != broker.Session || rec2.Session == rec.Session || rec2.Sequence != 2 || rec2.IP != addr {
+		t.Errorf("expected new session record, got %v %+v", topic, rec2)
+	}
+	// Numbering continues across sessions.
+	if _, got := next(); got.Session != rec2.Session || got.Sequence != 3 {
+		t.Errorf("expected datapoint 3 of session %v, got %+v", rec2.Session, got)
+	}
+	close(s)
+}
+
+func TestSessionStorageFull(t *testing.T) {
+	limit := make(chan *int64)
+	c := cfg
+	c.Encoding = JSON
+	c.Persistor = broker.NewPersistor("msgs", afero.NewMemMapFs(), limit)
+	c.Session = NewSession()
+	var full int64
+	limit <- &full
+
+	s := make(source)
+	converter := NewConverter(c, s)
+	// The record of the session cannot be persisted.
+	if m := <-converter.Output(); m.Topic != broker.Log || m.Error == "" {
+		t.Fatalf("expected storage error, got %+v", m)
+	}
+
+	limit <- nil
+	s <- agent.Message{Type: "datapoint", Data: json.RawMessage(`{"type": "t", "payload": {}}`)}
+	m := <-converter.Output()
+	var rec struct {
+		Session string `json:"session"`
+	}
+	if err := json.Unmarshal(m.Bytes, &rec); err != nil || m.Topic != broker.Session || rec.Session == "" {
+		t.Fatalf("expected session record sent again, got %v %s", m.Topic, m.Bytes)
+	}
+	if m := <-converter.Output(); m.Topic != broker.DataPoint {
+		t.Errorf("expected datapoint, got %v", m.Topic)
+	}
+	close(s)
+}